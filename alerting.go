@@ -0,0 +1,498 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/smtp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Alerting ///////////////////////////////////////////////////////////////////
+
+// The rules are checked at every interval. An alert is sent to the notifiers
+// when a rule starts firing, and again when it is resolved; not while it
+// keeps firing. Silenced alerts are tracked, but not sent.
+
+// alertConfig configures alerting. Zero values are replaced by defaults.
+type alertConfig struct {
+	Interval  duration // how often the rules are checked
+	Rules     []alertRule
+	Notifiers []notifierConfig
+}
+
+// Default alerting
+var defaultAlertConfig = alertConfig{
+	Interval: duration{30 * time.Second},
+}
+
+// Kinds of alert rules
+const (
+	ruleDisconnected = "disconnected" // automat disconnected longer than For
+	ruleSIPPool      = "sip-pool"     // fewer than Min working SIP connections
+	ruleErrorRate    = "error-rate"   // over MaxErrorRate % failed transactions within For, of at least Min
+	ruleIdle         = "idle"         // automat without transactions for For, within Hours
+)
+
+// alertRule is a condition to alert on.
+type alertRule struct {
+	Name         string
+	Kind         string // see rule* kinds
+	For          duration
+	Min          int
+	MaxErrorRate float64  // percent
+	Hours        string   // idle: "09:00-20:00", every day
+	Automats     []string // names of the automats to check; all if none
+}
+
+// Notifier types
+const (
+	notifyLog     = "log"
+	notifyWebhook = "webhook" // POSTs the alert as JSON to URL
+	notifySMTP    = "smtp"    // mails the alert through SMTPServer
+)
+
+// notifierConfig configures a notifier.
+type notifierConfig struct {
+	Type       string
+	URL        string   // webhook
+	SMTPServer string   // smtp: host:port, without authentication
+	From       string   // smtp
+	To         []string // smtp
+}
+
+// Alert statuses
+const (
+	alertFiring   = "FIRING"
+	alertResolved = "RESOLVED"
+)
+
+// alert is a rule firing, for an automat or the hub.
+type alert struct {
+	Rule     string
+	Subject  string // name of the automat, or "hub"
+	Status   string // FIRING or RESOLVED
+	Message  string
+	Since    time.Time // firing since
+	Resolved time.Time // zero while firing
+	Silenced bool
+
+	notified bool // FIRING sent
+}
+
+func (a *alert) key() string {
+	return a.Rule + "/" + a.Subject
+}
+
+// alertSubjectHub is the subject of alerts about the hub itself.
+const alertSubjectHub = "hub"
+
+// validate checks the alerting config, reporting problems to add.
+func (c *alertConfig) validate(add func(format string, args ...interface{})) {
+	names := make(map[string]bool)
+	for i, r := range c.Rules {
+		if r.Name == "" || names[r.Name] {
+			add("Alerts.Rules[%d]: Name missing or not unique: %q", i, r.Name)
+		}
+		names[r.Name] = true
+		switch r.Kind {
+		case ruleDisconnected, ruleSIPPool:
+		case ruleErrorRate:
+			if r.For.Duration <= 0 || r.MaxErrorRate <= 0 {
+				add("Alerts.Rules[%d] %q: error-rate needs For and MaxErrorRate", i, r.Name)
+			}
+		case ruleIdle:
+			if _, _, err := parseHours(r.Hours); err != nil {
+				add("Alerts.Rules[%d] %q: %v", i, r.Name, err)
+			}
+			if r.For.Duration <= 0 {
+				add("Alerts.Rules[%d] %q: idle needs For", i, r.Name)
+			}
+		default:
+			add("Alerts.Rules[%d] %q: unknown Kind: %q", i, r.Name, r.Kind)
+		}
+	}
+	for i, n := range c.Notifiers {
+		if _, err := newNotifier(n); err != nil {
+			add("Alerts.Notifiers[%d]: %v", i, err)
+		}
+	}
+}
+
+// parseHours parses opening hours, "09:00-20:00", into minutes after
+// midnight.
+func parseHours(s string) (from, to int, err error) {
+	var h1, m1, h2, m2 int
+	if _, err := fmt.Sscanf(s, "%d:%d-%d:%d", &h1, &m1, &h2, &m2); err != nil ||
+		h1 > 24 || h2 > 24 || m1 > 59 || m2 > 59 || h1*60+m1 >= h2*60+m2 {
+		return 0, 0, fmt.Errorf("Hours must be like \"09:00-20:00\", not %q", s)
+	}
+	return h1*60 + m1, h2*60 + m2, nil
+}
+
+// notifier sends alerts somewhere.
+type notifier interface {
+	notify(a alert) error
+}
+
+func newNotifier(c notifierConfig) (notifier, error) {
+	switch c.Type {
+	case notifyLog:
+		return logNotifier{}, nil
+	case notifyWebhook:
+		if c.URL == "" {
+			return nil, fmt.Errorf("webhook notifier needs URL")
+		}
+		return &webhookNotifier{url: c.URL, client: &http.Client{Timeout: 10 * time.Second}}, nil
+	case notifySMTP:
+		if c.SMTPServer == "" || c.From == "" || len(c.To) == 0 {
+			return nil, fmt.Errorf("smtp notifier needs SMTPServer, From and To")
+		}
+		return &smtpNotifier{addr: c.SMTPServer, from: c.From, to: c.To}, nil
+	}
+	return nil, fmt.Errorf("unknown notifier Type: %q", c.Type)
+}
+
+// logNotifier writes alerts to the log.
+type logNotifier struct{}
+
+func (logNotifier) notify(a alert) error {
+	level := "WARN"
+	if a.Status == alertResolved {
+		level = "INFO"
+	}
+	log.Println(level, "ALERT", a.Status, a.key()+":", a.Message)
+	return nil
+}
+
+// webhookNotifier posts alerts as JSON.
+type webhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func (n *webhookNotifier) notify(a alert) error {
+	b, _ := json.Marshal(a)
+	resp, err := n.client.Post(n.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook %s responded: %s", n.url, resp.Status)
+	}
+	return nil
+}
+
+// smtpNotifier mails alerts.
+type smtpNotifier struct {
+	addr string
+	from string
+	to   []string
+}
+
+func (n *smtpNotifier) notify(a alert) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", n.from)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(n.to, ", "))
+	fmt.Fprintf(&b, "Subject: [automathub] %s %s\r\n", a.Status, a.key())
+	fmt.Fprintf(&b, "\r\n%s\r\n\r\nSince: %s\r\n", a.Message, a.Since.Format(time.RFC1123))
+	if a.Status == alertResolved {
+		fmt.Fprintf(&b, "Resolved: %s\r\n", a.Resolved.Format(time.RFC1123))
+	}
+	return smtp.SendMail(n.addr, nil, n.from, n.to, []byte(b.String()))
+}
+
+// alertSample is the transaction counts at a check, for error rates.
+type alertSample struct {
+	time                   time.Time
+	transactions, failures int64
+}
+
+// alertSilence keeps a rule from notifying until a time. Subject "*"
+// silences the rule for all subjects.
+type alertSilence struct {
+	Rule    string
+	Subject string
+	Until   time.Time
+}
+
+// alerter checks the alert rules, and notifies.
+type alerter struct {
+	cfg       alertConfig
+	notifiers []notifier
+	stats     *appMetrics
+	automats  func() []automat // configured automats
+	poolSize  func() int       // SIP connections; nil without a SIP pool
+	now       func() time.Time
+
+	mu       sync.Mutex
+	active   map[string]*alert        // firing, by key
+	silences map[string]*alertSilence // by rule/subject
+	samples  []alertSample
+}
+
+func newAlerter(c alertConfig, m *appMetrics, automats func() []automat) *alerter {
+	if c.Interval.Duration == 0 {
+		c.Interval = defaultAlertConfig.Interval
+	}
+	a := &alerter{
+		cfg:      c,
+		stats:    m,
+		automats: automats,
+		now:      time.Now,
+		active:   make(map[string]*alert),
+		silences: make(map[string]*alertSilence),
+	}
+	for _, nc := range c.Notifiers {
+		n, err := newNotifier(nc)
+		if err != nil {
+			log.Println("ERROR", "alerting:", err)
+			continue
+		}
+		a.notifiers = append(a.notifiers, n)
+	}
+	return a
+}
+
+// run checks the rules at every interval, until quit is closed.
+func (a *alerter) run(quit <-chan bool) {
+	if len(a.cfg.Rules) == 0 {
+		return
+	}
+	ticker := time.NewTicker(a.cfg.Interval.Duration)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			a.check()
+		case <-quit:
+			return
+		}
+	}
+}
+
+// check evaluates the rules, and notifies about alerts that started firing
+// or were resolved since the last check.
+func (a *alerter) check() {
+	now := a.now()
+	exp := a.stats.Export()
+	a.samples = append(a.samples, alertSample{now, exp.Transactions, exp.Failures})
+
+	firing := make(map[string]alert)
+	for _, r := range a.cfg.Rules {
+		for _, al := range a.evaluate(r, now, exp) {
+			al.Rule, al.Status = r.Name, alertFiring
+			firing[al.key()] = al
+		}
+	}
+	a.pruneSamples(now)
+
+	var send []alert
+	a.mu.Lock()
+	for k, al := range firing {
+		active, ok := a.active[k]
+		if !ok {
+			al := al
+			active = &al
+			a.active[k] = active
+		}
+		// new, or no longer silenced
+		if !active.notified && !a.silenced(active, now) {
+			active.notified = true
+			send = append(send, *active)
+		}
+	}
+	for k, al := range a.active {
+		if _, ok := firing[k]; ok {
+			continue
+		}
+		delete(a.active, k)
+		al.Status, al.Resolved = alertResolved, now
+		if al.notified && !a.silenced(al, now) {
+			send = append(send, *al)
+		}
+	}
+	for k, s := range a.silences {
+		if !now.Before(s.Until) {
+			delete(a.silences, k)
+		}
+	}
+	a.mu.Unlock()
+
+	sort.Slice(send, func(i, j int) bool { return send[i].key() < send[j].key() })
+	for _, al := range send {
+		for _, n := range a.notifiers {
+			if err := n.notify(al); err != nil {
+				log.Println("ERROR", "alerting:", err)
+			}
+		}
+	}
+}
+
+// evaluate returns the alerts of a rule; Rule and Status are set by check.
+func (a *alerter) evaluate(r alertRule, now time.Time, exp *exportMetrics) []alert {
+	var alerts []alert
+	switch r.Kind {
+	case ruleDisconnected:
+		for _, ac := range a.watched(r) {
+			st, ok := exp.Automats[ac.IP]
+			if ok && st.Connections > 0 {
+				continue
+			}
+			since := a.stats.StartTime
+			if ok && !st.Since.IsZero() {
+				since = st.Since
+			}
+			if now.Sub(since) >= r.For.Duration {
+				alerts = append(alerts, alert{Subject: ac.Name, Since: since,
+					Message: fmt.Sprintf("%s has been disconnected since %s", ac.Name, since.Format("02/01 15:04"))})
+			}
+		}
+	case ruleSIPPool:
+		if a.poolSize == nil {
+			break
+		}
+		if n := a.poolSize(); n < r.Min {
+			alerts = append(alerts, alert{Subject: alertSubjectHub, Since: now,
+				Message: fmt.Sprintf("%d SIP connections, want at least %d", n, r.Min)})
+		}
+	case ruleErrorRate:
+		base := a.samples[0]
+		for _, s := range a.samples {
+			if now.Sub(s.time) < r.For.Duration {
+				break
+			}
+			base = s
+		}
+		n, failed := exp.Transactions-base.transactions, exp.Failures-base.failures
+		if n > 0 && n >= int64(r.Min) {
+			if rate := float64(failed) * 100 / float64(n); rate > r.MaxErrorRate {
+				alerts = append(alerts, alert{Subject: alertSubjectHub, Since: now,
+					Message: fmt.Sprintf("%.0f%% of %d transactions failed in the last %v", rate, n, r.For.Duration)})
+			}
+		}
+	case ruleIdle:
+		from, to, err := parseHours(r.Hours)
+		if err != nil {
+			break
+		}
+		midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+		open, closed := midnight.Add(time.Duration(from)*time.Minute), midnight.Add(time.Duration(to)*time.Minute)
+		if now.Before(open) || !now.Before(closed) {
+			break
+		}
+		for _, ac := range a.watched(r) {
+			st, ok := exp.Automats[ac.IP]
+			if !ok || st.Connections == 0 {
+				continue // the disconnected rule is for that
+			}
+			if st.Maintenance || st.Hours == hoursClosed {
+				continue // idle on purpose
+			}
+			since := st.LastTransaction
+			for _, t := range []time.Time{open, st.Since} {
+				if t.After(since) {
+					since = t
+				}
+			}
+			if now.Sub(since) >= r.For.Duration {
+				alerts = append(alerts, alert{Subject: ac.Name, Since: since,
+					Message: fmt.Sprintf("no transactions at %s since %s", ac.Name, since.Format("15:04"))})
+			}
+		}
+	}
+	return alerts
+}
+
+// watched returns the automats a rule checks.
+func (a *alerter) watched(r alertRule) []automat {
+	all := a.automats()
+	if len(r.Automats) == 0 {
+		return all
+	}
+	var w []automat
+	for _, ac := range all {
+		for _, name := range r.Automats {
+			if ac.Name == name {
+				w = append(w, ac)
+			}
+		}
+	}
+	return w
+}
+
+// pruneSamples drops the samples no error rate rule needs any more.
+func (a *alerter) pruneSamples(now time.Time) {
+	var keep time.Duration
+	for _, r := range a.cfg.Rules {
+		if r.Kind == ruleErrorRate && r.For.Duration > keep {
+			keep = r.For.Duration
+		}
+	}
+	i := 0
+	// the newest sample older than keep is the base of the longest window
+	for i+1 < len(a.samples) && now.Sub(a.samples[i+1].time) >= keep {
+		i++
+	}
+	a.samples = a.samples[i:]
+}
+
+// silenced reports if an alert is silenced. Must be called with a.mu held.
+func (a *alerter) silenced(al *alert, now time.Time) bool {
+	for _, k := range []string{al.key(), al.Rule + "/*"} {
+		if s, ok := a.silences[k]; ok && now.Before(s.Until) {
+			return true
+		}
+	}
+	return false
+}
+
+// silence keeps a rule from notifying about subject, or all subjects if
+// subject is "", for d. A zero d lifts the silence.
+func (a *alerter) silence(rule, subject string, d time.Duration) {
+	if subject == "" {
+		subject = "*"
+	}
+	s := &alertSilence{Rule: rule, Subject: subject, Until: a.now().Add(d)}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if d <= 0 {
+		delete(a.silences, rule+"/"+subject)
+		return
+	}
+	a.silences[rule+"/"+subject] = s
+}
+
+// alertStatus is the firing alerts and the silences.
+type alertStatus struct {
+	Active   []alert
+	Silences []alertSilence
+}
+
+func (a *alerter) status() alertStatus {
+	now := a.now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	st := alertStatus{Active: []alert{}, Silences: []alertSilence{}}
+	for _, al := range a.active {
+		c := *al
+		c.Silenced = a.silenced(al, now)
+		st.Active = append(st.Active, c)
+	}
+	for _, s := range a.silences {
+		if now.Before(s.Until) {
+			st.Silences = append(st.Silences, *s)
+		}
+	}
+	sort.Slice(st.Active, func(i, j int) bool { return st.Active[i].key() < st.Active[j].key() })
+	sort.Slice(st.Silences, func(i, j int) bool {
+		return st.Silences[i].Rule+"/"+st.Silences[i].Subject < st.Silences[j].Rule+"/"+st.Silences[j].Subject
+	})
+	return st
+}
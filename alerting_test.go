@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/knakk/specs"
+)
+
+// startTestSMTP starts an SMTP server that passes the mails it gets on.
+func startTestSMTP(t *testing.T) (string, chan string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mails := make(chan string, 10)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				r := bufio.NewReader(c)
+				c.Write([]byte("220 test ESMTP\r\n"))
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					switch cmd := strings.ToUpper(strings.Fields(line + " x")[0]); cmd {
+					case "DATA":
+						c.Write([]byte("354 go ahead\r\n"))
+						var mail strings.Builder
+						for {
+							l, err := r.ReadString('\n')
+							if err != nil || l == ".\r\n" {
+								break
+							}
+							mail.WriteString(l)
+						}
+						mails <- mail.String()
+						c.Write([]byte("250 OK\r\n"))
+					case "QUIT":
+						c.Write([]byte("221 bye\r\n"))
+						return
+					default:
+						c.Write([]byte("250 OK\r\n"))
+					}
+				}
+			}(c)
+		}
+	}()
+	return ln.Addr().String(), mails
+}
+
+func TestAlerting(t *testing.T) {
+	s := specs.New(t)
+	var (
+		mu  sync.Mutex
+		got []alert
+	)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var a alert
+		json.NewDecoder(r.Body).Decode(&a)
+		mu.Lock()
+		got = append(got, a)
+		mu.Unlock()
+	}))
+	defer hook.Close()
+	sent := func() []alert {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]alert(nil), got...)
+	}
+
+	m := RegisterMetrics(2)
+	automats := []automat{{IP: "10.0.0.1", Name: "Røa1"}, {IP: "10.0.0.2", Name: "Hoved1"}}
+	a := newAlerter(alertConfig{
+		Rules: []alertRule{
+			{Name: "offline", Kind: ruleDisconnected, For: duration{time.Hour}},
+			{Name: "errors", Kind: ruleErrorRate, For: duration{10 * time.Minute}, Min: 10, MaxErrorRate: 50},
+			{Name: "sip", Kind: ruleSIPPool, Min: 2},
+		},
+		Notifiers: []notifierConfig{{Type: notifyWebhook, URL: hook.URL}},
+	}, m, func() []automat { return automats })
+	pool := 2
+	a.poolSize = func() int { return pool }
+	now := time.Now()
+	a.now = func() time.Time { return now }
+
+	m.AutomatConnected("10.0.0.2", true)
+	a.check()
+	s.Expect(0, len(sent()))
+
+	// Røa1 has not been seen since the hub started
+	now = now.Add(2 * time.Hour)
+	a.check()
+	s.Expect(1, len(sent()))
+	s.Expect("offline", sent()[0].Rule)
+	s.Expect("Røa1", sent()[0].Subject)
+	s.Expect(alertFiring, sent()[0].Status)
+
+	// no repeats while firing
+	a.check()
+	s.Expect(1, len(sent()))
+	s.Expect(1, len(a.status().Active))
+
+	m.AutomatConnected("10.0.0.1", true)
+	a.check()
+	s.Expect(2, len(sent()))
+	s.Expect(alertResolved, sent()[1].Status)
+	s.Expect(0, len(a.status().Active))
+
+	// silenced
+	a.silence("offline", "", 24*time.Hour)
+	m.AutomatConnected("10.0.0.1", false)
+	now = now.Add(2 * time.Hour)
+	a.check()
+	s.Expect(2, len(sent()))
+	st := a.status()
+	s.Expect(1, len(st.Active))
+	s.Expect(true, st.Active[0].Silenced)
+	s.Expect("*", st.Silences[0].Subject)
+	// ... and notified when the silence is lifted
+	a.silence("offline", "", 0)
+	a.check()
+	s.Expect(3, len(sent()))
+	m.AutomatConnected("10.0.0.1", true)
+
+	pool = 1
+	m.Transaction("10.0.0.1", usageCounts{Checkouts: 5, Failures: 7})
+	now = now.Add(time.Minute)
+	a.check()
+	s.Expect(6, len(sent())) // errors firing, offline resolved, sip firing
+	s.Expect("errors", sent()[3].Rule)
+	s.Expect("sip", sent()[5].Rule)
+	s.Expect("1 SIP connections, want at least 2", sent()[5].Message)
+
+	// the failures are out of the window
+	now = now.Add(15 * time.Minute)
+	a.check()
+	s.Expect(7, len(sent()))
+	s.Expect("errors", sent()[6].Rule)
+	s.Expect(alertResolved, sent()[6].Status)
+}
+
+func TestIdleAlert(t *testing.T) {
+	s := specs.New(t)
+	m := RegisterMetrics(1)
+	a := newAlerter(alertConfig{Rules: []alertRule{
+		{Name: "idle", Kind: ruleIdle, For: duration{2 * time.Hour}, Hours: "09:00-20:00"}},
+	}, m, func() []automat { return []automat{{IP: "10.0.0.1", Name: "Røa1"}} })
+	m.AutomatConnected("10.0.0.1", true)
+	m.automats["10.0.0.1"].Since = time.Date(2014, 1, 24, 7, 0, 0, 0, time.Local)
+
+	at := func(h, min int) []alert {
+		return a.evaluate(a.cfg.Rules[0], time.Date(2014, 1, 24, h, min, 0, 0, time.Local), m.Export())
+	}
+	s.Expect(0, len(at(8, 0)))
+	s.Expect(0, len(at(10, 59)))
+	s.Expect(1, len(at(11, 0)))
+	s.Expect(0, len(at(21, 0)))
+	m.automats["10.0.0.1"].LastTransaction = time.Date(2014, 1, 24, 10, 0, 0, 0, time.Local)
+	s.Expect(0, len(at(11, 0)))
+}
+
+func TestSMTPNotifier(t *testing.T) {
+	s := specs.New(t)
+	addr, mails := startTestSMTP(t)
+	n, err := newNotifier(notifierConfig{Type: notifySMTP, SMTPServer: addr, From: "hub@deichman.no", To: []string{"drift@deichman.no"}})
+	s.ExpectNil(err)
+	s.ExpectNil(n.notify(alert{Rule: "offline", Subject: "Røa1", Status: alertFiring, Message: "Røa1 has been disconnected since 24/01 08:00"}))
+	select {
+	case mail := <-mails:
+		s.Expect(true, strings.Contains(mail, "Subject: [automathub] FIRING offline/Røa1"))
+		s.Expect(true, strings.Contains(mail, "Røa1 has been disconnected"))
+	case <-time.After(time.Second):
+		t.Fatal("no mail")
+	}
+}
+
+func TestAlertConfigValidate(t *testing.T) {
+	s := specs.New(t)
+	var problems []string
+	c := alertConfig{
+		Rules: []alertRule{
+			{Name: "a", Kind: ruleDisconnected},
+			{Name: "a", Kind: "sunspots"},
+			{Name: "b", Kind: ruleIdle, For: duration{time.Hour}, Hours: "20:00-09:00"},
+		},
+		Notifiers: []notifierConfig{{Type: notifyLog}, {Type: notifySMTP}},
+	}
+	c.validate(func(format string, args ...interface{}) { problems = append(problems, format) })
+	s.Expect(4, len(problems))
+}
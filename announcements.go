@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Announcements are messages from the staff to the patrons at the automats,
+// i.e. "the library closes in 15 minutes". They are shown by the UIs of the
+// automats targeted, from From until To.
+
+// announcement is a message to the automats of a branch, a single automat,
+// or all of them if neither is given.
+type announcement struct {
+	ID       int
+	Text     string
+	Branch   string `json:",omitempty"` // department
+	Automat  string `json:",omitempty"` // name or IP
+	From     time.Time
+	To       time.Time
+	Priority int // higher first
+}
+
+// targets reports if the announcement is for the automat.
+func (a announcement) targets(name, ip, dept string) bool {
+	switch {
+	case a.Automat != "":
+		return a.Automat == name || a.Automat == ip
+	case a.Branch != "":
+		return a.Branch == dept
+	}
+	return true
+}
+
+// announcementStore keeps the announcements which haven't ended. It is safe
+// to use from several goroutines.
+type announcementStore struct {
+	mu   sync.Mutex
+	list []announcement
+	next int
+	now  func() time.Time
+}
+
+func newAnnouncementStore() *announcementStore {
+	return &announcementStore{next: 1, now: time.Now}
+}
+
+// add stores an announcement, and returns it with its ID. It starts now if
+// From isn't given.
+func (s *announcementStore) add(a announcement) (announcement, error) {
+	a.Text = strings.TrimSpace(a.Text)
+	if a.Text == "" {
+		return a, errors.New("no text")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	if a.From.IsZero() {
+		a.From = now
+	}
+	if !a.To.After(a.From) || !a.To.After(now) {
+		return a, errors.New("the announcement must end after it starts, and in the future")
+	}
+	a.ID = s.next
+	s.next++
+	s.list = append(s.list, a)
+	return a, nil
+}
+
+// remove deletes the announcement with the given ID. It reports if there
+// was one.
+func (s *announcementStore) remove(id int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, a := range s.list {
+		if a.ID == id {
+			s.list = append(s.list[:i], s.list[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// all returns the announcements which haven't ended, active or not.
+func (s *announcementStore) all() []announcement {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	list := s.list[:0]
+	for _, a := range s.list {
+		if a.To.After(now) {
+			list = append(list, a)
+		}
+	}
+	s.list = list
+	return append([]announcement{}, list...)
+}
+
+// active returns the announcements for an automat to show now, highest
+// priority first. A nil store has none.
+func (s *announcementStore) active(name, ip, dept string) []announcement {
+	if s == nil {
+		return nil
+	}
+	now := s.now()
+	var list []announcement
+	for _, a := range s.all() {
+		if !now.Before(a.From) && a.targets(name, ip, dept) {
+			list = append(list, a)
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Priority > list[j].Priority })
+	return list
+}
+
+// announcementIDs identifies a list of announcements, to tell if it has
+// changed.
+func announcementIDs(list []announcement) string {
+	ids := make([]string, len(list))
+	for i, a := range list {
+		ids[i] = strconv.Itoa(a.ID)
+	}
+	return strings.Join(ids, ",")
+}
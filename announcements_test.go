@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/knakk/specs"
+)
+
+func TestAnnouncementStore(t *testing.T) {
+	s := specs.New(t)
+	now := time.Date(2014, 1, 24, 10, 0, 0, 0, time.Local)
+	st := newAnnouncementStore()
+	st.now = func() time.Time { return now }
+
+	_, err := st.add(announcement{Text: " ", To: now.Add(time.Hour)})
+	s.Expect(true, err != nil)
+	_, err = st.add(announcement{Text: "for nobody", From: now, To: now})
+	s.Expect(true, err != nil)
+
+	all, _ := st.add(announcement{Text: "Lån er gratis i dag", To: now.Add(8 * time.Hour)})
+	roa, _ := st.add(announcement{Text: "Biblioteket stenger om 15 minutter", Branch: "ROA",
+		From: now.Add(time.Hour), To: now.Add(2 * time.Hour), Priority: 1})
+	one, _ := st.add(announcement{Text: "Skriveren er tom for papir", Automat: "Røa1", To: now.Add(time.Hour)})
+	s.Expect(1, all.ID)
+	s.Expect(3, one.ID)
+	s.Expect(now, all.From)
+
+	ids := func(name, ip, dept string) string {
+		return announcementIDs(st.active(name, ip, dept))
+	}
+	s.Expect("1,3", ids("Røa1", "10.0.0.1", "ROA"))
+	s.Expect("1", ids("Røa2", "10.0.0.2", "ROA"))
+	s.Expect("1", ids("Hoved1", "10.0.0.3", "HUTL"))
+
+	// started, by priority; the one for Røa1 has ended
+	now = now.Add(time.Hour)
+	s.Expect("2,1", ids("Røa1", "10.0.0.1", "ROA"))
+	s.Expect(2, len(st.all()))
+
+	// ended
+	now = now.Add(time.Hour)
+	s.Expect("1", ids("Røa1", "10.0.0.1", "ROA"))
+	s.Expect(1, len(st.all()))
+	s.Expect(false, st.remove(roa.ID))
+	s.Expect(true, st.remove(all.ID))
+	s.Expect("", ids("Røa1", "10.0.0.1", "ROA"))
+}
+
+func TestAnnouncementsHandler(t *testing.T) {
+	s := specs.New(t)
+	app := newTestApp(t, &fakeBackend{})
+	defer app.Close()
+	_, port, _ := net.SplitHostPort(app.TCPAddr())
+	conn, err := net.Dial("tcp", "127.0.0.1:"+port)
+	s.ExpectNil(err)
+	defer conn.Close()
+	a := waitAutomat(t, app, conn.LocalAddr().String())
+
+	w := httptest.NewRecorder()
+	app.announcementsHandler(w, httptest.NewRequest("POST", "/.announcements?text=Biblioteket+stenger+om+15+minutter&branch=HUTL&for=15m&priority=1", nil))
+	s.Expect(http.StatusOK, w.Code)
+	var list []announcement
+	s.ExpectNil(json.Unmarshal(w.Body.Bytes(), &list))
+	s.Expect(1, len(list))
+	s.Expect(15*time.Minute, list[0].To.Sub(list[0].From))
+
+	// the UI gets it
+	cancel := make(chan bool)
+	time.AfterFunc(time.Second, func() { close(cancel) })
+	var got UIAnnouncements
+	for got.Action != "ANNOUNCEMENTS" {
+		m, ok := a.ToUI.Get(cancel)
+		if !ok {
+			t.Fatal("no announcements sent to the UI")
+		}
+		json.Unmarshal(m, &got)
+	}
+	s.Expect(1, len(got.Announcements))
+	s.Expect("Biblioteket stenger om 15 minutter", got.Announcements[0].Text)
+
+	w = httptest.NewRecorder()
+	app.announcementsHandler(w, httptest.NewRequest("POST", "/.announcements?text=x&to=tomorrow", nil))
+	s.Expect(http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	app.announcementsHandler(w, httptest.NewRequest("DELETE", "/.announcements?id=1", nil))
+	s.Expect(http.StatusOK, w.Code)
+	s.Expect("[]", w.Body.String())
+}
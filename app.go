@@ -0,0 +1,204 @@
+package main
+
+import (
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// App is an automathub: the TCP server for the RFID services, the library
+// system backend, the websocket hub and the HTTP handlers, built from one
+// config. Several Apps can run in one process.
+type App struct {
+	cfg        *config // as started; reloaded settings are in server.config()
+	configFile string
+	logOutput  *levelWriter
+
+	backend   Backend
+	sipPool   *ConnPool // nil unless the SIP backend is used
+	stats     *appMetrics
+	guard     *loginGuard
+	usage     *usageStore
+	alerts    *alerter
+	news      *announcementStore
+	rfidCerts *certStore // TLS for the RFID service, if configured
+	sipCerts  *certStore // TLS for SIP, if configured
+	server    *TCPServer
+	hub       *wsHub
+	mux       *http.ServeMux
+	assets    *assets // templates and static files
+	templates *template.Template
+
+	// serializes config changes: reloads and maintenance overrides
+	confMu      sync.Mutex
+	maintenance map[string]maintenanceOverride // by IP
+
+	httpLn    net.Listener
+	quit      chan bool // closed by Close
+	closeOnce sync.Once
+}
+
+// AppOptions are what an App is built from. Only Config is required.
+type AppOptions struct {
+	Config     *config
+	ConfigFile string       // reloaded when changed, if given
+	Backend    Backend      // library system; default is the one in Config
+	LogOutput  *levelWriter // if given, the log level follows the config
+}
+
+// NewApp builds an App. Nothing is listening until Start is called.
+func NewApp(o AppOptions) (*App, error) {
+	c := o.Config
+	app := &App{
+		cfg:        c,
+		configFile: o.ConfigFile,
+		logOutput:  o.LogOutput,
+		backend:    o.Backend,
+		quit:       make(chan bool),
+
+		maintenance: make(map[string]maintenanceOverride),
+	}
+
+	var err error
+	app.assets, err = newAssets(c.AssetDir)
+	if err != nil {
+		return nil, err
+	}
+	app.templates, err = template.ParseFS(app.assets, "html/monitor.html", "html/ui.html")
+	if err != nil {
+		return nil, err
+	}
+
+	if c.RFIDTLS != nil {
+		log.Println("INFO", "Loading TLS certificates for the RFID service")
+		app.rfidCerts, err = newCertStore(*c.RFIDTLS)
+		if err != nil {
+			return nil, err
+		}
+		go app.rfidCerts.watch(certReloadInterval, app.quit)
+	}
+	if c.SIPTLS != nil {
+		log.Println("INFO", "Loading TLS certificates for SIP")
+		app.sipCerts, err = newCertStore(*c.SIPTLS)
+		if err != nil {
+			return nil, err
+		}
+		go app.sipCerts.watch(certReloadInterval, app.quit)
+	}
+
+	if app.backend == nil {
+		if c.Backend == "" || c.Backend == "sip" {
+			log.Println("INFO", "Creating SIP Connection pool with size:", c.NumSIPConnections)
+			app.sipPool = NewSIPConnPool(c, app.sipCerts)
+		}
+		log.Println("INFO", "Using library system backend:", c.Backend)
+		app.backend, err = newBackend(c, app.sipPool)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	log.Println("INFO", "Registering metrics")
+	app.stats = RegisterMetrics(len(c.Automats))
+	app.guard = newLoginGuard(c.LoginGuard, app.stats)
+	app.stats.LockedPatrons = app.guard.locked
+
+	app.usage = newUsageStore(c.UsageDir)
+
+	app.server = newTCPServer(c, app.backend, app.guard, app.stats)
+	app.server.certs = app.rfidCerts
+	app.server.usage = app.usage
+	app.news = newAnnouncementStore()
+	app.server.news = app.news
+	app.alerts = newAlerter(c.Alerts, app.stats, func() []automat { return app.server.config().Automats })
+	if app.sipPool != nil {
+		app.alerts.poolSize = app.sipPool.Size
+	}
+	app.hub = NewHub(app.stats)
+	app.mux = app.routes()
+	return app, nil
+}
+
+// routes returns the HTTP handlers.
+func (app *App) routes() *http.ServeMux {
+	auth := app.cfg.Auth
+	mux := http.NewServeMux()
+	mux.HandleFunc("/css/", app.staticHandler)
+	mux.HandleFunc("/js/", app.staticHandler)
+	mux.HandleFunc("/themes/", app.staticHandler)
+	mux.HandleFunc("/.status", requireRole(auth, roleMonitor, app.statusHandler))
+	mux.HandleFunc("/.usage", requireRole(auth, roleMonitor, app.usageHandler))
+	mux.HandleFunc("/.alerts", requireRole(auth, roleMonitor, app.alertsHandler))
+	mux.HandleFunc("/.alerts/silence", requireRole(auth, roleAdmin, app.silenceHandler))
+	mux.HandleFunc("/.maintenance", requireRole(auth, roleAdmin, app.maintenanceHandler))
+	mux.HandleFunc("/.announcements", requireRole(auth, roleAdmin, app.announcementsHandler))
+	mux.HandleFunc("/ws", app.wsHandler)
+	mux.HandleFunc("/ui", app.uiHandler)
+	mux.HandleFunc("/", requireRole(auth, roleMonitor, app.monitorHandler))
+	return mux
+}
+
+// Start listens on the TCP and HTTP ports, and serves them until Close.
+func (app *App) Start() error {
+	// TCP server handles the communcation with the RFID-service on the
+	// self-checkin-automats, and spins up an automat state-machine for every
+	// connection.
+	log.Println("INFO", "Starting TCP server")
+	if err := app.server.listen(); err != nil {
+		return err
+	}
+
+	log.Println("INFO", "Starting HTTP server")
+	ln, err := net.Listen("tcp", ":"+app.cfg.HTTPPort)
+	if err != nil {
+		app.server.close()
+		return err
+	}
+	app.httpLn = ln
+
+	go app.server.serve()
+
+	// Websocket server handles feedback to the user interface on self-checkin-
+	// automats, and broadcast metrics to a monitor page.
+	log.Println("INFO", "Starting Websocket server")
+	go app.hub.run(app.quit)
+
+	go app.usage.flushEvery(usageFlushInterval, app.quit)
+	go app.alerts.run(app.quit)
+
+	// Changes to the config file are applied without a restart
+	if app.configFile != "" {
+		go app.watchConfig(app.configFile, configCheckInterval)
+	}
+
+	go func() {
+		err := http.Serve(ln, app.mux)
+		select {
+		case <-app.quit:
+		default:
+			log.Println("ERROR", "HTTP server:", err)
+		}
+	}()
+	return nil
+}
+
+// Close stops the servers, and disconnects the automats.
+func (app *App) Close() {
+	app.closeOnce.Do(func() {
+		close(app.quit)
+		if app.httpLn != nil {
+			app.httpLn.Close()
+		}
+		app.server.close()
+		if err := app.usage.flush(); err != nil {
+			log.Println("ERROR", "usage statistics:", err)
+		}
+	})
+}
+
+// TCPAddr and HTTPAddr return the addresses listened on, i.e. when started
+// with port "0".
+func (app *App) TCPAddr() string  { return app.server.ln.Addr().String() }
+func (app *App) HTTPAddr() string { return app.httpLn.Addr().String() }
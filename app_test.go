@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/knakk/specs"
+)
+
+// loginBackend reports library card logins on a channel.
+type loginBackend struct {
+	Backend
+	logins chan string
+}
+
+func (b *loginBackend) PatronInfo(dept, username string) (*UIResponse, error) {
+	b.logins <- username
+	return &UIResponse{Authenticated: true, Patron: username}, nil
+}
+
+func newTestApp(t *testing.T, b Backend) *App {
+	c := &config{TCPPort: "0", HTTPPort: "0",
+		Automats: []automat{{IP: "127.0.0.1", Name: "test", Department: "HUTL"}}}
+	app, err := NewApp(AppOptions{Config: c, Backend: b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := app.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return app
+}
+
+// waitAutomat returns the automat connected from addr, once the hub has
+// registered it.
+func waitAutomat(t *testing.T, app *App, addr string) *Automat {
+	deadline := time.Now().Add(time.Second)
+	for {
+		if a, ok := app.server.lookup(addr); ok {
+			return a
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("automat not registered")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestIsolatedApps(t *testing.T) {
+	s := specs.New(t)
+	b1, b2 := &loginBackend{logins: make(chan string, 1)}, &loginBackend{logins: make(chan string, 1)}
+	app1, app2 := newTestApp(t, b1), newTestApp(t, b2)
+	defer app1.Close()
+	defer app2.Close()
+	s.Expect(true, app1.TCPAddr() != app2.TCPAddr())
+
+	// an RFID service connects to the first hub, and the patron logs in
+	// with a library card
+	_, port, _ := net.SplitHostPort(app1.TCPAddr())
+	conn, err := net.Dial("tcp", "127.0.0.1:"+port)
+	s.ExpectNil(err)
+	defer conn.Close()
+	conn.Write([]byte(`{"Command": "PATRON-CARD", "Barcode": "card1"}` + "\n"))
+
+	a := waitAutomat(t, app1, conn.LocalAddr().String())
+	s.Expect("HUTL", a.Dept)
+	select {
+	case card := <-b1.logins:
+		s.Expect("card1", card)
+	case <-time.After(time.Second):
+		t.Fatal("no login")
+	}
+	s.Expect(0, len(b2.logins))
+
+	// each hub has its own metrics
+	get := func(app *App) exportMetrics {
+		var m exportMetrics
+		_, port, _ := net.SplitHostPort(app.HTTPAddr())
+		resp, err := http.Get("http://127.0.0.1:" + port + "/.status")
+		s.ExpectNil(err)
+		defer resp.Body.Close()
+		s.ExpectNil(json.NewDecoder(resp.Body).Decode(&m))
+		return m
+	}
+	s.Expect(int64(1), get(app1).ClientsConnected)
+	s.Expect(int64(0), get(app2).ClientsConnected)
+
+	// closing the hub disconnects the automat
+	app1.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	r := bufio.NewReader(conn)
+	for err == nil {
+		_, err = r.ReadString('\n')
+	}
+	s.Expect(false, isTimeout(err))
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+func TestMaintenanceHandler(t *testing.T) {
+	s := specs.New(t)
+	app := newTestApp(t, &fakeBackend{})
+	defer app.Close()
+	_, port, _ := net.SplitHostPort(app.TCPAddr())
+	conn, err := net.Dial("tcp", "127.0.0.1:"+port)
+	s.ExpectNil(err)
+	defer conn.Close()
+
+	w := httptest.NewRecorder()
+	app.maintenanceHandler(w, httptest.NewRequest("POST", "/.maintenance?automat=test&on=true&message=Stengt", nil))
+	s.Expect(http.StatusOK, w.Code)
+	s.Expect(`[{"IP":"127.0.0.1","Name":"test","Message":"Stengt"}]`, w.Body.String())
+
+	// the reader is turned off
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	s.ExpectNil(err)
+	s.Expect(string(rfidReaderOff), line)
+	s.Expect(true, app.stats.Export().Automats["127.0.0.1"].Maintenance)
+
+	// kept when the config is reloaded
+	s.Expect(true, app.withMaintenance(app.cfg).Automats[0].Maintenance)
+
+	w = httptest.NewRecorder()
+	app.maintenanceHandler(w, httptest.NewRequest("POST", "/.maintenance?automat=nope&on=true", nil))
+	s.Expect(http.StatusBadRequest, w.Code)
+}
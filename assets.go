@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/sha1"
+	"embed"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// The HTML templates, CSS and JavaScript are embedded in the binary, so it
+// runs from any directory. Files in the config's AssetDir take precedence,
+// for local customization; i.e. "themes/ROA.css" for the UIs at Røa.
+
+//go:embed data/html data/css data/js
+var embedded embed.FS
+
+// How long browsers may use static files before checking for changes
+const assetMaxAge = 3600 // seconds
+
+// assets is the embedded files, overridden by those in dir, if given.
+type assets struct {
+	dir   string
+	base  fs.FS
+	etags map[string]string // of the embedded files, by name
+}
+
+func newAssets(dir string) (*assets, error) {
+	base, err := fs.Sub(embedded, "data")
+	if err != nil {
+		return nil, err
+	}
+	a := &assets{dir: dir, base: base, etags: make(map[string]string)}
+	err = fs.WalkDir(base, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		b, err := fs.ReadFile(base, name)
+		if err != nil {
+			return err
+		}
+		a.etags[name] = fmt.Sprintf(`"%x"`, sha1.Sum(b))
+		return nil
+	})
+	return a, err
+}
+
+// Open opens the named file, from dir if it is there.
+func (a *assets) Open(name string) (fs.File, error) {
+	if a.dir != "" {
+		f, err := os.DirFS(a.dir).Open(name)
+		if !errors.Is(err, fs.ErrNotExist) {
+			return f, err
+		}
+	}
+	return a.base.Open(name)
+}
+
+// etag identifies the version of a file: by content if embedded, by time
+// and size if overridden.
+func (a *assets) etag(name string, fi fs.FileInfo) string {
+	if fi.ModTime().IsZero() {
+		return a.etags[name]
+	}
+	return fmt.Sprintf(`"%x-%x"`, fi.ModTime().UnixNano(), fi.Size())
+}
+
+// staticHandler serves the CSS, JavaScript and themes, with caching headers.
+func (app *App) staticHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(path.Clean(r.URL.Path), "/")
+	f, err := app.assets.Open(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	content, ok := f.(io.ReadSeeker)
+	if !ok {
+		http.Error(w, "ERROR: can't serve "+name, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", assetMaxAge))
+	w.Header().Set("ETag", app.assets.etag(name, fi))
+	http.ServeContent(w, r, name, fi.ModTime(), content)
+}
+
+// theme returns the URL of the stylesheet for the UIs of a department, or
+// "" if it has none.
+func (app *App) theme(dept string) string {
+	if dept == "" || strings.ContainsAny(dept, "/.") {
+		return ""
+	}
+	name := "themes/" + dept + ".css"
+	if _, err := fs.Stat(app.assets, name); err != nil {
+		return ""
+	}
+	return "/" + name
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/knakk/specs"
+)
+
+func TestAssets(t *testing.T) {
+	s := specs.New(t)
+	dir, err := ioutil.TempDir("", "automathub-assets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "css"), 0755)
+	os.MkdirAll(filepath.Join(dir, "themes"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "css", "styles.css"), []byte("/* local */ body { color: red; }"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "themes", "ROA.css"), []byte("body { color: green; }"), 0644)
+
+	app := &App{}
+	app.assets, err = newAssets(dir)
+	s.ExpectNil(err)
+	get := func(path, etag string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", path, nil)
+		if etag != "" {
+			r.Header.Set("If-None-Match", etag)
+		}
+		app.staticHandler(w, r)
+		return w
+	}
+
+	// embedded
+	w := get("/js/react-with-addons-0.8.0.js", "")
+	s.Expect(http.StatusOK, w.Code)
+	s.Expect("public, max-age=3600", w.Header().Get("Cache-Control"))
+	s.Expect(true, strings.Contains(w.Body.String(), "React"))
+	etag := w.Header().Get("ETag")
+	s.Expect(true, etag != "")
+	s.Expect(http.StatusNotModified, get("/js/react-with-addons-0.8.0.js", etag).Code)
+
+	// overridden
+	w = get("/css/styles.css", "")
+	s.Expect("/* local */ body { color: red; }", w.Body.String())
+	s.Expect(http.StatusNotModified, get("/css/styles.css", w.Header().Get("ETag")).Code)
+	s.Expect(http.StatusNotFound, get("/css/nope.css", "").Code)
+	s.Expect(http.StatusNotFound, get("/css/../html/ui.html/..", "").Code)
+
+	s.Expect("/themes/ROA.css", app.theme("ROA"))
+	s.Expect("", app.theme("HUTL"))
+	s.Expect("body { color: green; }", get("/themes/ROA.css", "").Body.String())
+
+	// without the override directory, the embedded files are served
+	app.assets, err = newAssets("")
+	s.ExpectNil(err)
+	s.Expect("", app.theme("ROA"))
+	w = get("/css/styles.css", "")
+	s.Expect(http.StatusOK, w.Code)
+	s.Expect(false, strings.Contains(w.Body.String(), "/* local */"))
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Access control for the HTTP endpoints //////////////////////////////////////
+
+// role is what a staff member or API token is allowed to do
+type role int
+
+const (
+	roleNone    role = iota
+	roleMonitor      // see the monitor page and status
+	roleAdmin        // everything, including opening any automat's UI
+)
+
+func parseRole(s string) role {
+	switch strings.ToLower(s) {
+	case "monitor":
+		return roleMonitor
+	case "admin":
+		return roleAdmin
+	}
+	return roleNone
+}
+
+// authConfig configures who may use the monitor and admin endpoints. Without
+// it, they are open to anyone.
+type authConfig struct {
+	Users          []staffUser // staff, logging in with HTTP basic auth
+	Tokens         []apiToken  // sent as "Authorization: Bearer <token>", or ?token= for websockets
+	AllowedOrigins []string    // websocket origins allowed besides the hub itself, i.e. "https://intra.example.org"
+}
+
+type staffUser struct {
+	Username string
+	Password string // bcrypt hash, i.e. from "htpasswd -nbB <username> <password>"
+	Role     string // "monitor" or "admin"
+}
+
+type apiToken struct {
+	Name  string // who uses it, for the log
+	Token string
+	Role  string
+}
+
+// validPasswordHash reports if stored is a password hash checkPassword
+// understands.
+func validPasswordHash(stored string) bool {
+	_, err := bcrypt.Cost([]byte(stored))
+	return err == nil
+}
+
+// checkPassword reports if password matches the stored form.
+func checkPassword(stored, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil
+}
+
+func secureEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// roleOf returns the role of the staff member or token making the request.
+func (c *authConfig) roleOf(r *http.Request) role {
+	if c == nil {
+		return roleAdmin
+	}
+	if user, pass, ok := r.BasicAuth(); ok {
+		for _, u := range c.Users {
+			if u.Username == user && checkPassword(u.Password, pass) {
+				return parseRole(u.Role)
+			}
+		}
+		return roleNone
+	}
+	token := r.URL.Query().Get("token")
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		token = strings.TrimPrefix(h, "Bearer ")
+	}
+	if token == "" {
+		return roleNone
+	}
+	for _, t := range c.Tokens {
+		if secureEqual(t.Token, token) {
+			return parseRole(t.Role)
+		}
+	}
+	return roleNone
+}
+
+// requireRole wraps a handler, letting only requests with at least role want
+// through.
+func requireRole(c *authConfig, want role, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if c.roleOf(r) >= want {
+			h(w, r)
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="automathub"`)
+		http.Error(w, "ERROR: not authorized", http.StatusUnauthorized)
+	}
+}
+
+// uiAllowed reports if a request may open the user interface of an automat:
+// it must come from the automat's own IP, or carry the automat's secret, or
+// be made by an admin.
+func uiAllowed(c *authConfig, r *http.Request, a *Automat) bool {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err == nil && ip == a.host() {
+		return true
+	}
+	if a.secret != "" {
+		secret := r.URL.Query().Get("secret")
+		if secret == "" {
+			secret = r.Header.Get("X-Automat-Secret")
+		}
+		if secureEqual(a.secret, secret) {
+			return true
+		}
+	}
+	return c != nil && c.roleOf(r) >= roleAdmin
+}
+
+// checkOrigin allows websocket connections from pages served by the hub
+// itself and from the allowed origins. Requests without an Origin are not
+// from a browser, and are allowed.
+func checkOrigin(c *authConfig) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+		u, err := url.Parse(origin)
+		if err != nil {
+			return false
+		}
+		if strings.EqualFold(u.Host, r.Host) {
+			return true
+		}
+		if c != nil {
+			for _, o := range c.AllowedOrigins {
+				if strings.EqualFold(strings.TrimSuffix(o, "/"), origin) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+}
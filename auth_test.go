@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/knakk/specs"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func mustHash(t *testing.T, password string) string {
+	h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(h)
+}
+
+func TestPasswordHash(t *testing.T) {
+	s := specs.New(t)
+	h := mustHash(t, "hemmelig")
+	s.Expect(true, validPasswordHash(h))
+	s.Expect(true, checkPassword(h, "hemmelig"))
+	s.Expect(false, checkPassword(h, "Hemmelig"))
+
+	s.Expect(false, validPasswordHash("hemmelig"))
+	s.Expect(false, checkPassword("hemmelig", "hemmelig"))
+}
+
+func TestRoles(t *testing.T) {
+	s := specs.New(t)
+	c := &authConfig{
+		Users: []staffUser{
+			{Username: "kari", Password: mustHash(t, "hemmelig"), Role: "admin"},
+			{Username: "ola", Password: mustHash(t, "passord"), Role: "monitor"},
+		},
+		Tokens: []apiToken{{Name: "grafana", Token: "t0k3n", Role: "monitor"}},
+	}
+
+	req := func(f func(r *http.Request)) *http.Request {
+		r := httptest.NewRequest("GET", "/.status", nil)
+		f(r)
+		return r
+	}
+	tests := []struct {
+		r    *http.Request
+		want role
+	}{
+		{req(func(r *http.Request) {}), roleNone},
+		{req(func(r *http.Request) { r.SetBasicAuth("kari", "hemmelig") }), roleAdmin},
+		{req(func(r *http.Request) { r.SetBasicAuth("kari", "passord") }), roleNone},
+		{req(func(r *http.Request) { r.SetBasicAuth("ola", "passord") }), roleMonitor},
+		{req(func(r *http.Request) { r.Header.Set("Authorization", "Bearer t0k3n") }), roleMonitor},
+		{req(func(r *http.Request) { r.Header.Set("Authorization", "Bearer wrong") }), roleNone},
+		{httptest.NewRequest("GET", "/ws?client=monitor&token=t0k3n", nil), roleMonitor},
+	}
+	for _, tt := range tests {
+		s.Expect(tt.want, c.roleOf(tt.r))
+	}
+
+	// without config, the monitor is open
+	var open *authConfig
+	s.Expect(roleAdmin, open.roleOf(httptest.NewRequest("GET", "/", nil)))
+
+	h := requireRole(c, roleMonitor, func(w http.ResponseWriter, r *http.Request) {})
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/", nil))
+	s.Expect(http.StatusUnauthorized, w.Code)
+	w = httptest.NewRecorder()
+	h(w, tests[3].r)
+	s.Expect(http.StatusOK, w.Code)
+}
+
+func TestUIAllowed(t *testing.T) {
+	s := specs.New(t)
+	a := &Automat{IP: "10.172.2.123:50123", secret: "s3cret"}
+	c := &authConfig{Users: []staffUser{{Username: "kari", Password: mustHash(t, "hemmelig"), Role: "admin"}}}
+
+	r := httptest.NewRequest("GET", "/ws?client=10.172.2.123:50123", nil)
+	r.RemoteAddr = "10.172.2.123:40000"
+	s.Expect(true, uiAllowed(nil, r, a))
+
+	r.RemoteAddr = "10.172.9.9:40000"
+	s.Expect(false, uiAllowed(nil, r, a))
+	s.Expect(false, uiAllowed(c, r, a))
+
+	r = httptest.NewRequest("GET", "/ws?client=10.172.2.123:50123&secret=s3cret", nil)
+	r.RemoteAddr = "10.172.9.9:40000"
+	s.Expect(true, uiAllowed(nil, r, a))
+
+	r = httptest.NewRequest("GET", "/ws?client=10.172.2.123:50123", nil)
+	r.RemoteAddr = "10.172.9.9:40000"
+	r.SetBasicAuth("kari", "hemmelig")
+	s.Expect(true, uiAllowed(c, r, a))
+
+	// no secret configured: an empty secret does not match
+	a.secret = ""
+	r = httptest.NewRequest("GET", "/ws?client=10.172.2.123:50123&secret=", nil)
+	r.RemoteAddr = "10.172.9.9:40000"
+	s.Expect(false, uiAllowed(nil, r, a))
+}
+
+func TestCheckOrigin(t *testing.T) {
+	s := specs.New(t)
+	check := checkOrigin(&authConfig{AllowedOrigins: []string{"https://intra.example.org/"}})
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{"", true},
+		{"http://hub:9000", true},
+		{"https://intra.example.org", true},
+		{"http://evil.example.com", false},
+		{"http://hub:9001", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "http://hub:9000/ws", nil)
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		s.Expect(tt.want, check(r))
+	}
+}
@@ -2,10 +2,15 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net"
+	"reflect"
 	"strings"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
@@ -20,22 +25,127 @@ const (
 	uiCHECKOUT
 	uiSTATUS
 	uiERROR
+	uiMAINTENANCE // out of order; see setMaintenance
+	uiCLOSED      // outside opening hours; see setHours
 )
 
+func (s uiState) String() string {
+	switch s {
+	case uiWAITING:
+		return "WAITING"
+	case uiCHECKIN:
+		return "CHECKIN"
+	case uiCHECKOUT:
+		return "CHECKOUT"
+	case uiSTATUS:
+		return "STATUS"
+	case uiERROR:
+		return "ERROR"
+	case uiMAINTENANCE:
+		return "MAINTENANCE"
+	case uiCLOSED:
+		return "CLOSED"
+	}
+	return "UNKNOWN"
+}
+
+func parseUIState(s string) uiState {
+	for st := uiWAITING; st <= uiCLOSED; st++ {
+		if st.String() == s {
+			return st
+		}
+	}
+	return uiWAITING
+}
+
+const (
+	// uiBufferSize is the number of messages kept for the user interface,
+	// i.e. while no UI is connected. When full, the oldest message is dropped.
+	uiBufferSize = 32
+
+	// rfidQueueSize is the number of messages the RFID service may lag
+	// behind. If exceeded, the RFID connection is considered stuck and closed.
+	rfidQueueSize = 64
+
+	// sipQueueSize is the number of SIP requests an automat may have waiting.
+	sipQueueSize = 16
+)
+
+// Commands to the RFID service
+var (
+	rfidReaderOn  = []byte(`{"Reader": "A", "Cmd": "SET-READER", "Data": "ON"}` + "\n")
+	rfidReaderOff = []byte(`{"Reader": "A", "Cmd": "SET-READER", "Data": "OFF"}` + "\n")
+)
+
+// rfidSortCommand tells the RFID service to route an item to a sort bin.
+func rfidSortCommand(barcode, bin string) []byte {
+	b, _ := json.Marshal(struct {
+		Reader  string
+		Cmd     string
+		Data    string
+		Barcode string
+	}{"A", "SORT", bin, barcode})
+	return append(b, '\n')
+}
+
+// rfidPrintCommand tells the RFID service to print a receipt.
+func rfidPrintCommand(text string) []byte {
+	b, _ := json.Marshal(struct {
+		Reader string
+		Cmd    string
+		Data   string
+	}{"A", "PRINT", text})
+	return append(b, '\n')
+}
+
+// sipJob is a SIP request to be performed on behalf of an automat.
+type sipJob struct {
+	action  string // LOGIN, CHECKIN or CHECKOUT
+	session int    // session the request belongs to
+	user    string // username for LOGIN
+	call    func() (*UIResponse, error)
+}
+
+// sipResult is the outcome of a sipJob.
+type sipResult struct {
+	job *sipJob
+	res *UIResponse
+	err error
+}
+
+// uiConn is a websocket connection from an automat's user interface. An
+// automat can outlive many UI connections (page reloads, dropped sockets).
+type uiConn struct {
+	ws   *websocket.Conn
+	done chan bool // closed when the connection is detached
+}
+
 // Automat is a state machine for the automats. It recieves communcations
 // from RFID service, User Interface and communicates with the SIP server.
 type Automat struct {
 	State         uiState
 	Authenticated bool   // logged in or not
 	IP            string // remote address of the automat
+	Name          string // name from config
 	Dept          string // department (SIP: institution id)
-	Patron        string // patron username
+	sorter        *sorter
+	sorterJammed  bool
+	requirePIN    bool            // require PIN when logging in with a library card
+	pendingCard   string          // card read, waiting for PIN
+	terminal      paymentTerminal // nil if no payment terminal
+	Patron        string          // patron username
+	Fees          *fees           // outstanding fees of patron
+	session       int             // incremented on logout; outdated SIP results are not applied
+	lang          string          // language of the session
+	defaultLang   string          // language of new sessions
+	hours         string          // opening hours mode: open, return-only or closed
+	news          []announcement  // active announcements, shown by the UI
 
 	// TODO
 	// Keep track of transactions, and send to RFIDservice for printout
 	// upon request. Clear on logout.
-	Checkins  []string
-	Checkouts []string
+	Checkins  []item
+	Checkouts []item
 
 	// SIP connection (via TCP)
 	SIPConn net.Conn
@@ -43,14 +153,39 @@ type Automat struct {
 	// Communication with the RFID service (via TCP)
 	RFIDconn net.Conn
 	FromRFID chan []byte
-	ToRFID   chan []byte
+	ToRFID   *outQueue
+
+	// Library system (SIP2, NCIP). Requests are performed one at a time,
+	// in order, by sipWorker.
+	backend    Backend
+	guard      *loginGuard // limits PIN logins; nil means no limit
+	stats      *appMetrics // may be nil
+	usage      *usageStore // may be nil
+	loginTime  time.Time   // start of the patron session
+	checkItems bool        // look up items before checkout
+	refOnly    []string    // reference-only locations
+	secret     string      // lets a UI connect from another IP
+	rec        *recorder   // records the session, if configured
+	recordDir  string      // where recordings go
+	replaying  bool        // replaying a recording; no sorter connection
+	sipJobs    chan *sipJob
+	sipResults chan sipResult
 
 	// User inteface communication (via Websocket)
-	ws     *websocket.Conn
-	ToUI   chan []byte
-	FromUI chan []byte
+	ui      *uiConn      // currently attached UI, nil if none
+	uiReg   chan *uiConn // attach UI
+	uiUnReg chan *uiConn // detach UI
+	ToUI    *outQueue    // drained by the attached UI's wsWriter
+	FromUI  chan []byte
+
+	// Mailboxes holding only the latest value, filled by handleMessages
+	conf      automat      // configuration applied
+	reconf    chan automat // new configuration, i.e. after config.json changed
+	hoursChan chan string  // new opening hours mode, from the schedule
+	newsChan  chan []announcement
 
-	Quit chan bool // For closing down the state machine
+	Quit    chan bool // For closing down the state machine
+	stopped chan bool // closed when the state machine has shut down
 }
 
 // return a new Automat (ceated upon receiving a tcp connection)
@@ -60,95 +195,210 @@ func newAutomat(c net.Conn) *Automat {
 		IP:       c.RemoteAddr().String(),
 		RFIDconn: c,
 		FromRFID: make(chan []byte),
-		ToRFID:   make(chan []byte),
-		ToUI:     make(chan []byte),
+		ToRFID:   newOutQueue("RFID", rfidQueueSize, overflow),
+		uiReg:    make(chan *uiConn),
+		uiUnReg:  make(chan *uiConn),
+		ToUI:     newOutQueue("UI", uiBufferSize, dropOldest),
 		FromUI:   make(chan []byte),
+		reconf:   make(chan automat, 1),
+		rec:      newRecorder(),
 		Quit:     make(chan bool),
+		stopped:  make(chan bool),
+
+		lang:        defaultLanguage,
+		defaultLang: defaultLanguage,
+		hours:       hoursOpen,
+		hoursChan:   make(chan string, 1),
+		newsChan:    make(chan []announcement, 1),
+
+		sipJobs:    make(chan *sipJob, sipQueueSize),
+		sipResults: make(chan sipResult),
+	}
+}
+
+// The post methods replace any value not yet taken from a mailbox, so the
+// state machine gets the latest one. They must have a single caller, the
+// TCP server's handleMessages, for the send after draining never to block.
+
+func (a *Automat) postConf(ac automat) {
+	select {
+	case <-a.reconf:
+	default:
+	}
+	a.reconf <- ac
+}
+
+func (a *Automat) postHours(m string) {
+	select {
+	case <-a.hoursChan:
+	default:
+	}
+	a.hoursChan <- m
+}
+
+func (a *Automat) postNews(n []announcement) {
+	select {
+	case <-a.newsChan:
+	default:
+	}
+	a.newsChan <- n
+}
+
+// sendUI queues a message for the user interface. It never blocks; if the
+// UI is away and the buffer is full, the oldest message is discarded.
+func (a *Automat) sendUI(msg []byte) {
+	a.rec.event(recUIOut, msg)
+	a.ToUI.Push(msg, prioNormal)
+}
+
+// sendRFID queues a command for the RFID service. Turning the reader on or
+// off has high priority, so it is not held up by e.g. receipts to print.
+func (a *Automat) sendRFID(msg []byte) {
+	a.rec.event(recRFIDOut, msg)
+	p := prioNormal
+	if bytes.Equal(msg, rfidReaderOn) || bytes.Equal(msg, rfidReaderOff) {
+		p = prioHigh
+	}
+	a.ToRFID.Push(msg, p)
+}
+
+// doSIP queues a SIP request. It returns false if too many requests are
+// already waiting.
+func (a *Automat) doSIP(j *sipJob) bool {
+	j.session = a.session
+	select {
+	case a.sipJobs <- j:
+		return true
+	default:
+		return false
+	}
+}
+
+// sipWorker performs SIP requests in the order they were queued, and hands
+// the results back to the state machine.
+func (a *Automat) sipWorker() {
+	for {
+		select {
+		case j := <-a.sipJobs:
+			res, err := j.call()
+			select {
+			case a.sipResults <- sipResult{job: j, res: res, err: err}:
+			case <-a.stopped:
+				return
+			}
+		case <-a.stopped:
+			return
+		}
+	}
+}
+
+// snapshot returns the current session state, sent to a freshly connected UI.
+func (a *Automat) snapshot() []byte {
+	b, err := json.Marshal(&UISnapshot{
+		Action:        "SNAPSHOT",
+		Mode:          a.State.String(),
+		Authenticated: a.Authenticated,
+		Patron:        a.Patron,
+		Fees:          a.Fees,
+		Checkins:      localizeItems(a.lang, a.Checkins),
+		Checkouts:     localizeItems(a.lang, a.Checkouts),
+		Language:      a.lang,
+		Hours:         a.hours,
+		Message:       a.notice(),
+	})
+	if err != nil {
+		return ErrorResponse(a.lang, err)
+	}
+	return b
+}
+
+// language returns the texts of the session language, for the UI.
+func (a *Automat) language() []byte {
+	b, _ := json.Marshal(&UILanguage{Action: "LANGUAGE", Language: a.lang, Texts: messages[a.lang]})
+	return b
+}
+
+// greetUI sends the session state to a freshly connected UI.
+func (a *Automat) greetUI() {
+	a.rec.event(recUIConnect, nil)
+	a.sendUI(a.language())
+	a.sendUI(a.snapshot())
+	a.sendUI(a.announcements())
+}
+
+// attachUI hands a websocket connection to the state machine. It returns
+// false if the automat has already shut down.
+func (a *Automat) attachUI(c *uiConn) bool {
+	select {
+	case a.uiReg <- c:
+		return true
+	case <-a.stopped:
+		return false
+	}
+}
+
+// detachUI tells the state machine that a UI connection has gone away.
+func (a *Automat) detachUI(c *uiConn) {
+	select {
+	case a.uiUnReg <- c:
+	case <-a.stopped:
 	}
 }
 
-// run the Automat state machine & message handler
+// run the Automat state machine & message handler. It must never block on
+// a peer: outbound messages are queued, and SIP calls run in sipWorker.
 func (a *Automat) run() {
+	defer close(a.stopped)
+	go a.sipWorker()
 
 	for {
 		select {
 		case msg := <-a.FromRFID:
-			log.Println("<- RFID:", strings.TrimRight(string(msg), "\n"))
-			rfidMsg, err := parseRFIDRequest(msg)
-			if err != nil {
-				log.Println("ERROR", err.Error())
-				// TODO respond to RFIDservise? and what?
-				break
-			}
-			//log.Printf("DEBUG %+v", rfidMsg)
-			var sipRes *UIResponse
-			switch a.State {
-			case uiCHECKIN:
-				sipRes, err = DoSIPCall(sipPool, sipFormMsgCheckin(a.Dept, rfidMsg.Barcode), checkinParse)
-				sipRes.Action = "CHECKIN"
-			case uiCHECKOUT:
-				sipRes, err = DoSIPCall(sipPool, sipFormMsgCheckout(a.Patron, rfidMsg.Barcode), checkoutParse)
-				sipRes.Action = "CHECKOUT"
-			default:
-				log.Println("ERROR", "state: %+v | rfidmessage: %v", a.State, rfidMsg)
-				break
-			}
-			if err != nil {
-				log.Println(err)
-				// TODO now what?
-				break
-			}
-			bRes, err := json.Marshal(sipRes)
-			if err != nil {
-				a.ToUI <- ErrorResponse(err)
-				break
-			}
-			a.ToUI <- bRes
+			a.handleRFID(msg)
 		case msg := <-a.FromUI:
-			log.Println("<- UI", strings.TrimRight(string(msg), "\n"))
-			var uiMsg UIRequest
-			err := json.Unmarshal(msg, &uiMsg)
-			if err != nil {
-				a.ToUI <- ErrorResponse(err)
-			} else {
-				switch uiMsg.Action {
-				case "LOGIN":
-					authRes, err := DoSIPCall(sipPool, sipFormMsgAuthenticate(a.Dept, uiMsg.Username, uiMsg.PIN), authParse)
-					if err != nil {
-						a.ToUI <- ErrorResponse(err)
-						break
-					}
-
-					bRes, err := json.Marshal(authRes)
-					if err != nil {
-						a.ToUI <- ErrorResponse(err)
-						break
-					}
-					a.Authenticated = authRes.Authenticated
-					if a.Authenticated {
-						a.Patron = uiMsg.Username
-					}
-					a.ToUI <- bRes
-				case "CHECKIN":
-					a.State = uiCHECKIN
-					a.ToRFID <- []byte(`{"Reader": "A", "Cmd": "SET-READER", "Data": "ON"}` + "\n")
-				case "CHECKOUT":
-					a.State = uiCHECKOUT
-					a.ToRFID <- []byte(`{"Reader": "A", "Cmd": "SET-READER", "Data": "ON"}` + "\n")
-				case "STATUS":
-					a.State = uiSTATUS
-				case "LOGOUT":
-					a.State = uiWAITING
-					a.Authenticated = false
-					a.Patron = ""
-					a.ToUI <- []byte(`{"action": "LOGOUT", "status": true}` + "\n")
-					a.ToRFID <- []byte(`{"Reader": "A", "Cmd": "SET-READER", "Data": "OFF"}` + "\n")
-				}
+			a.handleUI(msg)
+		case r := <-a.sipResults:
+			a.handleSIPResult(r)
+		case ev := <-a.sorter.events():
+			b, _ := json.Marshal(ev)
+			a.rec.event(recSorter, b)
+			a.handleSorterEvent(ev)
+		case c := <-a.uiReg:
+			if a.ui != nil {
+				// a new UI replaces the old one
+				log.Println("UI", a.IP, "replaced by new connection")
+				close(a.ui.done)
+				go a.ui.ws.Close()
 			}
+			a.ui = c
+			go a.wsWriter(c)
+			a.greetUI()
+		case c := <-a.uiUnReg:
+			if a.ui == c {
+				close(c.done)
+				a.ui = nil
+			}
+		case ac := <-a.reconf:
+			log.Println("INFO", "new configuration for automat", a.IP)
+			a.configure(ac)
+		case m := <-a.hoursChan:
+			a.setHours(m)
+		case n := <-a.newsChan:
+			a.setNews(n)
 		case <-a.Quit:
 			// cleanup: close channels & connections
-			close(a.ToUI)
-			close(a.ToRFID)
+			if a.ui != nil {
+				close(a.ui.done)
+				go a.ui.ws.Close()
+				a.ui = nil
+			}
+			a.endSession()
+			a.rec.stop()
+			a.ToUI.Close()
+			a.ToRFID.Close()
+			if a.sorter != nil {
+				a.sorter.stop()
+			}
 			close(a.FromRFID)
 			log.Println("INFO", "shutting down state machine", a.IP)
 			if a.SIPConn != nil {
@@ -160,6 +410,520 @@ func (a *Automat) run() {
 	}
 }
 
+// configure applies the automat's configuration. The patron session is kept.
+// Once run has started, it must only be called from the run loop.
+func (a *Automat) configure(ac automat) {
+	if ac.Record && a.rec.recording() {
+		b, _ := json.Marshal(ac)
+		a.rec.event(recConfig, b)
+	}
+	a.Name = ac.Name
+	a.Dept = ac.Department
+	a.requirePIN = ac.RequirePIN
+	a.secret = ac.Secret
+	lang := ac.Language
+	if lang == "" {
+		lang = defaultLanguage
+	}
+	if a.lang == "" || a.lang == a.defaultLang {
+		a.lang = lang
+	}
+	a.defaultLang = lang
+	maintenance := ac.Maintenance != a.conf.Maintenance ||
+		ac.Maintenance && ac.MaintenanceMessage != a.conf.MaintenanceMessage
+	if ac.Terminal != a.conf.Terminal || a.conf.IP == "" {
+		t, err := newPaymentTerminal(ac.Terminal)
+		if err != nil {
+			log.Println("ERROR", ac.Name, err)
+		}
+		a.terminal = t
+	}
+	if !reflect.DeepEqual(ac.Sorter, a.conf.Sorter) {
+		if a.sorter != nil {
+			a.sorter.stop()
+		}
+		a.sorter, a.sorterJammed = nil, false
+		if ac.Sorter != nil {
+			a.sorter = newSorter(*ac.Sorter)
+			if a.sorter.conn != nil && !a.replaying {
+				go a.sorter.conn.run()
+			}
+		}
+	}
+	a.conf = ac
+	if maintenance {
+		a.setMaintenance(ac.Maintenance)
+	}
+
+	switch {
+	case ac.Record && !a.rec.recording():
+		file, err := a.rec.startFile(a.recordDir, ac.Name)
+		if err != nil {
+			log.Println("ERROR", "recording", ac.Name, err)
+			break
+		}
+		log.Println("INFO", "recording automat", ac.Name, "to", file)
+		b, _ := json.Marshal(recSetup{Automat: ac, ItemInfoBeforeCheckout: a.checkItems, ReferenceOnlyLocations: a.refOnly})
+		a.rec.record(recEvent{Kind: recStart, Data: string(b), State: string(a.snapshot())})
+	case !ac.Record && a.rec.recording():
+		log.Println("INFO", "stopped recording automat", ac.Name)
+		a.rec.stop()
+	}
+}
+
+// handleRFID handles a message from the RFID service
+func (a *Automat) handleRFID(msg []byte) {
+	a.rec.event(recRFIDIn, msg)
+	log.Println("<- RFID:", strings.TrimRight(string(msg), "\n"))
+	rfidMsg, err := parseRFIDRequest(msg)
+	if err != nil {
+		log.Println("ERROR", err.Error())
+		// TODO respond to RFIDservise? and what?
+		return
+	}
+	//log.Printf("DEBUG %+v", rfidMsg)
+	switch rfidMsg.Command {
+	case rfidCmdSorter:
+		a.handleSorterEvent(sorterEvent{Event: rfidMsg.Data, Bin: rfidMsg.Bin, Barcode: rfidMsg.Barcode})
+		return
+	case rfidCmdPatronCard:
+		a.cardLogin(rfidMsg.Barcode)
+		return
+	}
+	var j *sipJob
+	switch a.State {
+	case uiCHECKIN:
+		dept, barcode := a.Dept, rfidMsg.Barcode
+		j = &sipJob{action: "CHECKIN", call: func() (*UIResponse, error) {
+			return a.backend.Checkin(dept, barcode)
+		}}
+	case uiCHECKOUT:
+		dept, patron, barcode := a.Dept, a.Patron, rfidMsg.Barcode
+		j = &sipJob{action: "CHECKOUT", call: func() (*UIResponse, error) {
+			return a.backend.Checkout(dept, patron, barcode)
+		}}
+		if a.checkItems {
+			refOnly := a.refOnly
+			j.call = func() (*UIResponse, error) {
+				return checkoutChecked(a.backend, dept, patron, barcode, refOnly)
+			}
+		}
+	case uiMAINTENANCE, uiCLOSED:
+		a.sendUI(a.refusal())
+		return
+	default:
+		log.Printf("ERROR state: %v | rfidmessage: %+v", a.State, rfidMsg)
+		return
+	}
+	if !a.doSIP(j) {
+		a.sendUI(ErrorResponse(a.lang, errSIPBusy))
+	}
+}
+
+// handleUI handles a message from the user interface
+func (a *Automat) handleUI(msg []byte) {
+	a.rec.event(recUIIn, maskPIN(msg))
+	log.Println("<- UI", strings.TrimRight(string(msg), "\n"))
+	var uiMsg UIRequest
+	err := json.Unmarshal(msg, &uiMsg)
+	if err != nil {
+		a.sendUI(ErrorResponse(a.lang, err))
+		return
+	}
+	if r := a.refused(uiMsg.Action); r != nil {
+		a.sendUI(r)
+		return
+	}
+	switch uiMsg.Action {
+	case "CARD":
+		// library card read by a barcode scanner attached to the UI
+		a.cardLogin(uiMsg.Username)
+	case "LOGIN":
+		if uiMsg.Username == "" && a.pendingCard != "" {
+			uiMsg.Username = a.pendingCard
+		}
+		a.pendingCard = ""
+		dept, host, username, pin := a.Dept, a.host(), uiMsg.Username, uiMsg.PIN
+		g := a.guard
+		j := &sipJob{action: "LOGIN", user: uiMsg.Username, call: func() (*UIResponse, error) {
+			if g == nil {
+				return a.backend.Authenticate(dept, username, pin)
+			}
+			return g.authenticate(a.backend, dept, host, username, pin)
+		}}
+		if !a.doSIP(j) {
+			a.sendUI(ErrorResponse(a.lang, errSIPBusy))
+		}
+	case "CHECKIN":
+		a.State = uiCHECKIN
+		if a.sorterJammed {
+			a.sendUI(sorterResponse(sorterJam))
+			break
+		}
+		a.sendRFID(rfidReaderOn)
+	case "CHECKOUT":
+		a.State = uiCHECKOUT
+		a.sendRFID(rfidReaderOn)
+	case "STATUS":
+		a.State = uiSTATUS
+	case "PAY":
+		a.pay(uiMsg)
+	case "SET_LANGUAGE":
+		if !knownLanguage(uiMsg.Language) {
+			a.sendUI(ErrorResponse(a.lang, fmt.Errorf("unknown language: %q", uiMsg.Language)))
+			break
+		}
+		a.lang = uiMsg.Language
+		// the snapshot has the items in the new language
+		a.sendUI(a.language())
+		a.sendUI(a.snapshot())
+	case "LOGOUT":
+		a.logout()
+		a.sendUI([]byte(`{"action": "LOGOUT", "status": true}` + "\n"))
+		a.sendRFID(rfidReaderOff)
+	}
+}
+
+// logout ends the patron session
+func (a *Automat) logout() {
+	a.endSession()
+	a.State = a.idleState()
+	a.Authenticated = false
+	a.Patron = ""
+	a.Fees = nil
+	a.pendingCard = ""
+	a.Checkins = nil
+	a.Checkouts = nil
+	a.session++
+	if a.lang != a.defaultLang {
+		a.lang = a.defaultLang
+		a.sendUI(a.language())
+	}
+}
+
+// setMaintenance takes the automat out of order, or back in service. While
+// out of order, the reader is off and patrons can't log in, check in or
+// check out.
+func (a *Automat) setMaintenance(on bool) {
+	if a.stats != nil {
+		a.stats.SetMaintenance(a.host(), on)
+	}
+	if !on {
+		log.Println("INFO", "automat", a.IP, "back in service")
+		a.State = a.idleState()
+		a.sendUI(a.snapshot())
+		return
+	}
+	log.Println("INFO", "automat", a.IP, "out of order")
+	if a.Authenticated || a.State != uiWAITING {
+		a.logout()
+	}
+	a.State = uiMAINTENANCE
+	a.sendRFID(rfidReaderOff)
+	a.sendUI(a.snapshot())
+}
+
+// setHours switches the automat to an opening hours mode. Closed is much
+// like out of order; return-only, patrons can't log in, but anyone can
+// check in.
+func (a *Automat) setHours(m string) {
+	if a.stats != nil {
+		a.stats.SetHours(a.host(), m)
+	}
+	if m == a.hours {
+		return
+	}
+	a.rec.event(recHours, []byte(m))
+	log.Println("INFO", "automat", a.IP, "opening hours:", m)
+	a.hours = m
+	switch {
+	case a.State == uiMAINTENANCE:
+		// applies when back in service
+	case m == hoursOpen:
+		if a.State == uiCLOSED {
+			a.State = uiWAITING
+		}
+	case a.Authenticated || m == hoursClosed || a.State != uiCHECKIN:
+		// a checkin without a patron may go on while return-only
+		a.logout()
+		a.sendRFID(rfidReaderOff)
+	}
+	a.sendUI(a.snapshot())
+}
+
+// setNews replaces the announcements shown by the UI.
+func (a *Automat) setNews(n []announcement) {
+	b, _ := json.Marshal(n)
+	a.rec.event(recNews, b)
+	a.news = n
+	a.sendUI(a.announcements())
+}
+
+// announcements returns the active announcements, for the UI.
+func (a *Automat) announcements() []byte {
+	b, _ := json.Marshal(&UIAnnouncements{Action: "ANNOUNCEMENTS", Announcements: a.news})
+	return b
+}
+
+// idleState is the state of the automat without a patron session.
+func (a *Automat) idleState() uiState {
+	switch {
+	case a.conf.Maintenance:
+		return uiMAINTENANCE
+	case a.hours == hoursClosed:
+		return uiCLOSED
+	}
+	return uiWAITING
+}
+
+// notice returns what the UI shows while the automat is out of order,
+// closed or return-only; otherwise "".
+func (a *Automat) notice() string {
+	switch {
+	case a.State == uiMAINTENANCE:
+		if a.conf.MaintenanceMessage != "" {
+			return a.conf.MaintenanceMessage
+		}
+		return translate(a.lang, msgOutOfOrder)
+	case a.State == uiCLOSED:
+		return translate(a.lang, msgClosed)
+	case a.hours == hoursReturnOnly:
+		return translate(a.lang, msgReturnOnly)
+	}
+	return ""
+}
+
+// refused returns the response to a UI action which isn't allowed now, or
+// nil if it is. Out of order or closed, only LOGOUT and SET_LANGUAGE are
+// allowed; return-only, patrons can't log in.
+func (a *Automat) refused(action string) []byte {
+	closed := a.State == uiMAINTENANCE || a.State == uiCLOSED
+	switch action {
+	case "CHECKIN":
+		if !closed {
+			return nil
+		}
+	case "CARD", "LOGIN", "CHECKOUT", "STATUS", "PAY":
+		if !closed && a.hours != hoursReturnOnly {
+			return nil
+		}
+	default:
+		return nil
+	}
+	return a.refusal()
+}
+
+// refusal is the response to refused actions: MAINTENANCE, CLOSED or
+// RETURN_ONLY, with the notice.
+func (a *Automat) refusal() []byte {
+	action := "RETURN_ONLY"
+	if a.State == uiMAINTENANCE || a.State == uiCLOSED {
+		action = a.State.String()
+	}
+	b, _ := json.Marshal(UIResponse{Action: action, Message: a.notice()})
+	return b
+}
+
+// endSession counts the patron session in the usage statistics.
+func (a *Automat) endSession() {
+	if a.Authenticated {
+		a.countUsage(usageCounts{Sessions: 1, SessionSeconds: int(time.Since(a.loginTime).Seconds())})
+	}
+}
+
+// countUsage adds to the usage statistics and metrics of the automat.
+func (a *Automat) countUsage(c usageCounts) {
+	if a.stats != nil {
+		a.stats.Transaction(a.host(), c)
+	}
+	name := a.Name
+	if name == "" {
+		name = a.host()
+	}
+	a.usage.add(name, a.Dept, c)
+}
+
+// cardLogin starts a login with a library card number. If the automat
+// requires a PIN, the UI is asked for it; the LOGIN that follows need not
+// repeat the card number.
+func (a *Automat) cardLogin(card string) {
+	if card == "" {
+		return
+	}
+	if r := a.refused("CARD"); r != nil {
+		a.sendUI(r)
+		return
+	}
+	if a.Authenticated {
+		if a.Patron == card {
+			return
+		}
+		// another patron's card: end the current session
+		a.logout()
+		a.sendRFID(rfidReaderOff)
+	}
+	if a.requirePIN {
+		a.pendingCard = card
+		b, _ := json.Marshal(&UIResponse{Action: "CARD", Patron: card})
+		a.sendUI(b)
+		return
+	}
+	dept := a.Dept
+	j := &sipJob{action: "LOGIN", user: card, call: func() (*UIResponse, error) {
+		return a.backend.PatronInfo(dept, card)
+	}}
+	if !a.doSIP(j) {
+		a.sendUI(ErrorResponse(a.lang, errSIPBusy))
+	}
+}
+
+// pay charges the patron on the payment terminal, and records the payment in
+// the library system. Without an amount, all outstanding fees are paid.
+func (a *Automat) pay(req UIRequest) {
+	if !a.Authenticated {
+		a.sendUI(ErrorResponse(a.lang, errors.New("not logged in")))
+		return
+	}
+	if a.Fees == nil {
+		a.sendUI(ErrorResponse(a.lang, errors.New("no fees to pay")))
+		return
+	}
+	p := payment{Currency: "NOK", Type: paymentCreditCard, FeeID: req.FeeID}
+	if a.Fees.Currency != "" {
+		p.Currency = a.Fees.Currency
+	}
+	amount := req.Amount
+	if amount == "" {
+		amount = a.Fees.Amount
+	}
+	var err error
+	p.Amount, err = parseAmount(amount)
+	if err != nil || p.Amount <= 0 {
+		a.sendUI(ErrorResponse(a.lang, fmt.Errorf("nothing to pay: %q", amount)))
+		return
+	}
+	// SIP gives the fine items (AV) as text only, so a payment of one fee
+	// (FeeID) is limited by the total owed too.
+	if owed, _ := parseAmount(a.Fees.Amount); p.Amount > owed {
+		a.sendUI(ErrorResponse(a.lang, fmt.Errorf("%s is more than the fees owed, %s", formatAmount(p.Amount), formatAmount(owed))))
+		return
+	}
+
+	dept, name, patron, terminal := a.Dept, a.Name, a.Patron, a.terminal
+	j := &sipJob{action: "PAY", call: func() (*UIResponse, error) {
+		return payFees(a.backend, terminal, dept, name, patron, p)
+	}}
+	if !a.doSIP(j) {
+		a.sendUI(ErrorResponse(a.lang, errSIPBusy))
+	}
+}
+
+// handleSorterEvent handles an event from the sorting machine. While the
+// sorter is jammed, the reader is kept off so no more items are accepted.
+func (a *Automat) handleSorterEvent(ev sorterEvent) {
+	log.Printf("INFO sorter %v: %+v", a.IP, ev)
+	if a.stats != nil {
+		a.stats.SorterEvent(a.host(), ev)
+	}
+	switch ev.Event {
+	case sorterJam:
+		a.sorterJammed = true
+		if a.State == uiCHECKIN {
+			a.sendRFID(rfidReaderOff)
+		}
+		a.sendUI(sorterResponse(ev.Event))
+	case sorterCleared:
+		a.sorterJammed = false
+		if a.State == uiCHECKIN {
+			a.sendRFID(rfidReaderOn)
+		}
+		a.sendUI(sorterResponse(ev.Event))
+	}
+}
+
+// sorterResponse tells the user interface about the state of the sorter
+func sorterResponse(event string) []byte {
+	b, _ := json.Marshal(&UIResponse{Action: "SORTER", Status: event})
+	return b
+}
+
+// host returns the IP of the automat, without port
+func (a *Automat) host() string {
+	h, _, err := net.SplitHostPort(a.IP)
+	if err != nil {
+		return a.IP
+	}
+	return h
+}
+
+// handleSIPResult applies the result of a SIP request to the automat state,
+// and passes it on to the user interface. Results arrive in request order.
+func (a *Automat) handleSIPResult(r sipResult) {
+	a.rec.result(recResult, r.res, r.err)
+	if r.err != nil {
+		log.Println("ERROR", r.job.action, r.err)
+		a.countUsage(usageCounts{Failures: 1})
+		a.sendUI(ErrorResponse(a.lang, r.err))
+		return
+	}
+	current := r.job.session == a.session
+	r.res.Action = r.job.action
+	switch r.job.action {
+	case "LOGIN":
+		if !current {
+			// patron logged out while authenticating
+			return
+		}
+		a.Authenticated = r.res.Authenticated
+		if a.Authenticated {
+			a.Patron = r.job.user
+			a.Fees = r.res.Fees
+			a.loginTime = time.Now()
+			a.countUsage(usageCounts{Logins: 1})
+		} else {
+			a.countUsage(usageCounts{LoginFailures: 1})
+		}
+	case "PAY":
+		if p := r.res.Payment; p != nil && p.Receipt != nil {
+			if current {
+				a.Fees = nil // fees are looked up again on next login
+			}
+			a.sendRFID(rfidPrintCommand(p.Receipt.text(a.lang)))
+		}
+	case "CHECKIN":
+		if current {
+			a.Checkins = append(a.Checkins, r.res.Item)
+		}
+		if r.res.Item.OK {
+			a.countUsage(usageCounts{Checkins: 1})
+		} else {
+			a.countUsage(usageCounts{Failures: 1})
+		}
+		if a.sorter != nil {
+			bin := a.sorter.bin(r.res.Item)
+			if cmd := a.sorter.sort(r.res.Item.Barcode, bin); cmd != nil {
+				a.sendRFID(cmd)
+			}
+		}
+	case "CHECKOUT":
+		if current {
+			a.Checkouts = append(a.Checkouts, r.res.Item)
+		}
+		if r.res.Item.OK {
+			a.countUsage(usageCounts{Checkouts: 1})
+		} else {
+			a.countUsage(usageCounts{Failures: 1})
+		}
+	}
+	r.res.Item = localizeItem(a.lang, r.res.Item)
+	bRes, err := json.Marshal(r.res)
+	if err != nil {
+		a.sendUI(ErrorResponse(a.lang, err))
+		return
+	}
+	a.sendUI(bRes)
+}
+
 // read from tcp connection and pipe into FromRFID channel
 func (a *Automat) tcpReader() {
 	r := bufio.NewReader(a.RFIDconn)
@@ -173,10 +937,24 @@ func (a *Automat) tcpReader() {
 	}
 }
 
-// write messages from channel ToRFID to tcp connection
+// write messages from queue ToRFID to tcp connection. If the RFID service
+// falls too far behind, the connection is closed.
 func (a *Automat) tcpWriter() {
+	go func() {
+		select {
+		case <-a.ToRFID.Overflow():
+			log.Println("ERROR", "RFID service", a.IP, "not keeping up; closing connection")
+			a.RFIDconn.Close()
+		case <-a.stopped:
+		}
+	}()
+
 	w := bufio.NewWriter(a.RFIDconn)
-	for msg := range a.ToRFID {
+	for {
+		msg, ok := a.ToRFID.Get(nil)
+		if !ok {
+			return
+		}
 		_, err := w.Write(msg)
 		if err != nil {
 			log.Println(err)
@@ -192,25 +970,36 @@ func (a *Automat) tcpWriter() {
 }
 
 // read from websocket connection and pipe into FromUI channel
-func (a *Automat) wsReader() {
+func (a *Automat) wsReader(c *uiConn) {
 	for {
 		// msgType, msg, err
-		_, msg, err := a.ws.ReadMessage()
+		_, msg, err := c.ws.ReadMessage()
 		if err != nil {
 			break
 		}
-		a.FromUI <- msg
+		select {
+		case a.FromUI <- msg:
+		case <-a.stopped:
+			return
+		}
 	}
 
 }
 
-// write messages from channel ToUI into websocket connection
-func (a *Automat) wsWriter() {
-	for msg := range a.ToUI {
+// write messages from queue ToUI into websocket connection, until the
+// connection is detached
+func (a *Automat) wsWriter(c *uiConn) {
+	for {
+		msg, ok := a.ToUI.Get(c.done)
+		if !ok {
+			return
+		}
 		// TODO ws.WriteJSON() takes interface{}, i.e  go struct
-		err := a.ws.WriteMessage(websocket.TextMessage, msg)
+		err := c.ws.WriteMessage(websocket.TextMessage, msg)
 		if err != nil {
-			break
+			// keep the message for the next UI connection
+			a.ToUI.PushFront(msg)
+			return
 		}
 		log.Println("-> UI:", strings.TrimRight(string(msg), "\n"))
 	}
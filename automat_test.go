@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/knakk/specs"
+)
+
+func newTestAutomat() *Automat {
+	c, _ := net.Pipe()
+	return newAutomat(c)
+}
+
+func TestUIBufferWhileDisconnected(t *testing.T) {
+	s := specs.New(t)
+	a := newTestAutomat()
+
+	for i := 0; i < uiBufferSize+5; i++ {
+		a.sendUI([]byte(fmt.Sprintf("msg %d", i)))
+	}
+	s.Expect(uiBufferSize, a.ToUI.Len())
+
+	// the oldest messages are dropped
+	msg, ok := a.ToUI.Get(nil)
+	s.Expect(true, ok)
+	s.Expect("msg 5", string(msg))
+}
+
+func TestRFIDReaderCommandsFirst(t *testing.T) {
+	s := specs.New(t)
+	a := newTestAutomat()
+
+	print := rfidPrintCommand("kvittering")
+	a.sendRFID(print)
+	a.sendRFID(rfidReaderOff)
+	a.sendRFID(rfidReaderOn)
+
+	for _, want := range [][]byte{rfidReaderOff, rfidReaderOn, print} {
+		m, _ := a.ToRFID.Get(nil)
+		s.Expect(string(want), string(m))
+	}
+}
+
+func TestUISnapshot(t *testing.T) {
+	s := specs.New(t)
+	a := newTestAutomat()
+	a.State = uiCHECKOUT
+	a.Authenticated = true
+	a.Patron = "patronid1"
+	a.Checkouts = append(a.Checkouts, item{Title: "Krutt-Kim", OK: true})
+
+	var snap UISnapshot
+	err := json.Unmarshal(a.snapshot(), &snap)
+	s.ExpectNil(err)
+	s.Expect("SNAPSHOT", snap.Action)
+	s.Expect("CHECKOUT", snap.Mode)
+	s.Expect("patronid1", snap.Patron)
+	s.Expect(1, len(snap.Checkouts))
+	s.Expect("Krutt-Kim", snap.Checkouts[0].Title)
+}
+
+// runJob performs the next queued SIP job, and applies the result
+func runJob(a *Automat) {
+	j := <-a.sipJobs
+	res, err := j.call()
+	a.handleSIPResult(sipResult{job: j, res: res, err: err})
+}
+
+func TestCardLogin(t *testing.T) {
+	s := specs.New(t)
+	b := &fakeBackend{}
+	a := newTestAutomat()
+	a.backend = b
+
+	a.handleRFID([]byte(`{"Command": "PATRON-CARD", "Barcode": "card1"}`))
+	runJob(a)
+	s.Expect([]string{"card1"}, b.logins)
+	s.Expect(true, a.Authenticated)
+	s.Expect("card1", a.Patron)
+
+	// PIN required: the UI is asked for it
+	a.requirePIN = true
+	a.handleRFID([]byte(`{"Command": "PATRON-CARD", "Barcode": "card2"}`))
+	s.Expect(false, a.Authenticated)
+	var msg UIResponse
+	for {
+		m, _ := a.ToUI.Get(nil)
+		json.Unmarshal(m, &msg)
+		if msg.Action == "CARD" || a.ToUI.Len() == 0 {
+			break
+		}
+	}
+	s.Expect("CARD", msg.Action)
+	s.Expect("card2", msg.Patron)
+
+	a.handleUI([]byte(`{"Action": "LOGIN", "PIN": "1234"}`))
+	runJob(a)
+	s.Expect([]string{"card1", "card2:1234"}, b.logins)
+	s.Expect("card2", a.Patron)
+}
+
+func TestReconfigureKeepsSession(t *testing.T) {
+	s := specs.New(t)
+	a := newTestAutomat()
+	a.configure(automat{IP: "10.0.0.1", Name: "Røa1", Department: "ROA", Terminal: "stub",
+		Sorter: &sorterConfig{DefaultBin: 1}})
+	a.Authenticated, a.Patron = true, "patron1"
+	a.sorterJammed = true
+	terminal, srt := a.terminal, a.sorter
+
+	// same terminal and sorter: kept as they are
+	a.configure(automat{IP: "10.0.0.1", Name: "Røa1", Department: "HUTL", Terminal: "stub",
+		Sorter: &sorterConfig{DefaultBin: 1}})
+	s.Expect("HUTL", a.Dept)
+	s.Expect(true, a.terminal == terminal)
+	s.Expect(true, a.sorter == srt)
+	s.Expect(true, a.sorterJammed)
+
+	// sorter removed
+	a.configure(automat{IP: "10.0.0.1", Name: "Røa1", Department: "HUTL", Terminal: "stub"})
+	s.Expect(true, a.sorter == nil)
+	s.Expect(false, a.sorterJammed)
+
+	s.Expect(true, a.Authenticated)
+	s.Expect("patron1", a.Patron)
+}
+
+func TestMaintenance(t *testing.T) {
+	s := specs.New(t)
+	b := &fakeBackend{}
+	a := newTestAutomat()
+	a.backend = b
+	// the UI messages queued since last time
+	ui := func() (msgs []UIResponse) {
+		for a.ToUI.Len() > 0 {
+			m, _ := a.ToUI.Get(nil)
+			var r UIResponse
+			json.Unmarshal(m, &r)
+			msgs = append(msgs, r)
+		}
+		return msgs
+	}
+	ac := automat{IP: "10.0.0.1", Name: "Røa1", Department: "ROA"}
+	a.configure(ac)
+	a.handleRFID([]byte(`{"Command": "PATRON-CARD", "Barcode": "card1"}`))
+	runJob(a)
+	a.handleUI([]byte(`{"Action": "CHECKOUT"}`))
+	ui()
+	for a.ToRFID.Len() > 0 {
+		a.ToRFID.Get(nil)
+	}
+
+	// the session ends, and the reader is turned off
+	ac.Maintenance = true
+	a.configure(ac)
+	s.Expect(uiMAINTENANCE, a.State)
+	s.Expect(false, a.Authenticated)
+	m, _ := a.ToRFID.Get(nil)
+	s.Expect(string(rfidReaderOff), string(m))
+	msgs := ui()
+	s.Expect("SNAPSHOT", msgs[len(msgs)-1].Action)
+	s.Expect("Automaten er ute av drift.", msgs[len(msgs)-1].Message)
+
+	a.handleRFID([]byte(`{"Command": "PATRON-CARD", "Barcode": "card1"}`))
+	a.handleUI([]byte(`{"Action": "CHECKIN"}`))
+	a.handleRFID([]byte(`{"Barcode": "03011174511003"}`))
+	s.Expect(0, len(a.sipJobs))
+	s.Expect(0, a.ToRFID.Len())
+	msgs = ui()
+	s.Expect(3, len(msgs))
+	s.Expect("MAINTENANCE", msgs[2].Action)
+
+	// a new message is shown at once; logging out keeps the automat out of order
+	ac.MaintenanceMessage = "Stengt for oppussing"
+	a.configure(ac)
+	s.Expect("Stengt for oppussing", ui()[0].Message)
+	a.handleUI([]byte(`{"Action": "LOGOUT"}`))
+	s.Expect(uiMAINTENANCE, a.State)
+
+	ac.Maintenance = false
+	a.configure(ac)
+	s.Expect(uiWAITING, a.State)
+	ui()
+	a.handleRFID([]byte(`{"Command": "PATRON-CARD", "Barcode": "card1"}`))
+	runJob(a)
+	s.Expect(true, a.Authenticated)
+}
+
+func TestMailboxes(t *testing.T) {
+	s := specs.New(t)
+	a := newTestAutomat()
+
+	// not taken by the state machine yet: only the latest is kept
+	a.postNews([]announcement{{ID: 1}})
+	a.postNews([]announcement{{ID: 1}, {ID: 2}})
+	s.Expect("1,2", announcementIDs(<-a.newsChan))
+	s.Expect(0, len(a.newsChan))
+
+	a.postHours(hoursReturnOnly)
+	a.postHours(hoursClosed)
+	s.Expect(hoursClosed, <-a.hoursChan)
+
+	a.postConf(automat{Name: "Røa1", Department: "ROA"})
+	a.postConf(automat{Name: "Røa1", Department: "HUTL"})
+	s.Expect("HUTL", (<-a.reconf).Department)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Backend is the library system (ILS) the hub performs circulation against.
+// The results are returned as UIResponses, ready to be passed on to the
+// user interface.
+type Backend interface {
+	// Authenticate verifies a patron's username and PIN.
+	Authenticate(dept, username, pin string) (*UIResponse, error)
+
+	// Checkin returns an item.
+	Checkin(dept, barcode string) (*UIResponse, error)
+
+	// Checkout loans an item to a patron.
+	Checkout(dept, username, barcode string) (*UIResponse, error)
+
+	// PatronInfo looks up a patron, without verifying the PIN. The response
+	// is Authenticated if the patron is valid and allowed to log in.
+	PatronInfo(dept, username string) (*UIResponse, error)
+
+	// Renew extends the loan period of an item loaned to a patron.
+	Renew(dept, username, barcode string) (*UIResponse, error)
+
+	// ItemInfo looks up an item.
+	ItemInfo(dept, barcode string) (*UIResponse, error)
+
+	// FeePaid records a fee payment made by a patron.
+	FeePaid(dept, username string, p payment) (*UIResponse, error)
+
+	// EndSession tells the library system that the patron has logged out.
+	EndSession(dept, username string) (*UIResponse, error)
+
+	// BlockPatron blocks a patron's card in the library system.
+	BlockPatron(dept, username, msg string) (*UIResponse, error)
+}
+
+// newBackend returns the Backend selected in the configuration. The SIP
+// backend uses pool.
+func newBackend(c *config, pool *ConnPool) (Backend, error) {
+	switch c.Backend {
+	case "", "sip":
+		return &SIPBackend{pool: pool}, nil
+	case "ncip":
+		if c.NCIPServer == "" {
+			return nil, errors.New("NCIP backend selected, but no NCIPServer configured")
+		}
+		return newNCIPBackend(c.NCIPServer, c.NCIPAgency), nil
+	}
+	return nil, fmt.Errorf("unknown backend: %q", c.Backend)
+}
+
+// SIPBackend talks SIP2 over a pool of TCP connections.
+type SIPBackend struct {
+	pool *ConnPool
+}
+
+func (b *SIPBackend) Authenticate(dept, username, pin string) (*UIResponse, error) {
+	return DoSIPCall(b.pool, sipFormMsgAuthenticate(dept, username, pin), authParse)
+}
+
+func (b *SIPBackend) Checkin(dept, barcode string) (*UIResponse, error) {
+	return DoSIPCall(b.pool, sipFormMsgCheckin(dept, barcode), checkinParse)
+}
+
+func (b *SIPBackend) Checkout(dept, username, barcode string) (*UIResponse, error) {
+	return DoSIPCall(b.pool, sipFormMsgCheckout(username, barcode), checkoutParse)
+}
+
+func (b *SIPBackend) PatronInfo(dept, username string) (*UIResponse, error) {
+	return DoSIPCall(b.pool, sipFormMsgPatronInfo(dept, username), patronInfoParse)
+}
+
+func (b *SIPBackend) Renew(dept, username, barcode string) (*UIResponse, error) {
+	return DoSIPCall(b.pool, sipFormMsgRenew(dept, username, barcode), renewParse)
+}
+
+func (b *SIPBackend) ItemInfo(dept, barcode string) (*UIResponse, error) {
+	return DoSIPCall(b.pool, sipFormMsgItemInfo(dept, barcode), itemInfoParse)
+}
+
+func (b *SIPBackend) FeePaid(dept, username string, p payment) (*UIResponse, error) {
+	return DoSIPCall(b.pool, sipFormMsgFeePaid(dept, username, p), feePaidParse)
+}
+
+func (b *SIPBackend) EndSession(dept, username string) (*UIResponse, error) {
+	return DoSIPCall(b.pool, sipFormMsgEndSession(dept, username), endSessionParse)
+}
+
+func (b *SIPBackend) BlockPatron(dept, username, msg string) (*UIResponse, error) {
+	return DoSIPCall(b.pool, sipFormMsgBlockPatron(dept, username, msg), patronStatusResponseParse)
+}
@@ -2,34 +2,472 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 type automat struct {
 	IP         string
 	Name       string
 	Department string
+	Sorter     *sorterConfig // sorting machine, if any
+	Terminal   string        // payment terminal driver, if any ("stub")
+	RequirePIN bool          // require PIN when logging in with a library card
+	CertName   string        // common name of the client certificate, if not Name
+	Secret     string        // lets the UI connect from another IP than the automat's
+	Record     bool          // record sessions to RecordDir, for replay
+	Language   string        // language of new sessions: nb (default), nn or en
+
+	// Out of order: patrons can't use the automat. Also set with the
+	// /.maintenance admin endpoint.
+	Maintenance        bool
+	MaintenanceMessage string // shown by the UI; default "out of order" text
 }
 
 type config struct {
 	LogFile           string
 	LogToFile         bool
+	LogLevel          string // DEBUG, INFO (default), WARN or ERROR
 	NumSIPConnections int
 	SIPServer         string
+	SIPUsername       string // SIP login (93); default: one "stresstest<n>" user per connection
+	SIPPassword       string // set with AUTOMATHUB_SIPPASSWORD rather than in the file
+	SIPLocation       string // location code of the SIP login
+	Backend           string // library system protocol: "sip" (default) or "ncip"
+	NCIPServer        string // NCIP responder URL
+	NCIPAgency        string // NCIP agency id of the hub
 	TCPServer         string
 	TCPPort           string
 	HTTPPort          string
+	Departments       []string // known department codes; if given, automats must use one
 	Automats          []automat
+
+	// Opening hours by department: automats are open, return-only or
+	// closed as scheduled. Departments without a schedule are always open.
+	Schedules map[string]branchSchedule
+
+	// Look up items (SIP 17) before checkout, and refuse items that can't be
+	// loaned, with a reason the UI can show.
+	ItemInfoBeforeCheckout bool
+	ReferenceOnlyLocations []string // items shelved here are not for loan
+
+	// Brute-force protection for PIN logins
+	LoginGuard loginGuardConfig
+
+	// TLS, if given. The RFID connections require client certificates
+	// (mutual TLS), one per automat. Changed certificate files are reloaded.
+	RFIDTLS *tlsConfig
+	SIPTLS  *tlsConfig
+
+	// Access control for the monitor and admin endpoints
+	Auth *authConfig
+
+	// Recordings of automats with Record set; see "automathub replay"
+	RecordDir string
+
+	// Usage statistics, one file per day; see /.usage
+	UsageDir string
+
+	// Alerts on automat outages and library system trouble; see /.alerts
+	Alerts alertConfig
+
+	// Files overriding the templates and static files built into the
+	// binary, i.e. html/ui.html, css/styles.css, or the stylesheet of the UIs
+	// of a department: themes/<Department>.css
+	AssetDir string
 }
 
-func (c *config) fromFile(file string) error {
-	b, err := ioutil.ReadFile(file)
+// duration is a time.Duration written as "15m" or "30s" in the config file.
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"15m\": %s", b)
+	}
+	v, err := time.ParseDuration(s)
 	if err != nil {
 		return err
 	}
-	err = json.Unmarshal(b, c)
+	d.Duration = v
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// findAutomat returns the configured automat with the IP of addr.
+func (c *config) findAutomat(addr net.Addr) (automat, bool) {
+	if addr == nil {
+		return automat{}, false
+	}
+	ip, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		ip = addr.String()
+	}
+	for _, a := range c.Automats {
+		if a.IP == ip {
+			return a, true
+		}
+	}
+	return automat{}, false
+}
+
+// Defaults for settings missing in the config file
+var defaultConfig = config{
+	LogFile:           "automathub.log",
+	LogLevel:          "INFO",
+	NumSIPConnections: 4,
+	SIPLocation:       "HUTL",
+	Backend:           "sip",
+	TCPPort:           "6666",
+	HTTPPort:          "9000",
+	RecordDir:         "recordings",
+	UsageDir:          "usage",
+}
+
+// Environment variables override settings of the config file:
+// AUTOMATHUB_SIPPASSWORD=secret sets SIPPassword.
+const envPrefix = "AUTOMATHUB_"
+
+// loadConfig reads a config file, applies environment overrides and
+// defaults, and validates the result. It returns all problems found.
+func loadConfig(file string, env func(string) (string, bool)) (*config, []error) {
+	c := &config{}
+	if err := c.fromFile(file); err != nil {
+		return nil, []error{err}
+	}
+	errs := c.fromEnv(env)
+	c.setDefaults()
+	errs = append(errs, c.validate()...)
+	return c, errs
+}
+
+// fromFile reads a config file. Syntax errors and unknown settings are
+// reported with their position.
+func (c *config) fromFile(file string) error {
+	b, err := ioutil.ReadFile(file)
 	if err != nil {
 		return err
 	}
+	var raw interface{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return jsonError(file, b, err)
+	}
+	if unknown := unknownFields("", raw, reflect.TypeOf(*c)); len(unknown) > 0 {
+		return fmt.Errorf("%s: unknown settings: %s", file, strings.Join(unknown, ", "))
+	}
+	if err := json.Unmarshal(b, c); err != nil {
+		return jsonError(file, b, err)
+	}
 	return nil
 }
+
+// jsonError adds the file name and the line and column to a JSON error.
+func jsonError(file string, b []byte, err error) error {
+	var offset int64
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		offset = e.Offset
+	case *json.UnmarshalTypeError:
+		offset = e.Offset
+		if e.Field != "" {
+			err = fmt.Errorf("%s: expected %v, got %s", e.Field, e.Type, e.Value)
+		}
+	default:
+		return fmt.Errorf("%s: %v", file, err)
+	}
+	if offset > int64(len(b)) {
+		offset = int64(len(b))
+	}
+	line, col := 1, 1
+	for _, ch := range b[:offset] {
+		if ch == '\n' {
+			line, col = line+1, 1
+		} else {
+			col++
+		}
+	}
+	return fmt.Errorf("%s:%d:%d: %v", file, line, col, err)
+}
+
+// unknownFields returns the paths of the JSON object keys in v which do not
+// match a field of t, case-insensitively, as encoding/json does.
+func unknownFields(path string, v interface{}, t reflect.Type) []string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if reflect.PtrTo(t).Implements(reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()) {
+		return nil
+	}
+	var unknown []string
+	switch t.Kind() {
+	case reflect.Struct:
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		for k, fv := range obj {
+			f, ok := t.FieldByNameFunc(func(name string) bool { return strings.EqualFold(name, k) })
+			if !ok || f.PkgPath != "" {
+				unknown = append(unknown, path+k)
+				continue
+			}
+			unknown = append(unknown, unknownFields(path+k+".", fv, f.Type)...)
+		}
+	case reflect.Slice:
+		arr, ok := v.([]interface{})
+		if !ok {
+			return nil
+		}
+		for i, ev := range arr {
+			unknown = append(unknown, unknownFields(fmt.Sprintf("%s%d.", path, i), ev, t.Elem())...)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+// fromEnv applies the environment overrides of top-level settings.
+func (c *config) fromEnv(env func(string) (string, bool)) []error {
+	var errs []error
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		name := envPrefix + strings.ToUpper(f.Name)
+		s, ok := env(name)
+		if !ok {
+			continue
+		}
+		fv := v.Field(i)
+		switch fv.Kind() {
+		case reflect.String:
+			fv.SetString(s)
+		case reflect.Int:
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: not a number: %q", name, s))
+				continue
+			}
+			fv.SetInt(int64(n))
+		case reflect.Bool:
+			b, err := strconv.ParseBool(s)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: not true or false: %q", name, s))
+				continue
+			}
+			fv.SetBool(b)
+		default:
+			errs = append(errs, fmt.Errorf("%s: %s can't be set from the environment", name, f.Name))
+		}
+	}
+	return errs
+}
+
+// setDefaults fills in settings missing in the config file.
+func (c *config) setDefaults() {
+	d := defaultConfig
+	if c.LogToFile && c.LogFile == "" {
+		c.LogFile = d.LogFile
+	}
+	if c.LogLevel == "" {
+		c.LogLevel = d.LogLevel
+	}
+	if c.Backend == "" {
+		c.Backend = d.Backend
+	}
+	if c.Backend == "sip" {
+		if c.NumSIPConnections == 0 {
+			c.NumSIPConnections = d.NumSIPConnections
+		}
+		if c.SIPLocation == "" {
+			c.SIPLocation = d.SIPLocation
+		}
+	}
+	if c.TCPPort == "" {
+		c.TCPPort = d.TCPPort
+	}
+	if c.HTTPPort == "" {
+		c.HTTPPort = d.HTTPPort
+	}
+	if c.RecordDir == "" {
+		c.RecordDir = d.RecordDir
+	}
+	if c.UsageDir == "" {
+		c.UsageDir = d.UsageDir
+	}
+}
+
+// validate checks the config, returning all problems found.
+func (c *config) validate() []error {
+	var errs []error
+	add := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	for _, p := range []struct{ name, port string }{{"TCPPort", c.TCPPort}, {"HTTPPort", c.HTTPPort}} {
+		if n, err := strconv.Atoi(p.port); err != nil || n < 1 || n > 65535 {
+			add("%s: invalid port: %q", p.name, p.port)
+		}
+	}
+	if c.TCPPort == c.HTTPPort {
+		add("TCPPort and HTTPPort are both %s", c.TCPPort)
+	}
+	if _, ok := logLevels[c.logLevel()]; !ok {
+		add("unknown LogLevel: %q", c.LogLevel)
+	}
+	if c.LogToFile && c.LogFile == "" {
+		add("LogToFile, but no LogFile")
+	}
+
+	switch c.Backend {
+	case "", "sip":
+		if c.NumSIPConnections < 1 {
+			add("NumSIPConnections must be at least 1")
+		}
+		if c.NumSIPConnections > maxPoolSize {
+			add("NumSIPConnections must be at most %d", maxPoolSize)
+		}
+		if _, _, err := net.SplitHostPort(c.SIPServer); err != nil {
+			add("SIPServer must be host:port, not %q", c.SIPServer)
+		}
+		if c.SIPUsername != "" && c.SIPPassword == "" {
+			add("SIPUsername %q has no SIPPassword; set %sSIPPASSWORD", c.SIPUsername, envPrefix)
+		}
+	case "ncip":
+		if c.NCIPServer == "" {
+			add("NCIP backend selected, but no NCIPServer configured")
+		}
+	default:
+		add("unknown Backend: %q", c.Backend)
+	}
+
+	if c.RFIDTLS != nil && (c.RFIDTLS.Cert == "" || c.RFIDTLS.Key == "" || c.RFIDTLS.CA == "") {
+		add("RFIDTLS needs Cert, Key and CA (for the automats' client certificates)")
+	}
+	if c.SIPTLS != nil && (c.SIPTLS.Cert == "") != (c.SIPTLS.Key == "") {
+		add("SIPTLS: Cert and Key must be given together")
+	}
+	if c.LoginGuard.MaxFailures < 0 || c.LoginGuard.BlockAfter < 0 {
+		add("LoginGuard: MaxFailures and BlockAfter can't be negative")
+	} else if !c.LoginGuard.blockReachable() {
+		add("LoginGuard: BlockAfter above MaxFailures needs a LockDuration shorter than Window")
+	}
+	if c.Auth != nil {
+		for i, u := range c.Auth.Users {
+			if parseRole(u.Role) == roleNone {
+				add("Auth.Users[%d] %q: unknown Role: %q", i, u.Username, u.Role)
+			}
+			if !validPasswordHash(u.Password) {
+				add("Auth.Users[%d] %q: Password must be a bcrypt hash", i, u.Username)
+			}
+		}
+		for i, t := range c.Auth.Tokens {
+			if parseRole(t.Role) == roleNone {
+				add("Auth.Tokens[%d] %q: unknown Role: %q", i, t.Name, t.Role)
+			}
+			if len(t.Token) < 16 {
+				add("Auth.Tokens[%d] %q: Token must be at least 16 characters", i, t.Name)
+			}
+		}
+	}
+
+	c.Alerts.validate(add)
+
+	if c.AssetDir != "" {
+		if fi, err := os.Stat(c.AssetDir); err != nil || !fi.IsDir() {
+			add("AssetDir: not a directory: %q", c.AssetDir)
+		}
+	}
+
+	depts := make(map[string]bool)
+	for _, d := range c.Departments {
+		depts[d] = true
+	}
+	for d, s := range c.Schedules {
+		if len(depts) > 0 && !depts[d] {
+			add("Schedules: unknown Department: %q", d)
+		}
+		s.validate(d, add)
+	}
+	seen := make(map[string]bool)
+	for i, a := range c.Automats {
+		switch {
+		case a.IP == "":
+			add("Automats[%d] %q: no IP", i, a.Name)
+		case net.ParseIP(a.IP) == nil:
+			add("Automats[%d] %q: invalid IP: %q", i, a.Name, a.IP)
+		case seen[a.IP]:
+			add("Automats[%d] %q: duplicate IP: %s", i, a.Name, a.IP)
+		}
+		seen[a.IP] = true
+		if a.Department == "" {
+			add("Automats[%d] %q: no Department", i, a.Name)
+		} else if len(depts) > 0 && !depts[a.Department] {
+			add("Automats[%d] %q: unknown Department: %q", i, a.Name, a.Department)
+		}
+		if _, err := newPaymentTerminal(a.Terminal); err != nil {
+			add("Automats[%d] %q: %v", i, a.Name, err)
+		}
+		if a.Language != "" && !knownLanguage(a.Language) {
+			add("Automats[%d] %q: unknown Language: %q", i, a.Name, a.Language)
+		}
+	}
+	return errs
+}
+
+func (c *config) logLevel() string {
+	if c.LogLevel == "" {
+		return "INFO"
+	}
+	return strings.ToUpper(c.LogLevel)
+}
+
+// reloaded returns a copy of c with the settings of n that can change while
+// running, and the names of the other settings that differ in n; these take
+// effect on restart.
+func (c *config) reloaded(n *config) (*config, []string) {
+	r := *c
+	r.Automats = n.Automats
+	r.Schedules = n.Schedules
+	r.NumSIPConnections = n.NumSIPConnections
+	r.LogLevel = n.LogLevel
+
+	var restart []string
+	rv, nv := reflect.ValueOf(r), reflect.ValueOf(*n)
+	for i := 0; i < rv.NumField(); i++ {
+		if !reflect.DeepEqual(rv.Field(i).Interface(), nv.Field(i).Interface()) {
+			restart = append(restart, rv.Type().Field(i).Name)
+		}
+	}
+	return &r, restart
+}
+
+// liveConfig is a config that can be replaced while in use.
+type liveConfig struct {
+	mu sync.RWMutex
+	c  *config
+}
+
+func (l *liveConfig) get() *config {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.c
+}
+
+func (l *liveConfig) set(c *config) {
+	l.mu.Lock()
+	l.c = c
+	l.mu.Unlock()
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/knakk/specs"
+)
+
+func validTestConfig() *config {
+	return &config{
+		TCPPort: "6666", HTTPPort: "9000", Backend: "sip", SIPServer: "sip:6001", NumSIPConnections: 2,
+		Departments: []string{"HUTL", "MAJ"},
+		Automats: []automat{
+			{IP: "10.0.0.1", Name: "a", Department: "HUTL"},
+			{IP: "10.0.0.2", Name: "b", Department: "MAJ"},
+		}}
+}
+
+func TestConfigValidate(t *testing.T) {
+	s := specs.New(t)
+	s.Expect(0, len(validTestConfig().validate()))
+
+	// every problem is reported
+	c := validTestConfig()
+	c.TCPPort, c.HTTPPort, c.LogLevel = "66x", "99999", "LOUD"
+	c.Automats = append(c.Automats,
+		automat{IP: "10.0.0.1", Name: "c", Department: "HUTL"},
+		automat{Name: "d", Department: "HUTL"},
+		automat{IP: "10.0.0", Name: "e", Department: "ROA"},
+		automat{IP: "10.0.0.9", Name: "f", Department: "HUTL", Terminal: "cash", Language: "se"})
+	s.Expect(9, len(c.validate()))
+
+	// no SIP connections needed with NCIP
+	c = validTestConfig()
+	c.Backend, c.SIPServer, c.NumSIPConnections, c.NCIPServer = "ncip", "", 0, "http://ncip/"
+	s.Expect(0, len(c.validate()))
+}
+
+func TestLoadConfig(t *testing.T) {
+	s := specs.New(t)
+	dir, err := ioutil.TempDir("", "automathub-config")
+	s.ExpectNil(err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "config.json")
+	env := map[string]string{}
+	lookup := func(k string) (string, bool) { v, ok := env[k]; return v, ok }
+
+	ioutil.WriteFile(file, []byte(`{
+	"SIPServer": "sip:6001",
+	"SIPUsername": "hub",
+	"Automats": [{"IP": "10.0.0.1", "Name": "a", "Department": "HUTL"}]
+}`), 0600)
+	env["AUTOMATHUB_SIPPASSWORD"] = "secret"
+	env["AUTOMATHUB_NUMSIPCONNECTIONS"] = "3"
+	c, errs := loadConfig(file, lookup)
+	s.Expect(0, len(errs))
+	s.Expect("secret", c.SIPPassword)
+	s.Expect(3, c.NumSIPConnections)
+	s.Expect("6666", c.TCPPort) // default
+	s.Expect("sip", c.Backend)
+
+	delete(env, "AUTOMATHUB_SIPPASSWORD")
+	env["AUTOMATHUB_NUMSIPCONNECTIONS"] = "many"
+	_, errs = loadConfig(file, lookup)
+	s.Expect(2, len(errs))
+
+	// unknown settings, at any depth
+	ioutil.WriteFile(file, []byte(`{"SIPServr": "sip:6001", "Automats": [{"IP": "10.0.0.1", "Dept": "HUTL"}],
+		"LoginGuard": {"Window": "15m"}}`), 0600)
+	_, errs = loadConfig(file, lookup)
+	s.Expect(1, len(errs))
+	s.Expect(file+": unknown settings: Automats.0.Dept, SIPServr", errs[0].Error())
+
+	// position of syntax and type errors
+	ioutil.WriteFile(file, []byte("{\n\t\"TCPPort\": \"6666\",\n\t\"HTTPPort\": 9000\n}"), 0600)
+	_, errs = loadConfig(file, lookup)
+	s.Expect(true, strings.HasPrefix(errs[0].Error(), file+":3:"))
+	s.Expect(true, strings.HasSuffix(errs[0].Error(), ": HTTPPort: expected string, got number"))
+	ioutil.WriteFile(file, []byte("{\n\t\"TCPPort\": \"6666\"\n\t\"HTTPPort\": \"9000\"\n}"), 0600)
+	_, errs = loadConfig(file, lookup)
+	s.Expect(true, strings.HasPrefix(errs[0].Error(), file+":3:"))
+}
+
+func TestSIPLogin(t *testing.T) {
+	s := specs.New(t)
+	c := &config{SIPLocation: "HUTL"}
+	s.Expect("9300CNstresstest2|COstresstest2|CPHUTL|\r", sipFormMsgLogin(c, 2))
+	c.SIPUsername, c.SIPPassword = "hub", "secret"
+	s.Expect("9300CNhub|COsecret|CPHUTL|\r", sipFormMsgLogin(c, 2))
+}
+
+func TestConfigReloaded(t *testing.T) {
+	s := specs.New(t)
+	old := &config{TCPPort: "6666", HTTPPort: "9000", NumSIPConnections: 2,
+		Automats: []automat{{IP: "10.0.0.1", Department: "HUTL"}}}
+	n := &config{TCPPort: "7777", HTTPPort: "9000", NumSIPConnections: 4, LogLevel: "WARN",
+		Automats: []automat{{IP: "10.0.0.1", Department: "MAJ"}, {IP: "10.0.0.2"}}}
+
+	c, restart := old.reloaded(n)
+	s.Expect([]string{"TCPPort"}, restart)
+	s.Expect("6666", c.TCPPort)
+	s.Expect(4, c.NumSIPConnections)
+	s.Expect("WARN", c.LogLevel)
+	s.Expect(n.Automats, c.Automats)
+	s.Expect("HUTL", old.Automats[0].Department)
+}
+
+func TestLevelWriter(t *testing.T) {
+	s := specs.New(t)
+	var b bytes.Buffer
+	w := newLevelWriter(&b)
+	l := log.New(w, "", log.LstdFlags)
+
+	l.Println("INFO", "shown")
+	s.ExpectNil(w.setLevel("warn"))
+	l.Println("INFO", "hidden")
+	l.Println("ERROR", "shown")
+	l.Println("-> SIP", "shown, no level")
+	s.Expect(false, w.setLevel("LOUD") == nil)
+
+	s.Expect(3, bytes.Count(b.Bytes(), []byte("shown")))
+	s.Expect(0, bytes.Count(b.Bytes(), []byte("hidden")))
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A SIP2 server emulating Koha, with an in-memory catalogue of patrons and
+// items. It lets the hub, and the tests, run without a library system.
+
+// sipCatalogue is the state of the fake library system.
+type sipCatalogue struct {
+	Institution string // AO, default "HUTL"
+	Currency    string // BH, default "NOK"
+	FeeLimit    string // CC, i.e. "100.00"
+	LoanDays    int    // loan period, default 28
+	Patrons     []*fakePatron
+	Items       []*fakeItem
+}
+
+type fakePatron struct {
+	ID      string
+	PIN     string
+	Name    string
+	Fees    string // outstanding, i.e. "50.00"
+	Expires string // YYYYMMDD, optional
+	Lost    bool   // card reported lost
+	Blocked bool   // charge privileges denied
+}
+
+type fakeItem struct {
+	Barcode      string
+	Title        string
+	MediaType    string // CK, i.e. "001"
+	Location     string // AQ, permanent location
+	Branch       string // owning branch; returns elsewhere are sent there
+	CheckedOutTo string // patron ID
+	Due          time.Time
+	HoldFor      string // patron ID
+	HoldBranch   string // pickup branch of the hold
+}
+
+// loadSIPCatalogue reads a catalogue from a JSON file.
+func loadSIPCatalogue(file string) (*sipCatalogue, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var c sipCatalogue
+	if err := json.NewDecoder(f).Decode(&c); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return &c, nil
+}
+
+// sipFaults are failures the fake SIP server can be told to make.
+type sipFaults struct {
+	Delay       time.Duration // before every response
+	DropAfter   int           // close each connection after this many requests; 0 never
+	RefuseLogin bool          // answer every login (93) with failure
+}
+
+// fakeSIPServer serves SIP2 from a catalogue.
+type fakeSIPServer struct {
+	faults sipFaults
+
+	mu      sync.Mutex // guards the catalogue
+	cat     *sipCatalogue
+	patrons map[string]*fakePatron
+	items   map[string]*fakeItem
+
+	ln   net.Listener
+	quit chan bool
+	now  func() time.Time
+}
+
+func newFakeSIPServer(cat *sipCatalogue, f sipFaults) *fakeSIPServer {
+	if cat.Institution == "" {
+		cat.Institution = "HUTL"
+	}
+	if cat.Currency == "" {
+		cat.Currency = "NOK"
+	}
+	if cat.LoanDays == 0 {
+		cat.LoanDays = 28
+	}
+	s := &fakeSIPServer{
+		faults:  f,
+		cat:     cat,
+		patrons: make(map[string]*fakePatron),
+		items:   make(map[string]*fakeItem),
+		quit:    make(chan bool),
+		now:     time.Now,
+	}
+	for _, p := range cat.Patrons {
+		s.patrons[p.ID] = p
+	}
+	for _, it := range cat.Items {
+		s.items[it.Barcode] = it
+	}
+	return s
+}
+
+// listen starts listening on addr, i.e. ":6001" or "127.0.0.1:0".
+func (s *fakeSIPServer) listen(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s.ln = ln
+	return nil
+}
+
+// Addr returns the address listened on.
+func (s *fakeSIPServer) Addr() string { return s.ln.Addr().String() }
+
+// serve accepts connections until close.
+func (s *fakeSIPServer) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			select {
+			case <-s.quit:
+				return
+			default:
+			}
+			log.Println("ERROR", "fake SIP server:", err)
+			continue
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeSIPServer) close() {
+	close(s.quit)
+	s.ln.Close()
+}
+
+// handle answers the requests of one connection.
+func (s *fakeSIPServer) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for n := 1; ; n++ {
+		req, err := r.ReadString('\r')
+		if err != nil {
+			return
+		}
+		req = strings.Trim(req, "\n\r")
+		if s.faults.DropAfter > 0 && n > s.faults.DropAfter {
+			log.Println("INFO", "fake SIP server: dropping connection from", conn.RemoteAddr())
+			return
+		}
+		if s.faults.Delay > 0 {
+			time.Sleep(s.faults.Delay)
+		}
+		if _, err := conn.Write([]byte(s.respond(req) + "\r")); err != nil {
+			return
+		}
+	}
+}
+
+// fixed part lengths of the requests, before the variable fields
+var sipRequestFixedLen = map[string]int{
+	"93": 4, "99": 10, "63": 33, "09": 39, "11": 40, "17": 20,
+	"29": 40, "35": 20, "37": 27, "01": 21,
+}
+
+// respond returns the response to a request, without the terminating \r.
+func (s *fakeSIPServer) respond(req string) string {
+	if len(req) < 2 {
+		return "96"
+	}
+	code := req[:2]
+	n, ok := sipRequestFixedLen[code]
+	if !ok || len(req) < n {
+		return "96" // request resend
+	}
+	f := pairFieldIDandValue(req[n:])
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now().Format(sipDateLayout)
+	switch code {
+	case "93":
+		if s.faults.RefuseLogin || f["CN"] == "" {
+			return "940"
+		}
+		return "941"
+	case "99":
+		return "98YYYYNN600003" + now + "2.00AO" + s.cat.Institution + "|AMFake Koha|BXYYYYYYYYYYYNNYYY|"
+	case "63":
+		return s.patronInfo(now, f)
+	case "09":
+		return s.checkin(now, f)
+	case "11":
+		return s.checkout(now, f)
+	case "17":
+		return s.itemInfo(now, f)
+	case "29":
+		return s.renew(now, f)
+	case "35":
+		return fmt.Sprintf("36Y%sAO%s|AA%s|AFThank you!|", now, f["AO"], f["AA"])
+	case "37":
+		return s.feePaid(now, f)
+	case "01":
+		return s.block(now, f)
+	}
+	return "96"
+}
+
+// patronStatus returns the 14 character patron status field.
+func (p *fakePatron) status() string {
+	flags := []byte("              ")
+	if p.Blocked {
+		copy(flags, "YYYY")
+	}
+	if p.Lost {
+		flags[4] = 'Y'
+	}
+	if amount, _ := parseAmount(p.Fees); amount > 0 {
+		flags[11] = 'Y'
+	}
+	return string(flags)
+}
+
+func (s *fakeSIPServer) patronInfo(now string, f map[string]string) string {
+	p, ok := s.patrons[f["AA"]]
+	if !ok {
+		return fmt.Sprintf("64YYYY          012%s000000000000000000000000AO%s|AA%s|BLN|AFUnknown patron|",
+			now, f["AO"], f["AA"])
+	}
+	var loans []string
+	for _, it := range s.cat.Items {
+		if it.CheckedOutTo == p.ID {
+			loans = append(loans, it.Barcode)
+		}
+	}
+	resp := fmt.Sprintf("64%s012%s00000000%04d000000000000AO%s|AA%s|AE%s|BLY|",
+		p.status(), now, len(loans), f["AO"], p.ID, p.Name)
+	if _, withPIN := f["AD"]; withPIN {
+		if f["AD"] == p.PIN {
+			resp += "CQY|"
+		} else {
+			resp += "CQN|"
+		}
+	}
+	if p.Fees != "" {
+		resp += fmt.Sprintf("BV%s|BH%s|", p.Fees, s.cat.Currency)
+	}
+	if s.cat.FeeLimit != "" {
+		resp += "CC" + s.cat.FeeLimit + "|"
+	}
+	if p.Expires != "" {
+		resp += "PA" + p.Expires + "|"
+	}
+	return resp + "AFGreetings from Koha. |"
+}
+
+func (s *fakeSIPServer) checkin(now string, f map[string]string) string {
+	it, ok := s.items[f["AB"]]
+	if !ok {
+		return fmt.Sprintf("100NUY%sAO%s|AB%s|CV99|AFInvalid Item|", now, f["AO"], f["AB"])
+	}
+	if it.CheckedOutTo == "" {
+		return fmt.Sprintf("100NUY%sAO%s|AB%s|AQ%s|AJ%s|CV99|AFItem not checked out|",
+			now, f["AO"], it.Barcode, it.Location, it.Title)
+	}
+	patron := it.CheckedOutTo
+	it.CheckedOutTo, it.Due = "", time.Time{}
+
+	alert, extra := "N", ""
+	switch {
+	case it.HoldFor != "" && (it.HoldBranch == "" || it.HoldBranch == f["AO"]):
+		alert, extra = "Y", fmt.Sprintf("CV%s|CY%s|DA%s|", alertHoldLocal, it.HoldFor, s.patronName(it.HoldFor))
+	case it.HoldFor != "":
+		alert, extra = "Y", fmt.Sprintf("CV%s|CT%s|CY%s|", alertHoldRemote, it.HoldBranch, it.HoldFor)
+	case it.Branch != "" && it.Branch != f["AO"]:
+		alert, extra = "Y", fmt.Sprintf("CV%s|CT%s|", alertSendToBranch, it.Branch)
+	}
+	return fmt.Sprintf("101YN%s%sAO%s|AB%s|AQ%s|AJ%s|AA%s|CK%s|%s",
+		alert, now, f["AO"], it.Barcode, it.Location, it.Title, patron, it.MediaType, extra)
+}
+
+func (s *fakeSIPServer) patronName(id string) string {
+	if p, ok := s.patrons[id]; ok {
+		return p.Name
+	}
+	return ""
+}
+
+// checkoutRefused returns why patron p may not borrow it, or "".
+func (s *fakeSIPServer) checkoutRefused(p *fakePatron, it *fakeItem) string {
+	switch {
+	case p.Blocked || p.Lost:
+		return "Patron blocked"
+	case it.CheckedOutTo != "" && it.CheckedOutTo != p.ID:
+		return "Item checked out to another patron"
+	case it.HoldFor != "" && it.HoldFor != p.ID:
+		return "Item on hold for another patron"
+	}
+	return ""
+}
+
+func (s *fakeSIPServer) dueDate() time.Time {
+	d := s.now().AddDate(0, 0, s.cat.LoanDays)
+	return time.Date(d.Year(), d.Month(), d.Day(), 23, 59, 0, 0, d.Location())
+}
+
+func (s *fakeSIPServer) checkout(now string, f map[string]string) string {
+	p, pok := s.patrons[f["AA"]]
+	it, iok := s.items[f["AB"]]
+	switch {
+	case !pok:
+		return fmt.Sprintf("120NUN%sAO%s|AA%s|AB%s|AJ|AH|AFInvalid patron|BLN|", now, s.cat.Institution, f["AA"], f["AB"])
+	case !iok:
+		return fmt.Sprintf("120NUN%sAO%s|AA%s|AB%s|AJ|AH|AFInvalid Item|BLY|", now, s.cat.Institution, f["AA"], f["AB"])
+	}
+	if why := s.checkoutRefused(p, it); why != "" {
+		return fmt.Sprintf("120NUN%sAO%s|AA%s|AB%s|AJ%s|AH|AF%s|BLY|", now, s.cat.Institution, p.ID, it.Barcode, it.Title, why)
+	}
+	renewal := "N"
+	if it.CheckedOutTo == p.ID {
+		renewal = "Y"
+	}
+	if it.HoldFor == p.ID {
+		it.HoldFor, it.HoldBranch = "", ""
+	}
+	it.CheckedOutTo, it.Due = p.ID, s.dueDate()
+	return fmt.Sprintf("121%sNY%sAO%s|AA%s|AB%s|AJ%s|AH%s|",
+		renewal, now, s.cat.Institution, p.ID, it.Barcode, it.Title, it.Due.Format(sipDateLayout))
+}
+
+func (s *fakeSIPServer) renew(now string, f map[string]string) string {
+	p, pok := s.patrons[f["AA"]]
+	it, iok := s.items[f["AB"]]
+	switch {
+	case !pok || !iok:
+		return fmt.Sprintf("300NUN%sAO%s|AA%s|AB%s|AJ|AH|AFInvalid patron or item|", now, f["AO"], f["AA"], f["AB"])
+	case it.CheckedOutTo != p.ID:
+		return fmt.Sprintf("300NUN%sAO%s|AA%s|AB%s|AJ%s|AH|AFItem not checked out to patron|", now, f["AO"], p.ID, it.Barcode, it.Title)
+	case it.HoldFor != "":
+		return fmt.Sprintf("300NUN%sAO%s|AA%s|AB%s|AJ%s|AH|AFOn hold for another patron|", now, f["AO"], p.ID, it.Barcode, it.Title)
+	}
+	it.Due = s.dueDate()
+	return fmt.Sprintf("301YNN%sAO%s|AA%s|AB%s|AJ%s|AH%s|",
+		now, f["AO"], p.ID, it.Barcode, it.Title, it.Due.Format(sipDateLayout))
+}
+
+func (s *fakeSIPServer) itemInfo(now string, f map[string]string) string {
+	it, ok := s.items[f["AB"]]
+	if !ok {
+		return fmt.Sprintf("18010000%sAB%s|AJ|AFItem not found|", now, f["AB"])
+	}
+	circ, status, queue := circAvailable, "", 0
+	switch {
+	case it.CheckedOutTo != "":
+		circ, status = circCharged, "Checked out"
+	case it.HoldFor != "":
+		circ, status = circOnHoldShelf, "On hold"
+	}
+	if it.HoldFor != "" {
+		queue = 1
+	}
+	return fmt.Sprintf("18%s0200%sAB%s|AJ%s|AQ%s|CF%d|CK%s|CY%s|AF%s|",
+		circ, now, it.Barcode, it.Title, it.Location, queue, it.MediaType, it.HoldFor, status)
+}
+
+func (s *fakeSIPServer) feePaid(now string, f map[string]string) string {
+	p, ok := s.patrons[f["AA"]]
+	if !ok {
+		return fmt.Sprintf("38N%sAO%s|AA%s|AFUnknown patron|", now, f["AO"], f["AA"])
+	}
+	paid, err := parseAmount(f["BV"])
+	owed, _ := parseAmount(p.Fees)
+	if err != nil || paid <= 0 || paid > owed {
+		return fmt.Sprintf("38N%sAO%s|AA%s|AFInvalid amount|", now, f["AO"], p.ID)
+	}
+	p.Fees = formatAmount(owed - paid)
+	return fmt.Sprintf("38Y%sAO%s|AA%s|BK%s|AFPayment accepted|", now, f["AO"], p.ID, f["BK"])
+}
+
+func (s *fakeSIPServer) block(now string, f map[string]string) string {
+	p, ok := s.patrons[f["AA"]]
+	if !ok {
+		return fmt.Sprintf("24YYYY          012%sAO%s|AA%s|BLN|AFUnknown patron|", now, f["AO"], f["AA"])
+	}
+	p.Blocked = true
+	return fmt.Sprintf("24%s012%sAO%s|AA%s|AE%s|BLY|AF%s|", p.status(), now, f["AO"], p.ID, p.Name, f["AL"])
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/knakk/specs"
+)
+
+// startFakeSIP starts a fake SIP server with the testdata catalogue, and
+// returns it with a pool of n connections to it.
+func startFakeSIP(t *testing.T, f sipFaults, n int) (*fakeSIPServer, *ConnPool) {
+	cat, err := loadSIPCatalogue("testdata/catalogue.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newFakeSIPServer(cat, f)
+	if err := srv.listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	go srv.serve()
+	return srv, NewSIPConnPool(&config{SIPServer: srv.Addr(), NumSIPConnections: n}, nil)
+}
+
+func TestFakeSIPServer(t *testing.T) {
+	s := specs.New(t)
+	srv, p := startFakeSIP(t, sipFaults{}, 2)
+	defer srv.close()
+	s.Expect(2, p.Size())
+	b := &SIPBackend{pool: p}
+
+	res, err := b.Authenticate("HUTL", "10", "pass")
+	s.ExpectNil(err)
+	s.Expect(true, res.Authenticated)
+	s.Expect("10", res.Patron)
+	res, _ = b.Authenticate("HUTL", "10", "wrong")
+	s.Expect(loginWrongPIN, res.Reason)
+	res, _ = b.Authenticate("HUTL", "nobody", "pass")
+	s.Expect(loginInvalidPatron, res.Reason)
+	res, _ = b.Authenticate("HUTL", "1002", "pass")
+	s.Expect(loginCardLost, res.Reason)
+	res, _ = b.Authenticate("HUTL", "1001", "pass")
+	s.Expect(true, res.Fees.OverLimit)
+	res, _ = b.PatronInfo("HUTL", "1004")
+	s.Expect([]string{blockCardExpired}, res.Blocks)
+
+	res, _ = b.Checkout("HUTL", "10", "03011174511003")
+	s.Expect(true, res.Item.OK)
+	s.Expect("Krutt-Kim", res.Item.Title)
+	res, _ = b.ItemInfo("HUTL", "03011174511003")
+	s.Expect(circCharged, res.Item.CircStatus)
+	res, _ = b.Renew("HUTL", "10", "03011174511003")
+	s.Expect(true, res.Item.OK)
+	res, _ = b.Checkout("HUTL", "1", "03011174511003")
+	s.Expect(false, res.Item.OK)
+	s.Expect("Item checked out to another patron", res.Item.Status)
+	res, _ = b.Checkout("HUTL", "1", "03011174511004")
+	s.Expect("Item on hold for another patron", res.Item.Status)
+	res, _ = b.Checkout("HUTL", "1003", "03010824010007")
+	s.Expect("Patron blocked", res.Item.Status)
+
+	res, _ = b.Checkin("HUTL", "03011174511003")
+	s.Expect(true, res.Item.OK)
+	s.Expect(routeShelve, res.Item.Routing.Action)
+	res, _ = b.Checkin("HUTL", "03011174511003")
+	s.Expect(false, res.Item.OK)
+	s.Expect("Item not checked out", res.Item.Status)
+	res, _ = b.Checkin("HUTL", "03010824010009")
+	s.Expect(routeTransit, res.Item.Routing.Action)
+	s.Expect("FMAJ", res.Item.Routing.Destination)
+
+	res, _ = b.BlockPatron("HUTL", "10", "too many failed logins")
+	s.Expect("10", res.Patron)
+	res, _ = b.Checkout("HUTL", "10", "03010824010007")
+	s.Expect("Patron blocked", res.Item.Status)
+}
+
+func TestFakeSIPFaults(t *testing.T) {
+	s := specs.New(t)
+
+	srv, p := startFakeSIP(t, sipFaults{RefuseLogin: true}, 2)
+	s.Expect(0, p.Size())
+	srv.close()
+
+	srv, p = startFakeSIP(t, sipFaults{DropAfter: 2}, 1)
+	b := &SIPBackend{pool: p}
+	_, err := b.ItemInfo("HUTL", "03011174511003")
+	s.ExpectNil(err)
+	_, err = b.ItemInfo("HUTL", "03011174511003")
+	s.Expect(true, err != nil)
+	srv.close()
+
+	srv, p = startFakeSIP(t, sipFaults{Delay: 50 * time.Millisecond}, 1)
+	defer srv.close()
+	b = &SIPBackend{pool: p}
+	start := time.Now()
+	_, err = b.ItemInfo("HUTL", "03011174511003")
+	s.ExpectNil(err)
+	s.Expect(true, time.Since(start) >= 50*time.Millisecond)
+}
@@ -2,53 +2,68 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"html/template"
 	"log"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
 // monitorHandler serves the monitor pages
-func monitorHandler(w http.ResponseWriter, r *http.Request) {
+func (app *App) monitorHandler(w http.ResponseWriter, r *http.Request) {
 	data := struct {
 		Host     string
 		Automats []automat
 	}{
 		r.Host,
-		cfg.Automats,
+		app.server.config().Automats,
 	}
-	err := templates.ExecuteTemplate(w, "monitor.html", data)
+	err := app.templates.ExecuteTemplate(w, "monitor.html", data)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
 // uiHandler serves the user interface of the automats
-func uiHandler(w http.ResponseWriter, r *http.Request) {
+func (app *App) uiHandler(w http.ResponseWriter, r *http.Request) {
 	v := r.URL.Query()
-	if _, ok := server.connections[v.Get("client")]; !ok {
+	a, ok := app.server.lookup(v.Get("client"))
+	if !ok {
 		http.Error(w, "ERROR: no automat connected with that address", http.StatusBadRequest)
 		return
 	}
+	if !uiAllowed(app.cfg.Auth, r, a) {
+		log.Println("WARN", "UI for", a.IP, "refused to", r.RemoteAddr)
+		http.Error(w, "ERROR: not allowed to use this automat", http.StatusForbidden)
+		return
+	}
 	data := struct {
 		Host      string
 		Client    string
+		Secret    string
+		Theme     string // stylesheet of the automat's branch, if any
 		JSXPragma template.JS
 	}{
 		r.Host,
 		v.Get("client"),
+		v.Get("secret"),
+		"",
 		template.JS("/** @jsx React.DOM */"),
 	}
-	err := templates.ExecuteTemplate(w, "ui.html", data)
+	if ac, ok := app.server.config().findAutomat(a.RFIDconn.RemoteAddr()); ok {
+		data.Theme = app.theme(ac.Department)
+	}
+	err := app.templates.ExecuteTemplate(w, "ui.html", data)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
-func statusHandler(w http.ResponseWriter, r *http.Request) {
-	b, err := json.Marshal(stats.Export())
+func (app *App) statusHandler(w http.ResponseWriter, r *http.Request) {
+	b, err := json.Marshal(app.stats.Export())
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
@@ -57,54 +72,263 @@ func statusHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // wsHandler establishes connections with monitor pages and the automat-UIs
-func wsHandler(w http.ResponseWriter, r *http.Request) {
-	ws, err := websocket.Upgrade(w, r, nil, 1024, 1024)
-	if _, ok := err.(websocket.HandshakeError); ok {
-		http.Error(w, "Not a websocket handshake", 400)
-		return
-	} else if err != nil {
-		return
+func (app *App) wsHandler(w http.ResponseWriter, r *http.Request) {
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		CheckOrigin:     checkOrigin(app.cfg.Auth),
 	}
 
 	v := r.URL.Query()
 	if v.Get("client") == "monitor" {
 		// Monitor connection
+		if app.cfg.Auth.roleOf(r) < roleMonitor {
+			http.Error(w, "ERROR: not authorized", http.StatusUnauthorized)
+			return
+		}
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
 		c := &monitorConn{send: make(chan *exportMetrics), ws: ws}
-		hub.mReg <- c
+		app.hub.mReg <- c
 		defer func() {
-			hub.mUnReg <- c
+			app.hub.mUnReg <- c
 		}()
 		go c.writer()
 		c.reader()
 	} else {
 		// UI connection
 		select {
-		case a := <-server.get(v.Get("client")):
-			a.ws = ws
+		case a := <-app.server.get(v.Get("client")):
+			if !uiAllowed(app.cfg.Auth, r, a) {
+				log.Println("WARN", "UI for", a.IP, "refused to", r.RemoteAddr)
+				http.Error(w, "ERROR: not allowed to use this automat", http.StatusForbidden)
+				return
+			}
+			ws, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			c := &uiConn{ws: ws, done: make(chan bool)}
+			if !a.attachUI(c) {
+				ws.Close()
+				return
+			}
 			log.Println("UI", a.IP, "connected")
 
 			defer func() {
 				log.Println("UI", a.IP, "disconnected")
-				//close(a.ToUI)
-				go a.ws.Close()
+				a.detachUI(c)
+				go ws.Close()
 			}()
 
-			go a.wsWriter()
-			a.ToUI <- []byte("{\"msg\":\"hei & velkommen\"}")
-			a.wsReader()
-			// TODO rethink
-			// Instead og go.wswriter & a.wsreader
-			// wait for ?
-			// <- a.quit (quit: make(chan bool, 1))
+			a.wsReader(c)
 		case <-time.After(time.Second * 3):
+			http.Error(w, "ERROR: no automat connected with that address", http.StatusBadRequest)
+			return
+		}
+	}
+}
+
+// usageHandler serves usage reports. The period is given by "period" (day,
+// week or month) and "date", or by "from" and "to" (dates, inclusive); the
+// default is today, and the longest maxUsageDays. "group" is automat
+// (default), branch, hour or day; "format" json (default) or csv.
+func (app *App) usageHandler(w http.ResponseWriter, r *http.Request) {
+	v := r.URL.Query()
+	q := usageQuery{Group: v.Get("group"), Automat: v.Get("automat"), Branch: v.Get("branch")}
+	if q.Group == "" {
+		q.Group = "automat"
+	}
+	date := func(name string, def time.Time) (time.Time, error) {
+		if v.Get(name) == "" {
+			return def, nil
+		}
+		return time.ParseInLocation(isoDate, v.Get(name), time.Local)
+	}
+	var err error
+	if v.Get("from") != "" || v.Get("to") != "" {
+		var from, to time.Time
+		from, err = date("from", time.Now())
+		if err == nil {
+			to, err = date("to", from)
+		}
+		q.From, _, _ = usagePeriod("day", from)
+		_, q.To, _ = usagePeriod("day", to)
+	} else {
+		var d time.Time
+		if d, err = date("date", time.Now()); err == nil {
+			period := v.Get("period")
+			if period == "" {
+				period = "day"
+			}
+			q.From, q.To, err = usagePeriod(period, d)
+		}
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !q.To.After(q.From) {
+		http.Error(w, "ERROR: to is before from", http.StatusBadRequest)
+		return
+	}
+	if q.To.After(q.From.AddDate(0, 0, maxUsageDays)) {
+		http.Error(w, fmt.Sprintf("ERROR: more than %d days", maxUsageDays), http.StatusBadRequest)
+		return
+	}
+	rep, err := app.usage.report(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch v.Get("format") {
+	case "", "json":
+		b, err := json.Marshal(rep)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=usage-%s-%s.csv",
+			q.From.Format(isoDate), q.To.AddDate(0, 0, -1).Format(isoDate)))
+		rep.WriteCSV(w)
+	default:
+		http.Error(w, "ERROR: unknown format: "+v.Get("format"), http.StatusBadRequest)
+	}
+}
+
+// alertsHandler serves the firing alerts and the silences.
+func (app *App) alertsHandler(w http.ResponseWriter, r *http.Request) {
+	b, err := json.Marshal(app.alerts.status())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// silenceHandler silences an alert rule: POST rule, subject (all if not
+// given) and for, i.e. "2h"; "0" lifts the silence.
+func (app *App) silenceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "ERROR: POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	rule := r.FormValue("rule")
+	if rule == "" {
+		http.Error(w, "ERROR: no rule", http.StatusBadRequest)
+		return
+	}
+	d, err := time.ParseDuration(r.FormValue("for"))
+	if err != nil {
+		http.Error(w, "ERROR: for must be a duration like \"2h\"", http.StatusBadRequest)
+		return
+	}
+	app.alerts.silence(rule, r.FormValue("subject"), d)
+	log.Println("INFO", "alert", rule, r.FormValue("subject"), "silenced for", d)
+	app.alertsHandler(w, r)
+}
+
+// maintenanceHandler lists the automats out of order. POST automat (name or
+// IP), on (true or false) and message takes an automat out of order, or
+// back in service, until restart.
+func (app *App) maintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		on, err := strconv.ParseBool(r.FormValue("on"))
+		if err != nil {
+			http.Error(w, "ERROR: on must be true or false", http.StatusBadRequest)
+			return
+		}
+		err = app.setMaintenance(r.FormValue("automat"), maintenanceOverride{On: on, Message: r.FormValue("message")})
+		if err != nil {
+			http.Error(w, "ERROR: "+err.Error(), http.StatusBadRequest)
 			return
 		}
+		log.Println("INFO", "automat", r.FormValue("automat"), "maintenance set to", on)
 	}
+
+	type outOfOrder struct {
+		IP, Name, Message string
+	}
+	list := []outOfOrder{}
+	for _, a := range app.server.config().Automats {
+		if a.Maintenance {
+			list = append(list, outOfOrder{a.IP, a.Name, a.MaintenanceMessage})
+		}
+	}
+	b, err := json.Marshal(list)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
 }
 
-// serveFile serves a single file from disk
-func serveFile(filename string) func(w http.ResponseWriter, r *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, filename)
+// announcementsHandler lists the announcements which haven't ended. POST
+// text, branch or automat (all if neither is given), from and to
+// ("2014-01-24T15:00"; from defaults to now), or for instead of to ("15m"),
+// and priority, to add one; DELETE id to remove one.
+func (app *App) announcementsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		a := announcement{Text: r.FormValue("text"), Branch: r.FormValue("branch"), Automat: r.FormValue("automat")}
+		var err error
+		if v := r.FormValue("priority"); v != "" {
+			if a.Priority, err = strconv.Atoi(v); err != nil {
+				http.Error(w, "ERROR: priority must be a number", http.StatusBadRequest)
+				return
+			}
+		}
+		parse := func(name string) time.Time {
+			if err != nil || r.FormValue(name) == "" {
+				return time.Time{}
+			}
+			var t time.Time
+			t, err = time.ParseInLocation("2006-01-02T15:04", r.FormValue(name), time.Local)
+			return t
+		}
+		a.From, a.To = parse("from"), parse("to")
+		if v := r.FormValue("for"); v != "" && err == nil {
+			var d time.Duration
+			if d, err = time.ParseDuration(v); err == nil {
+				if a.From.IsZero() {
+					a.From = time.Now()
+				}
+				a.To = a.From.Add(d)
+			}
+		}
+		if err == nil {
+			a, err = app.news.add(a)
+		}
+		if err != nil {
+			http.Error(w, "ERROR: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Println("INFO", "announcement", a.ID, "added:", a.Text)
+		app.server.announce()
+	case "DELETE":
+		id, err := strconv.Atoi(r.FormValue("id"))
+		if err != nil || !app.news.remove(id) {
+			http.Error(w, "ERROR: no announcement with that id", http.StatusNotFound)
+			return
+		}
+		log.Println("INFO", "announcement", id, "removed")
+		app.server.announce()
+	}
+
+	b, err := json.Marshal(app.news.all())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
 }
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Patron-facing messages. Backends return codes and dates; the text is made
+// by the automat in the language of the session, just before it is sent.
+
+// Languages
+const (
+	langBokmal  = "nb"
+	langNynorsk = "nn"
+	langEnglish = "en"
+
+	defaultLanguage = langBokmal
+)
+
+// What happened to an item (item.Event); the UI shows it with item.Date.
+const (
+	eventCheckedIn      = "CHECKED_IN"
+	eventCheckedOut     = "CHECKED_OUT"
+	eventRenewed        = "RENEWED"
+	eventCheckoutFailed = "CHECKOUT_FAILED" // without a reason from the library system
+)
+
+// Other message keys. Login reasons, blocks, routes, and item reasons and
+// warnings are keys too, so the UI can show them from the same catalogue.
+const (
+	msgError      = "ERROR"
+	msgOutOfOrder = "OUT_OF_ORDER"
+	msgClosed     = "CLOSED"
+	msgReturnOnly = "RETURN_ONLY"
+
+	msgReceipt            = "RECEIPT"
+	msgReceiptAutomat     = "RECEIPT_AUTOMAT"
+	msgReceiptPatron      = "RECEIPT_PATRON"
+	msgReceiptPaid        = "RECEIPT_PAID"
+	msgReceiptReference   = "RECEIPT_REFERENCE"
+	msgReceiptTransaction = "RECEIPT_TRANSACTION"
+)
+
+// messages is the catalogue: language, key, text. Every language must have
+// every key of defaultLanguage.
+var messages = map[string]map[string]string{
+	langBokmal: {
+		eventCheckedIn:      "registrert innlevert %s",
+		eventCheckedOut:     "utlånt til %s",
+		eventRenewed:        "fornyet til %s",
+		eventCheckoutFailed: "Utlånet feilet. Ta kontakt med betjeningen.",
+		msgError:            "Noe gikk galt, det er ikke din feil!",
+		msgOutOfOrder:       "Automaten er ute av drift.",
+		msgClosed:           "Automaten er stengt.",
+		msgReturnOnly:       "Nå kan du bare levere inn.",
+
+		msgReceipt:            "KVITTERING",
+		msgReceiptAutomat:     "Automat",
+		msgReceiptPatron:      "Lånenr",
+		msgReceiptPaid:        "Betalt",
+		msgReceiptReference:   "Referanse",
+		msgReceiptTransaction: "Trans.id",
+
+		loginWrongPIN:      "Feil PIN-kode",
+		loginInvalidPatron: "Ukjent lånenummer",
+		loginCardLost:      "Kortet er meldt tapt. Ta kontakt med betjeningen.",
+		loginLocked:        "For mange feilede forsøk. Prøv igjen senere, eller ta kontakt med betjeningen.",
+
+		blockChargeDenied:   "Du kan ikke låne nå. Ta kontakt med betjeningen.",
+		blockCardExpired:    "Lånekortet er utløpt. Ta kontakt med betjeningen for å fornye det.",
+		blockTooManyItems:   "Du har lånt maks antall.",
+		blockTooManyOverdue: "Du har for mange lån på overtid. Lever dem inn for å låne mer.",
+		blockExcessiveFines: "Du har for høye gebyrer.",
+		blockExcessiveFees:  "Du har for høye gebyrer.",
+		blockFeeLimit:       "Du har gebyrer over grensen. Betal for å låne mer.",
+
+		routeHoldShelf: "Legg på hentehylla",
+		routeTransit:   "Legg i transportkassa",
+		routeStaff:     "Lever til betjeningen",
+
+		reasonUnknownItem:     "Ukjent materiale. Ta kontakt med betjeningen.",
+		reasonReferenceOnly:   "Kan ikke lånes, bare brukes på biblioteket.",
+		reasonOnHoldForOther:  "Reservert for en annen låner.",
+		reasonNotAvailable:    "Kan ikke lånes ennå.",
+		reasonInTransit:       "Skal til et annet bibliotek. Lever til betjeningen.",
+		reasonLost:            "Registrert som tapt. Ta kontakt med betjeningen.",
+		reasonMissing:         "Registrert som savnet. Ta kontakt med betjeningen.",
+		reasonClaimedReturned: "Registrert som levert. Ta kontakt med betjeningen.",
+
+		warnHoldQueue:  "Andre venter på denne, så lånet kan ikke fornyes.",
+		warnOnHold:     "Lå på hentehylla.",
+		warnCheckedOut: "Var registrert som utlånt.",
+
+		"UI_CHECKOUT":       "UTLÅN",
+		"UI_CHECKIN":        "INNLEVERING",
+		"UI_STATUS":         "STATUS",
+		"UI_STATUS_COMMENT": "lån og reserveringer",
+		"UI_LOGGED_IN":      "Logget inn med lånenummer",
+		"UI_FEES":           "Gebyr",
+		"UI_PAY":            "Betal",
+		"UI_LOGOUT":         "Avslutt",
+		"UI_CARD_NUMBER":    "Lånenummer",
+		"UI_PIN":            "PIN-kode",
+		"UI_LOGIN":          "Logg inn",
+		"UI_CANCEL":         "Avbryt",
+		"UI_ITEM":           "materiale",
+		"UI_SORTER_JAM":     "Sorteringsanlegget har stoppet. Vent litt, eller ta kontakt med betjeningen.",
+	},
+	langNynorsk: {
+		eventCheckedIn:      "registrert innlevert %s",
+		eventCheckedOut:     "utlånt til %s",
+		eventRenewed:        "fornya til %s",
+		eventCheckoutFailed: "Utlånet feila. Ta kontakt med betjeninga.",
+		msgError:            "Noko gjekk gale, det er ikkje din feil!",
+		msgOutOfOrder:       "Automaten er ute av drift.",
+		msgClosed:           "Automaten er stengd.",
+		msgReturnOnly:       "No kan du berre levere inn.",
+
+		msgReceipt:            "KVITTERING",
+		msgReceiptAutomat:     "Automat",
+		msgReceiptPatron:      "Lånenr",
+		msgReceiptPaid:        "Betalt",
+		msgReceiptReference:   "Referanse",
+		msgReceiptTransaction: "Trans.id",
+
+		loginWrongPIN:      "Feil PIN-kode",
+		loginInvalidPatron: "Ukjent lånenummer",
+		loginCardLost:      "Kortet er meldt tapt. Ta kontakt med betjeninga.",
+		loginLocked:        "For mange mislukka forsøk. Prøv igjen seinare, eller ta kontakt med betjeninga.",
+
+		blockChargeDenied:   "Du kan ikkje låne no. Ta kontakt med betjeninga.",
+		blockCardExpired:    "Lånekortet har gått ut. Ta kontakt med betjeninga for å fornye det.",
+		blockTooManyItems:   "Du har lånt maks tal.",
+		blockTooManyOverdue: "Du har for mange lån på overtid. Lever dei inn for å låne meir.",
+		blockExcessiveFines: "Du har for høge gebyr.",
+		blockExcessiveFees:  "Du har for høge gebyr.",
+		blockFeeLimit:       "Du har gebyr over grensa. Betal for å låne meir.",
+
+		routeHoldShelf: "Legg på hentehylla",
+		routeTransit:   "Legg i transportkassa",
+		routeStaff:     "Lever til betjeninga",
+
+		reasonUnknownItem:     "Ukjent materiale. Ta kontakt med betjeninga.",
+		reasonReferenceOnly:   "Kan ikkje lånast, berre brukast på biblioteket.",
+		reasonOnHoldForOther:  "Reservert for ein annan lånar.",
+		reasonNotAvailable:    "Kan ikkje lånast enno.",
+		reasonInTransit:       "Skal til eit anna bibliotek. Lever til betjeninga.",
+		reasonLost:            "Registrert som tapt. Ta kontakt med betjeninga.",
+		reasonMissing:         "Registrert som sakna. Ta kontakt med betjeninga.",
+		reasonClaimedReturned: "Registrert som levert. Ta kontakt med betjeninga.",
+
+		warnHoldQueue:  "Andre ventar på denne, så lånet kan ikkje fornyast.",
+		warnOnHold:     "Låg på hentehylla.",
+		warnCheckedOut: "Var registrert som utlånt.",
+
+		"UI_CHECKOUT":       "UTLÅN",
+		"UI_CHECKIN":        "INNLEVERING",
+		"UI_STATUS":         "STATUS",
+		"UI_STATUS_COMMENT": "lån og reserveringar",
+		"UI_LOGGED_IN":      "Logga inn med lånenummer",
+		"UI_FEES":           "Gebyr",
+		"UI_PAY":            "Betal",
+		"UI_LOGOUT":         "Avslutt",
+		"UI_CARD_NUMBER":    "Lånenummer",
+		"UI_PIN":            "PIN-kode",
+		"UI_LOGIN":          "Logg inn",
+		"UI_CANCEL":         "Avbryt",
+		"UI_ITEM":           "materiale",
+		"UI_SORTER_JAM":     "Sorteringsanlegget har stoppa. Vent litt, eller ta kontakt med betjeninga.",
+	},
+	langEnglish: {
+		eventCheckedIn:      "returned %s",
+		eventCheckedOut:     "due %s",
+		eventRenewed:        "renewed, due %s",
+		eventCheckoutFailed: "Checkout failed. Please ask the staff.",
+		msgError:            "Something went wrong, it is not your fault!",
+		msgOutOfOrder:       "This machine is out of order.",
+		msgClosed:           "This machine is closed.",
+		msgReturnOnly:       "Returns only at this time.",
+
+		msgReceipt:            "RECEIPT",
+		msgReceiptAutomat:     "Automat",
+		msgReceiptPatron:      "Card no",
+		msgReceiptPaid:        "Paid",
+		msgReceiptReference:   "Reference",
+		msgReceiptTransaction: "Trans.id",
+
+		loginWrongPIN:      "Wrong PIN",
+		loginInvalidPatron: "Unknown card number",
+		loginCardLost:      "The card is reported lost. Please ask the staff.",
+		loginLocked:        "Too many failed attempts. Try again later, or ask the staff.",
+
+		blockChargeDenied:   "You cannot borrow now. Please ask the staff.",
+		blockCardExpired:    "Your library card has expired. Ask the staff to renew it.",
+		blockTooManyItems:   "You have borrowed the maximum number of items.",
+		blockTooManyOverdue: "You have too many overdue loans. Return them to borrow more.",
+		blockExcessiveFines: "Your fines are too high.",
+		blockExcessiveFees:  "Your fees are too high.",
+		blockFeeLimit:       "Your fees are over the limit. Pay to borrow more.",
+
+		routeHoldShelf: "Put on the hold shelf",
+		routeTransit:   "Put in the transport box",
+		routeStaff:     "Hand in to the staff",
+
+		reasonUnknownItem:     "Unknown item. Please ask the staff.",
+		reasonReferenceOnly:   "Reference only: it can't be borrowed.",
+		reasonOnHoldForOther:  "On hold for another patron.",
+		reasonNotAvailable:    "Not yet available for loan.",
+		reasonInTransit:       "On its way to another library. Please hand it to the staff.",
+		reasonLost:            "Registered as lost. Please ask the staff.",
+		reasonMissing:         "Registered as missing. Please ask the staff.",
+		reasonClaimedReturned: "Registered as returned. Please ask the staff.",
+
+		warnHoldQueue:  "Others are waiting for it, so the loan can't be renewed.",
+		warnOnHold:     "It was on the hold shelf.",
+		warnCheckedOut: "It was registered as on loan.",
+
+		"UI_CHECKOUT":       "BORROW",
+		"UI_CHECKIN":        "RETURN",
+		"UI_STATUS":         "STATUS",
+		"UI_STATUS_COMMENT": "loans and holds",
+		"UI_LOGGED_IN":      "Logged in with card number",
+		"UI_FEES":           "Fees",
+		"UI_PAY":            "Pay",
+		"UI_LOGOUT":         "Log out",
+		"UI_CARD_NUMBER":    "Card number",
+		"UI_PIN":            "PIN",
+		"UI_LOGIN":          "Log in",
+		"UI_CANCEL":         "Cancel",
+		"UI_ITEM":           "item",
+		"UI_SORTER_JAM":     "The sorting machine has stopped. Please wait, or contact the staff.",
+	},
+}
+
+// dateLayouts are how dates are written in each language.
+var dateLayouts = map[string]string{
+	langBokmal:  "02/01/2006",
+	langNynorsk: "02/01/2006",
+	langEnglish: "2 Jan 2006",
+}
+
+// isoDate is the layout of item.Date.
+const isoDate = "2006-01-02"
+
+func knownLanguage(lang string) bool {
+	_, ok := messages[lang]
+	return ok
+}
+
+// translate returns the text of key in lang, formatted with args. Unknown
+// languages and keys fall back to defaultLanguage, and then to the key.
+func translate(lang, key string, args ...interface{}) string {
+	text, ok := messages[lang][key]
+	if !ok {
+		if text, ok = messages[defaultLanguage][key]; !ok {
+			text = key
+		}
+	}
+	if len(args) > 0 {
+		return fmt.Sprintf(text, args...)
+	}
+	return text
+}
+
+// formatDate writes an isoDate in the way of lang.
+func formatDate(lang, date string) string {
+	t, err := time.Parse(isoDate, date)
+	if err != nil {
+		return date
+	}
+	layout, ok := dateLayouts[lang]
+	if !ok {
+		layout = dateLayouts[defaultLanguage]
+	}
+	return t.Format(layout)
+}
+
+// localizeItem sets the status text of an item from its Event. Items
+// without an Event keep the text from the library system.
+func localizeItem(lang string, it item) item {
+	switch it.Event {
+	case "":
+	case eventCheckoutFailed:
+		it.Status = translate(lang, it.Event)
+	default:
+		it.Status = translate(lang, it.Event, formatDate(lang, it.Date))
+	}
+	return it
+}
+
+func localizeItems(lang string, items []item) []item {
+	if items == nil {
+		return nil
+	}
+	l := make([]item, len(items))
+	for i, it := range items {
+		l[i] = localizeItem(lang, it)
+	}
+	return l
+}
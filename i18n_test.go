@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/knakk/specs"
+)
+
+func TestCatalogue(t *testing.T) {
+	for lang, texts := range messages {
+		for key := range messages[defaultLanguage] {
+			if _, ok := texts[key]; !ok {
+				t.Errorf("%s: no text for %s", lang, key)
+			}
+		}
+		if _, ok := dateLayouts[lang]; !ok {
+			t.Errorf("%s: no date layout", lang)
+		}
+	}
+
+	// codes the UI shows
+	codes := []string{reasonUnknownItem, reasonReferenceOnly, reasonOnHoldForOther, reasonNotAvailable,
+		reasonInTransit, reasonLost, reasonMissing, reasonClaimedReturned,
+		warnHoldQueue, warnOnHold, warnCheckedOut, loginCardExpired, "UI_SORTER_JAM"}
+	for _, key := range codes {
+		if _, ok := messages[defaultLanguage][key]; !ok {
+			t.Errorf("%s: no text for %s", defaultLanguage, key)
+		}
+	}
+}
+
+func TestLocalizeItem(t *testing.T) {
+	s := specs.New(t)
+	it := item{OK: true, Event: eventCheckedIn, Date: "2014-01-24"}
+	s.Expect("registrert innlevert 24/01/2014", localizeItem(langBokmal, it).Status)
+	s.Expect("returned 24 Jan 2014", localizeItem(langEnglish, it).Status)
+	s.Expect("registrert innlevert 24/01/2014", localizeItem("se", it).Status)
+
+	it = item{OK: true, Event: eventRenewed, Date: "2014-03-21"}
+	s.Expect("fornya til 21/03/2014", localizeItem(langNynorsk, it).Status)
+
+	// text from the library system is kept
+	it = item{Status: "Invalid Item"}
+	s.Expect("Invalid Item", localizeItem(langEnglish, it).Status)
+}
+
+func TestReceiptText(t *testing.T) {
+	s := specs.New(t)
+	r := &receipt{Time: time.Date(2014, 1, 24, 10, 0, 0, 0, time.UTC), Automat: "Røa1",
+		Patron: "10", Amount: "150.00", Currency: "NOK", Reference: "ref1"}
+	s.Expect(true, strings.Contains(r.text(langEnglish), "Paid:      150.00 NOK"))
+	s.Expect(true, strings.Contains(r.text(langEnglish), "24 Jan 2014 10:00:00"))
+	s.Expect(true, strings.HasPrefix(r.String(), "KVITTERING\n24/01/2014"))
+}
+
+func TestSetLanguage(t *testing.T) {
+	s := specs.New(t)
+	a := newTestAutomat()
+	a.configure(automat{IP: "10.0.0.1", Name: "Røa1", Department: "HUTL", Language: langNynorsk})
+	s.Expect(langNynorsk, a.lang)
+	a.backend = &fakeBackend{}
+	a.Authenticated, a.Patron, a.State = true, "patron1", uiCHECKOUT
+	a.Checkouts = []item{{Title: "Krutt-Kim", OK: true, Event: eventCheckedOut, Date: "2014-02-21"}}
+
+	a.handleUI([]byte(`{"Action": "SET_LANGUAGE", "Language": "en"}`))
+	s.Expect(langEnglish, a.lang)
+	m, _ := a.ToUI.Get(nil)
+	var l UILanguage
+	s.ExpectNil(json.Unmarshal(m, &l))
+	s.Expect("LANGUAGE", l.Action)
+	s.Expect("Log out", l.Texts["UI_LOGOUT"])
+	m, _ = a.ToUI.Get(nil)
+	var snap UISnapshot
+	s.ExpectNil(json.Unmarshal(m, &snap))
+	s.Expect("due 21 Feb 2014", snap.Checkouts[0].Status)
+
+	// results are sent in the language of the session
+	a.handleRFID([]byte(`{"Barcode": "03011174511003"}`))
+	runJob(a)
+	var res UIResponse
+	m, _ = a.ToUI.Get(nil)
+	s.ExpectNil(json.Unmarshal(m, &res))
+	s.Expect("due 21 Feb 2014", res.Item.Status)
+
+	a.handleUI([]byte(`{"Action": "SET_LANGUAGE", "Language": "se"}`))
+	m, _ = a.ToUI.Get(nil)
+	s.ExpectNil(json.Unmarshal(m, &res))
+	s.Expect("ERROR", res.Action)
+	s.Expect(translate(langEnglish, msgError), res.Message)
+
+	// a new session gets the language of the automat
+	a.handleUI([]byte(`{"Action": "LOGOUT"}`))
+	s.Expect(langNynorsk, a.lang)
+}
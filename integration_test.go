@@ -4,6 +4,7 @@ package main
 
 import (
 	"bufio"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -36,8 +37,14 @@ const (
 
 	// Maximum patron item checkouts per session
 	MAXCHEKCOUTS = 20
+
+	// Patrons and items of the fake SIP server
+	CATALOGUEFILE = "testdata/catalogue.json"
 )
 
+// Without -koha, the test runs against the fake SIP server
+var koha = flag.Bool("koha", false, "test against the SIP server in config.json")
+
 type RFIDState uint
 
 const (
@@ -61,6 +68,7 @@ type patron struct {
 var (
 	patrons []*patron
 	items   []string
+	app     *App
 )
 
 func newRFIDService() *RFIDService {
@@ -166,11 +174,14 @@ func simulatePatronAutomatInteraction() {
 	}
 
 	go s.handleMessages()
-	a := <-server.get(s.conn.LocalAddr().String())
+	a := <-app.server.get(s.conn.LocalAddr().String())
 	go func() {
-		for _ = range a.ToUI {
+		for {
 			// discarding
-			// log.Printf(string(msg))
+			_, ok := a.ToUI.Get(nil)
+			if !ok {
+				return
+			}
 			//println("simulating send to UI")
 		}
 	}()
@@ -198,7 +209,46 @@ func simulatePatronAutomatInteraction() {
 
 // SETUP
 
-func init() {
+// setup builds the app, with a fake SIP server unless -koha is given, and
+// loads the patrons and items to use.
+func setup(t *testing.T) {
+	cfg, errs := loadConfig("config.json", os.LookupEnv)
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	cfg.TCPPort = "6666"
+	cfg.UsageDir = "" // usage statistics in memory only
+
+	if !*koha {
+		cat, err := loadSIPCatalogue(CATALOGUEFILE)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range cat.Patrons {
+			patrons = append(patrons, &patron{ID: p.ID})
+		}
+		for _, it := range cat.Items {
+			items = append(items, it.Barcode)
+		}
+		srv := newFakeSIPServer(cat, sipFaults{})
+		if err := srv.listen("127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+		go srv.serve()
+		cfg.SIPServer = srv.Addr()
+	} else {
+		loadTestdata()
+	}
+
+	var err error
+	app, err = NewApp(AppOptions{Config: cfg})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// loadTestdata loads patrons and items known to the real SIP server.
+func loadTestdata() {
 	// load & init patrons
 	f1, err := os.Open(PATRONSFILE)
 	if err != nil {
@@ -228,13 +278,14 @@ func init() {
 
 func TestAutomatPatronInteraction(t *testing.T) {
 	s := specs.New(t)
-	server = newTCPServer(&config{TCPPort: "6666"})
 	rand.Seed(time.Now().UnixNano())
-	if sipPool.size == 0 {
+	setup(t)
+	if app.sipPool.size == 0 {
 		log.Fatal("No SIP connections")
 	}
-	go server.run()
-	s.Expect(0, len(server.connections))
+	s.ExpectNil(app.Start())
+	defer app.Close()
+	s.Expect(0, len(app.server.connections))
 
 	for i := 0; i < NUMCLIENTS; i++ {
 		go simulatePatronAutomatInteraction()
@@ -242,12 +293,12 @@ func TestAutomatPatronInteraction(t *testing.T) {
 	}
 
 	time.Sleep(DURATION)
-	s.Expect(NUMCLIENTS, len(server.connections))
+	s.Expect(NUMCLIENTS, len(app.server.connections))
 
 	// TODO iterate over patrons and checkin all checked out books
 	for i := range patrons {
 		for _, j := range patrons[i].Checkouts {
-			_, _ = DoSIPCall(sipPool, sipFormMsgCheckin("HUTL", j), checkinParse)
+			_, _ = DoSIPCall(app.sipPool, sipFormMsgCheckin("HUTL", j), checkinParse)
 			println(i, j)
 		}
 	}
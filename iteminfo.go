@@ -0,0 +1,93 @@
+package main
+
+import "strings"
+
+// SIP circulation status codes (Item Information Response, 18)
+const (
+	circOther           = "01"
+	circOnOrder         = "02"
+	circAvailable       = "03"
+	circCharged         = "04"
+	circChargedNoRecall = "05"
+	circInProcess       = "06"
+	circRecalled        = "07"
+	circOnHoldShelf     = "08"
+	circReshelving      = "09"
+	circInTransit       = "10"
+	circClaimedReturned = "11"
+	circLost            = "12"
+	circMissing         = "13"
+)
+
+// assessCheckout decides from an item information lookup whether an item can
+// be loaned to patron. If not, ok is false and reason says why. Warnings are
+// conditions the patron should know about, but which don't stop the loan.
+func assessCheckout(it item, patron string, referenceOnly []string) (ok bool, reason string, warnings []string) {
+	if it.Title == "" && it.Location == "" && it.CircStatus == circOther {
+		return false, reasonUnknownItem, nil
+	}
+	for _, loc := range referenceOnly {
+		if strings.EqualFold(loc, it.Location) {
+			return false, reasonReferenceOnly, nil
+		}
+	}
+
+	switch it.CircStatus {
+	case circOnOrder, circInProcess:
+		return false, reasonNotAvailable, nil
+	case circInTransit:
+		return false, reasonInTransit, nil
+	case circLost:
+		return false, reasonLost, nil
+	case circMissing:
+		return false, reasonMissing, nil
+	case circClaimedReturned:
+		return false, reasonClaimedReturned, nil
+	case circOnHoldShelf:
+		switch it.HoldPatron {
+		case "":
+			// we don't know for whom; let the library system decide
+			warnings = append(warnings, warnOnHold)
+		case patron:
+		default:
+			return false, reasonOnHoldForOther, nil
+		}
+	case circCharged, circChargedNoRecall, circRecalled:
+		warnings = append(warnings, warnCheckedOut)
+	}
+
+	if it.HoldQueue > 0 && it.HoldPatron != patron {
+		warnings = append(warnings, warnHoldQueue)
+	}
+	return true, "", warnings
+}
+
+// checkoutChecked looks up an item before checking it out, and refuses the
+// checkout without contacting the library system again if the item can not
+// be loaned.
+func checkoutChecked(b Backend, dept, patron, barcode string, referenceOnly []string) (*UIResponse, error) {
+	info, err := b.ItemInfo(dept, barcode)
+	if err != nil {
+		return nil, err
+	}
+	ok, reason, warnings := assessCheckout(info.Item, patron, referenceOnly)
+	if !ok {
+		info.Item.OK = false
+		info.Item.Reason = reason
+		return info, nil
+	}
+
+	res, err := b.Checkout(dept, patron, barcode)
+	if err != nil {
+		return nil, err
+	}
+	if res.Item.Title == "" {
+		res.Item.Title = info.Item.Title
+	}
+	res.Item.MediaType = info.Item.MediaType
+	res.Item.HoldQueue = info.Item.HoldQueue
+	if res.Item.OK {
+		res.Item.Warnings = warnings
+	}
+	return res, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/knakk/specs"
+)
+
+// fakeBackend returns canned responses, and counts checkouts.
+type fakeBackend struct {
+	Backend
+	info      item
+	checkouts int
+	logins    []string // usernames, with PIN if given: "user:pin"
+}
+
+func (b *fakeBackend) Authenticate(dept, username, pin string) (*UIResponse, error) {
+	b.logins = append(b.logins, username+":"+pin)
+	return &UIResponse{Authenticated: true, Patron: username}, nil
+}
+
+func (b *fakeBackend) PatronInfo(dept, username string) (*UIResponse, error) {
+	b.logins = append(b.logins, username)
+	return &UIResponse{Authenticated: true, Patron: username}, nil
+}
+
+func (b *fakeBackend) ItemInfo(dept, barcode string) (*UIResponse, error) {
+	return &UIResponse{Item: b.info}, nil
+}
+
+func (b *fakeBackend) Checkout(dept, username, barcode string) (*UIResponse, error) {
+	b.checkouts++
+	return &UIResponse{Item: item{OK: true, Event: eventCheckedOut, Date: "2014-02-21"}}, nil
+}
+
+func TestAssessCheckout(t *testing.T) {
+	s := specs.New(t)
+	refOnly := []string{"REF"}
+
+	tests := []struct {
+		it       item
+		ok       bool
+		reason   string
+		warnings int
+	}{
+		{item{Title: "t", CircStatus: circAvailable}, true, "", 0},
+		{item{CircStatus: circOther}, false, reasonUnknownItem, 0},
+		{item{Title: "t", Location: "ref", CircStatus: circAvailable}, false, reasonReferenceOnly, 0},
+		{item{Title: "t", CircStatus: circLost}, false, reasonLost, 0},
+		{item{Title: "t", CircStatus: circInTransit}, false, reasonInTransit, 0},
+		{item{Title: "t", CircStatus: circOnHoldShelf, HoldPatron: "other"}, false, reasonOnHoldForOther, 0},
+		{item{Title: "t", CircStatus: circOnHoldShelf, HoldPatron: "me", HoldQueue: 1}, true, "", 0},
+		{item{Title: "t", CircStatus: circOnHoldShelf}, true, "", 1},
+		{item{Title: "t", CircStatus: circAvailable, HoldQueue: 3}, true, "", 1},
+		{item{Title: "t", CircStatus: circCharged, HoldQueue: 1}, true, "", 2},
+	}
+	for _, tt := range tests {
+		ok, reason, warnings := assessCheckout(tt.it, "me", refOnly)
+		s.Expect(tt.ok, ok)
+		s.Expect(tt.reason, reason)
+		s.Expect(tt.warnings, len(warnings))
+	}
+}
+
+func TestCheckoutChecked(t *testing.T) {
+	s := specs.New(t)
+
+	b := &fakeBackend{info: item{Title: "Krutt-Kim", CircStatus: circMissing}}
+	res, err := checkoutChecked(b, "HUTL", "me", "1234", nil)
+	s.ExpectNil(err)
+	s.Expect(false, res.Item.OK)
+	s.Expect(reasonMissing, res.Item.Reason)
+	s.Expect(0, b.checkouts)
+
+	b = &fakeBackend{info: item{Title: "Krutt-Kim", CircStatus: circAvailable, HoldQueue: 2}}
+	res, err = checkoutChecked(b, "HUTL", "me", "1234", nil)
+	s.ExpectNil(err)
+	s.Expect(true, res.Item.OK)
+	s.Expect("Krutt-Kim", res.Item.Title)
+	s.Expect([]string{warnHoldQueue}, res.Item.Warnings)
+	s.Expect(1, b.checkouts)
+}
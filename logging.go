@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+)
+
+// Log levels. The level is the first word of a log message, as in
+// log.Println("WARN", ...). Messages without a level are always written.
+var logLevels = map[string]int32{
+	"DEBUG": 0,
+	"INFO":  1,
+	"WARN":  2,
+	"ERROR": 3,
+}
+
+// levelWriter is a log output dropping messages below a minimum level,
+// which can be changed while logging.
+type levelWriter struct {
+	out io.Writer
+	min int32
+}
+
+func newLevelWriter(out io.Writer) *levelWriter {
+	return &levelWriter{out: out, min: logLevels["INFO"]}
+}
+
+func (w *levelWriter) setLevel(level string) error {
+	l, ok := logLevels[strings.ToUpper(level)]
+	if !ok {
+		return fmt.Errorf("unknown log level: %q", level)
+	}
+	atomic.StoreInt32(&w.min, l)
+	return nil
+}
+
+func (w *levelWriter) Write(p []byte) (int, error) {
+	if l, ok := logLevels[messageLevel(p)]; ok && l < atomic.LoadInt32(&w.min) {
+		return len(p), nil
+	}
+	return w.out.Write(p)
+}
+
+// messageLevel returns the first word after the date and time of a log line.
+func messageLevel(p []byte) string {
+	f := bytes.Fields(p)
+	if len(f) < 3 {
+		return ""
+	}
+	return string(f[2])
+}
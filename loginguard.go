@@ -0,0 +1,269 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Brute-force protection for PIN logins /////////////////////////////////////
+
+// loginGuardConfig configures the brute-force protection. Zero values are
+// replaced by defaults.
+type loginGuardConfig struct {
+	// A patron is locked out after MaxFailures failed logins within
+	// Window, on any automat, for LockDuration.
+	MaxFailures  int
+	Window       duration
+	LockDuration duration
+
+	// Each recent failure at an automat doubles the delay before its next
+	// login attempt, starting at AutomatDelay, up to MaxAutomatDelay.
+	AutomatDelay    duration
+	MaxAutomatDelay duration
+
+	// Send SIP 01 Block Patron after BlockAfter failures within Window,
+	// counting attempts while locked out. 0 means never; only use if the
+	// library system supports it.
+	BlockAfter int
+}
+
+// Default brute-force protection
+var defaultLoginGuardConfig = loginGuardConfig{
+	MaxFailures:     5,
+	Window:          duration{15 * time.Minute},
+	LockDuration:    duration{30 * time.Minute},
+	AutomatDelay:    duration{time.Second},
+	MaxAutomatDelay: duration{30 * time.Second},
+}
+
+// failures keeps track of failed logins for a patron or an automat
+type failures struct {
+	times       []time.Time // within window
+	lockedUntil time.Time
+	blocked     bool // Block Patron sent
+}
+
+// prune drops failures older than the window
+func (f *failures) prune(now time.Time, window time.Duration) {
+	i := 0
+	for i < len(f.times) && now.Sub(f.times[i]) > window {
+		i++
+	}
+	f.times = f.times[i:]
+}
+
+// expired reports whether there is nothing left to remember: no failures
+// within the window, and no lock.
+func (f *failures) expired(now time.Time) bool {
+	return len(f.times) == 0 && !now.Before(f.lockedUntil)
+}
+
+// loginGuard limits PIN login attempts, per patron across all automats, and
+// per automat.
+type loginGuard struct {
+	cfg     loginGuardConfig
+	metrics *appMetrics // may be nil
+
+	mu       sync.Mutex
+	patrons  map[string]*failures
+	automats map[string]*failures
+	swept    time.Time // expired entries last removed
+
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+// withDefaults returns c with its zero values replaced by the defaults.
+func (c loginGuardConfig) withDefaults() loginGuardConfig {
+	d := defaultLoginGuardConfig
+	if c.MaxFailures == 0 {
+		c.MaxFailures = d.MaxFailures
+	}
+	if c.Window.Duration == 0 {
+		c.Window = d.Window
+	}
+	if c.LockDuration.Duration == 0 {
+		c.LockDuration = d.LockDuration
+	}
+	if c.AutomatDelay.Duration == 0 {
+		c.AutomatDelay = d.AutomatDelay
+	}
+	if c.MaxAutomatDelay.Duration == 0 {
+		c.MaxAutomatDelay = d.MaxAutomatDelay
+	}
+	return c
+}
+
+// blockReachable reports whether BlockAfter can be reached by failed PINs
+// alone. Above MaxFailures the patron is locked out first, and unless the
+// lock ends within Window, the earlier failures are gone by then.
+func (c loginGuardConfig) blockReachable() bool {
+	c = c.withDefaults()
+	return c.BlockAfter <= c.MaxFailures || c.LockDuration.Duration < c.Window.Duration
+}
+
+func newLoginGuard(c loginGuardConfig, m *appMetrics) *loginGuard {
+	return &loginGuard{
+		cfg:      c.withDefaults(),
+		metrics:  m,
+		patrons:  make(map[string]*failures),
+		automats: make(map[string]*failures),
+		now:      time.Now,
+		sleep:    time.Sleep,
+	}
+}
+
+// get returns the failures for key, to record a new one.
+func (g *loginGuard) get(m map[string]*failures, key string) *failures {
+	f, ok := m[key]
+	if !ok {
+		f = &failures{}
+		m[key] = f
+	}
+	f.prune(g.now(), g.cfg.Window.Duration)
+	return f
+}
+
+// lookup returns the failures for key, forgetting them if expired.
+func (g *loginGuard) lookup(m map[string]*failures, key string) *failures {
+	f, ok := m[key]
+	if !ok {
+		return &failures{}
+	}
+	now := g.now()
+	f.prune(now, g.cfg.Window.Duration)
+	if f.expired(now) {
+		delete(m, key)
+	}
+	return f
+}
+
+// sweep forgets the expired failures of all patrons and automats, at most
+// once per window.
+func (g *loginGuard) sweep() {
+	now := g.now()
+	if now.Sub(g.swept) < g.cfg.Window.Duration {
+		return
+	}
+	g.swept = now
+	for _, m := range []map[string]*failures{g.patrons, g.automats} {
+		for key, f := range m {
+			f.prune(now, g.cfg.Window.Duration)
+			if f.expired(now) {
+				delete(m, key)
+			}
+		}
+	}
+}
+
+// check returns how long to wait before attempting a login from automat,
+// and whether the patron is locked out.
+func (g *loginGuard) check(patron, automat string) (delay time.Duration, locked bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.now().Before(g.lookup(g.patrons, patron).lockedUntil) {
+		return 0, true
+	}
+	n := len(g.lookup(g.automats, automat).times)
+	if n == 0 {
+		return 0, false
+	}
+	delay = g.cfg.AutomatDelay.Duration
+	for i := 1; i < n && delay < g.cfg.MaxAutomatDelay.Duration; i++ {
+		delay *= 2
+	}
+	if delay > g.cfg.MaxAutomatDelay.Duration {
+		delay = g.cfg.MaxAutomatDelay.Duration
+	}
+	return delay, false
+}
+
+// fail records a failed login, or an attempt while locked out. It returns true if the patron should now be
+// blocked in the library system.
+func (g *loginGuard) fail(patron, automat string) (block bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := g.now()
+	g.sweep()
+
+	a := g.get(g.automats, automat)
+	a.times = append(a.times, now)
+
+	p := g.get(g.patrons, patron)
+	p.times = append(p.times, now)
+	log.Printf("WARN failed login for patron %s at %s (%d within %v)", patron, automat, len(p.times), g.cfg.Window)
+	if g.metrics != nil {
+		g.metrics.LoginFailed(automat)
+	}
+
+	if len(p.times) >= g.cfg.MaxFailures && !now.Before(p.lockedUntil) {
+		p.lockedUntil = now.Add(g.cfg.LockDuration.Duration)
+		log.Printf("WARN patron %s locked out until %s", patron, p.lockedUntil.Format(time.RFC3339))
+		if g.metrics != nil {
+			g.metrics.PatronLockouts.Inc(1)
+		}
+	}
+	if g.cfg.BlockAfter > 0 && len(p.times) >= g.cfg.BlockAfter && !p.blocked {
+		p.blocked = true
+		return true
+	}
+	return false
+}
+
+// success clears the failed logins of a patron.
+func (g *loginGuard) success(patron string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.patrons, patron)
+}
+
+// locked returns the number of patrons currently locked out.
+func (g *loginGuard) locked() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	n, now := 0, g.now()
+	for _, f := range g.patrons {
+		if now.Before(f.lockedUntil) {
+			n++
+		}
+	}
+	return n
+}
+
+// authenticate performs a PIN login, subject to the limits of the guard.
+func (g *loginGuard) authenticate(b Backend, dept, automat, username, pin string) (*UIResponse, error) {
+	delay, locked := g.check(username, automat)
+	if locked {
+		log.Printf("WARN login attempt for locked out patron %s at %s", username, automat)
+		if g.fail(username, automat) {
+			g.block(b, dept, username)
+		}
+		return &UIResponse{Action: "LOGIN", Patron: username, Reason: loginLocked}, nil
+	}
+	if delay > 0 {
+		g.sleep(delay)
+	}
+
+	res, err := b.Authenticate(dept, username, pin)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case res.Authenticated:
+		g.success(username)
+	case res.Reason == loginWrongPIN, res.Reason == loginInvalidPatron:
+		if g.fail(username, automat) {
+			g.block(b, dept, username)
+		}
+	}
+	return res, nil
+}
+
+// block blocks the patron in the library system.
+func (g *loginGuard) block(b Backend, dept, username string) {
+	log.Printf("WARN blocking patron %s in library system after repeated failed logins", username)
+	if _, err := b.BlockPatron(dept, username, "Blocked by automathub: too many failed logins"); err != nil {
+		log.Println("ERROR", "block patron", username, err)
+	}
+}
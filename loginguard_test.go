@@ -0,0 +1,161 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/knakk/specs"
+	"github.com/rcrowley/go-metrics"
+)
+
+// pinBackend accepts PIN 1234 only, and records blocked patrons.
+type pinBackend struct {
+	Backend
+	attempts int
+	blocked  []string
+}
+
+func (b *pinBackend) Authenticate(dept, username, pin string) (*UIResponse, error) {
+	b.attempts++
+	if pin != "1234" {
+		return &UIResponse{Action: "LOGIN", Patron: username, Reason: loginWrongPIN}, nil
+	}
+	return &UIResponse{Action: "LOGIN", Patron: username, Authenticated: true}, nil
+}
+
+func (b *pinBackend) BlockPatron(dept, username, msg string) (*UIResponse, error) {
+	b.blocked = append(b.blocked, username)
+	return &UIResponse{Action: "BLOCK", Patron: username}, nil
+}
+
+func TestLoginGuard(t *testing.T) {
+	s := specs.New(t)
+	m := &appMetrics{automats: make(map[string]*automatStatus)}
+	m.LoginFailures = metrics.NewCounter()
+	m.PatronLockouts = metrics.NewCounter()
+
+	now := time.Date(2014, 1, 23, 12, 0, 0, 0, time.UTC)
+	var slept []time.Duration
+	g := newLoginGuard(loginGuardConfig{MaxFailures: 3}, m)
+	g.now = func() time.Time { return now }
+	g.sleep = func(d time.Duration) { slept = append(slept, d) }
+	b := &pinBackend{}
+
+	// failures slow down the automat, doubling the delay
+	for i := 0; i < 3; i++ {
+		res, err := g.authenticate(b, "HUTL", "10.0.0.1", "p1", "0000")
+		s.ExpectNil(err)
+		s.Expect(loginWrongPIN, res.Reason)
+	}
+	s.Expect([]time.Duration{time.Second, 2 * time.Second}, slept)
+	s.Expect(int64(3), m.LoginFailures.Count())
+	s.Expect(3, m.automats["10.0.0.1"].LoginFailures)
+
+	// the patron is now locked out on all automats, even with the right PIN
+	res, _ := g.authenticate(b, "HUTL", "10.0.0.2", "p1", "1234")
+	s.Expect(loginLocked, res.Reason)
+	s.Expect(false, res.Authenticated)
+	s.Expect(3, b.attempts)
+	s.Expect(int64(1), m.PatronLockouts.Count())
+	s.Expect(1, g.locked())
+
+	// other patrons are not affected, but the automat is still slowed down
+	res, _ = g.authenticate(b, "HUTL", "10.0.0.1", "p2", "1234")
+	s.Expect(true, res.Authenticated)
+	s.Expect(4*time.Second, slept[len(slept)-1])
+
+	// the lock expires
+	now = now.Add(31 * time.Minute)
+	s.Expect(0, g.locked())
+	res, _ = g.authenticate(b, "HUTL", "10.0.0.2", "p1", "1234")
+	s.Expect(true, res.Authenticated)
+
+	s.Expect([]string(nil), b.blocked)
+}
+
+func TestLoginGuardBlock(t *testing.T) {
+	s := specs.New(t)
+	now := time.Date(2014, 1, 23, 12, 0, 0, 0, time.UTC)
+	b := &pinBackend{}
+	newGuard := func(c loginGuardConfig) *loginGuard {
+		g := newLoginGuard(c, nil)
+		g.now = func() time.Time { return now }
+		g.sleep = func(time.Duration) {}
+		return g
+	}
+
+	// with the defaults, the patron is blocked when locked out, once
+	g := newGuard(loginGuardConfig{BlockAfter: 5})
+	for i := 0; i < 5; i++ {
+		g.authenticate(b, "HUTL", "10.0.0.1", "p1", "0000")
+	}
+	s.Expect(1, g.locked())
+	s.Expect([]string{"p1"}, b.blocked)
+	res, _ := g.authenticate(b, "HUTL", "10.0.0.1", "p1", "0000")
+	s.Expect(loginLocked, res.Reason)
+	s.Expect([]string{"p1"}, b.blocked)
+
+	// failures spread beyond the window never add up
+	for i := 0; i < 10; i++ {
+		g.authenticate(b, "HUTL", "10.0.0.1", "p2", "0000")
+		now = now.Add(16 * time.Minute)
+	}
+	s.Expect([]string{"p1"}, b.blocked)
+
+	// attempts while locked out count toward the block
+	b.attempts = 0
+	g = newGuard(loginGuardConfig{BlockAfter: 8, Window: duration{time.Hour}})
+	for i := 0; i < 5; i++ {
+		g.authenticate(b, "HUTL", "10.0.0.1", "p3", "0000")
+	}
+	s.Expect(1, g.locked())
+	for i := 0; i < 3; i++ {
+		res, _ = g.authenticate(b, "HUTL", "10.0.0.2", "p3", "1234")
+		s.Expect(loginLocked, res.Reason)
+	}
+	s.Expect(5, b.attempts)
+	s.Expect([]string{"p1", "p3"}, b.blocked)
+}
+
+func TestLoginGuardBlockReachable(t *testing.T) {
+	s := specs.New(t)
+	s.Expect(true, loginGuardConfig{}.blockReachable())
+	s.Expect(true, loginGuardConfig{BlockAfter: 5}.blockReachable())
+	s.Expect(false, loginGuardConfig{BlockAfter: 6}.blockReachable())
+	s.Expect(true, loginGuardConfig{BlockAfter: 6, Window: duration{time.Hour}}.blockReachable())
+
+	c := validTestConfig()
+	c.LoginGuard.BlockAfter = 10
+	s.Expect(1, len(c.validate()))
+}
+
+func TestLoginGuardForgetsOldFailures(t *testing.T) {
+	s := specs.New(t)
+	now := time.Date(2014, 1, 23, 12, 0, 0, 0, time.UTC)
+	g := newLoginGuard(loginGuardConfig{MaxFailures: 2}, nil)
+	g.now = func() time.Time { return now }
+
+	g.fail("p1", "10.0.0.1")
+	g.fail("p2", "10.0.0.2")
+	g.fail("p2", "10.0.0.2") // locked out
+	s.Expect(2, len(g.patrons))
+	s.Expect(2, len(g.automats))
+
+	// checking does not remember anything
+	g.check("p3", "10.0.0.3")
+	s.Expect(2, len(g.patrons))
+
+	// p1's failure has left the window; p2 is still locked out
+	now = now.Add(16 * time.Minute)
+	g.check("p1", "10.0.0.1")
+	s.Expect(1, len(g.patrons))
+	s.Expect(1, len(g.automats))
+
+	// the lock has expired too: removed by the sweep on the next failure
+	now = now.Add(15 * time.Minute)
+	g.fail("p4", "10.0.0.4")
+	s.Expect(1, len(g.patrons))
+	s.Expect(1, len(g.automats))
+	_, ok := g.patrons["p4"]
+	s.Expect(true, ok)
+}
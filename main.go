@@ -1,83 +1,195 @@
 package main
 
 import (
-	"html/template"
+	"flag"
+	"fmt"
+	"io/ioutil"
 	"log"
-	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
-// Application state //////////////////////////////////////////////////////////
-
-var (
-	sipPool   *ConnPool
-	hub       *wsHub
-	cfg       *config
-	stats     *appMetrics
-	server    *TCPServer
-	logFile   *os.File
-	templates = template.Must(
-		template.ParseFiles("data/html/monitor.html", "data/html/ui.html"))
-)
+// checkConfig validates a config file, reporting all problems. It returns
+// the exit status.
+func checkConfig(file string) int {
+	_, errs := loadConfig(file, os.LookupEnv)
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if len(errs) > 0 {
+		fmt.Fprintf(os.Stderr, "%s: %d problems\n", file, len(errs))
+		return 1
+	}
+	fmt.Println(file, "OK")
+	return 0
+}
 
-// Setup //////////////////////////////////////////////////////////////////////
+// sipServer runs the fake SIP server standalone, so the hub can be run
+// without a library system: "automathub sipserver -catalogue file". It
+// returns the exit status.
+func sipServer(args []string) int {
+	fs := flag.NewFlagSet("sipserver", flag.ExitOnError)
+	addr := fs.String("addr", ":6001", "address to listen on")
+	file := fs.String("catalogue", "testdata/catalogue.json", "patrons and items")
+	var f sipFaults
+	fs.DurationVar(&f.Delay, "delay", 0, "delay before every response")
+	fs.IntVar(&f.DropAfter, "drop-after", 0, "close connections after this many requests; 0 never")
+	fs.BoolVar(&f.RefuseLogin, "refuse-login", false, "refuse all SIP logins")
+	fs.Parse(args)
 
-func init() {
-	cfg = &config{}
-	err := cfg.fromFile("config.json")
+	cat, err := loadSIPCatalogue(*file)
 	if err != nil {
-		log.Fatal(err)
+		log.Println("ERROR", err)
+		return 1
+	}
+	s := newFakeSIPServer(cat, f)
+	if err := s.listen(*addr); err != nil {
+		log.Println("ERROR", err)
+		return 1
 	}
+	log.Printf("INFO fake SIP server listening on %s, with %d patrons and %d items",
+		s.Addr(), len(cat.Patrons), len(cat.Items))
+	s.serve()
+	return 0
+}
 
-	if cfg.LogToFile {
-		logFile, err := os.OpenFile(cfg.LogFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+// simulateCmd runs virtual automats against a hub, and reports how it did:
+// "automathub simulate -automats 50 -duration 5m". It returns the exit
+// status; 1 if there were errors.
+func simulateCmd(args []string) int {
+	fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+	c := simConfig{}
+	fs.StringVar(&c.TCPAddr, "tcp", "localhost:6666", "RFID service address of the hub")
+	fs.StringVar(&c.HTTPAddr, "http", "localhost:9000", "HTTP address of the hub")
+	fs.StringVar(&c.Secret, "secret", "", "automat secret, if the hub does not allow the UI by IP")
+	fs.IntVar(&c.Automats, "automats", 10, "number of virtual automats")
+	fs.DurationVar(&c.Duration, "duration", time.Minute, "how long to run")
+	fs.DurationVar(&c.Think, "think", time.Second, "max pause between sessions")
+	fs.DurationVar(&c.Timeout, "timeout", 10*time.Second, "max wait for a reply")
+	fs.IntVar(&c.MaxItems, "items", 5, "max items per random session")
+	script := fs.String("script", "", "JSON file with sessions to run, instead of random ones")
+	catalogue := fs.String("catalogue", "testdata/catalogue.json", "patrons and items for random sessions")
+	fs.Parse(args)
+
+	if *script != "" {
+		var err error
+		if c.Script, err = loadSimScript(*script); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	} else {
+		cat, err := loadSIPCatalogue(*catalogue)
 		if err != nil {
-			log.Fatal(err)
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		for _, p := range cat.Patrons {
+			c.Patrons = append(c.Patrons, simPatron{ID: p.ID, PIN: p.PIN})
+		}
+		for _, it := range cat.Items {
+			c.Items = append(c.Items, it.Barcode)
 		}
-		log.SetOutput(logFile)
 	}
 
-	log.Println("INFO", "Creating SIP Connection pool with size:", cfg.NumSIPConnections)
-	sipPool = NewSIPConnPool(cfg.NumSIPConnections)
-
-	log.Println("INFO", "Registering metrics")
-	stats = RegisterMetrics()
-
-	log.Println("INFO", "Starting Websocket server")
-	hub = NewHub()
+	r := simulate(c)
+	r.Print(os.Stdout)
+	for _, res := range r.Results {
+		if res.Errors > 0 {
+			return 1
+		}
+	}
+	if len(r.Errors) > 0 {
+		return 1
+	}
+	return 0
+}
 
+// replayCmd replays a recording, and reports where the state machine now
+// behaves differently: "automathub replay recordings/Maj1-....jsonl". It
+// returns the exit status; 1 if there were differences.
+func replayCmd(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: automathub replay <recording>")
+		return 2
+	}
+	events, err := loadRecording(args[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	log.SetOutput(ioutil.Discard) // the state machine's log is noise here
+	r, err := replay(events)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	r.Print(os.Stdout)
+	if len(r.Diffs) > 0 {
+		return 1
+	}
+	return 0
 }
 
 // Application entry point ////////////////////////////////////////////////////
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "sipserver":
+			os.Exit(sipServer(os.Args[2:]))
+		case "simulate":
+			os.Exit(simulateCmd(os.Args[2:]))
+		case "replay":
+			os.Exit(replayCmd(os.Args[2:]))
+		}
+	}
+
+	configFile := flag.String("config", "config.json", "config file; reloaded when changed")
+	check := flag.Bool("check-config", false, "validate the config file and exit")
+	flag.Parse()
+	if *check {
+		os.Exit(checkConfig(*configFile))
+	}
+
+	cfg, errs := loadConfig(*configFile, os.LookupEnv)
+	if len(errs) > 0 {
+		for _, err := range errs {
+			log.Println("ERROR", "config:", err)
+		}
+		log.Fatal("invalid config: ", *configFile)
+	}
+
+	logOutput := newLevelWriter(os.Stderr)
 	if cfg.LogToFile {
+		logFile, err := os.OpenFile(cfg.LogFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+		if err != nil {
+			log.Fatal(err)
+		}
 		defer logFile.Close()
+		logOutput = newLevelWriter(logFile)
 	}
-	// TCP server handles the communcation with the RFID-service on the
-	// self-checkin-automats, and spins up an automat state-machine for every
-	// connection.
-	log.Println("INFO", "Starting TCP server")
-	server = newTCPServer(cfg)
-	go server.run()
-
-	// Websocket server handles feedback to the user interface on self-checkin-
-	// automats, and broadcast metrics to a monitor page.
-	go hub.run()
-
-	// HTTP handlers
-	http.HandleFunc("/css/styles.css", serveFile("data/css/styles.css"))
-	http.HandleFunc("/.status", statusHandler)
-	http.HandleFunc("/js/JSXTransformer-0.8.0.js", serveFile("data/js/JSXTransformer-0.8.0.js"))
-	http.HandleFunc("/js/react-with-addons-0.8.0.js", serveFile("data/js/react-with-addons-0.8.0.js"))
-	http.HandleFunc("/ws", wsHandler)
-	http.HandleFunc("/ui", uiHandler)
-	http.HandleFunc("/", monitorHandler)
-
-	// HTTP Server
-	log.Println("INFO", "Starting HTTP server")
-	err := http.ListenAndServe(":"+cfg.HTTPPort, nil)
+	if err := logOutput.setLevel(cfg.logLevel()); err != nil {
+		log.Fatal(err)
+	}
+	log.SetOutput(logOutput)
+
+	if cfg.Auth == nil {
+		log.Println("WARN", "No Auth configured: the monitor is open to anyone")
+	}
+
+	app, err := NewApp(AppOptions{Config: cfg, ConfigFile: *configFile, LogOutput: logOutput})
 	if err != nil {
 		log.Fatal(err)
 	}
+	if err := app.Start(); err != nil {
+		log.Fatal(err)
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	s := <-stop
+	log.Println("INFO", "Shutting down:", s)
+	app.Close()
 }
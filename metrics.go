@@ -2,16 +2,27 @@ package main
 
 import (
 	"os"
+	"sync"
 	"time"
 
 	"github.com/rcrowley/go-metrics"
 )
 
 type appMetrics struct {
+	registry         metrics.Registry
 	StartTime        time.Time
 	PID              int
 	ClientsKnown     int
 	ClientsConnected metrics.Counter
+	SorterJams       metrics.Counter
+	LoginFailures    metrics.Counter
+	PatronLockouts   metrics.Counter
+	Transactions     metrics.Counter // logins, checkins and checkouts
+	Failures         metrics.Counter // of these, failed
+	LockedPatrons    func() int      // currently locked out, if known
+
+	mu       sync.Mutex
+	automats map[string]*automatStatus // by IP
 }
 
 type exportMetrics struct {
@@ -19,16 +30,55 @@ type exportMetrics struct {
 	PID              int
 	ClientsKnown     int
 	ClientsConnected int64
+	SorterJams       int64
+	LoginFailures    int64
+	PatronLockouts   int64
+	Transactions     int64
+	Failures         int64
+	LockedPatrons    int
+	Automats         map[string]automatStatus
+}
+
+// automatStatus is the state of an automat shown on the monitor page
+type automatStatus struct {
+	Sorter          *sorterStatus `json:",omitempty"`
+	LoginFailures   int
+	Connections     int       // RFID service connections
+	Since           time.Time // connected, or disconnected, since
+	LastTransaction time.Time
+	Maintenance     bool   // out of order
+	Hours           string `json:",omitempty"` // opening hours mode
+}
+
+type sorterStatus struct {
+	Jammed    bool
+	FullBins  []int
+	LastEvent string
+	Message   string
+	Time      time.Time
 }
 
-func RegisterMetrics() *appMetrics {
+// RegisterMetrics creates the metrics of an App, in a registry of its own.
+func RegisterMetrics(clientsKnown int) *appMetrics {
 	var m appMetrics
 
+	m.registry = metrics.NewRegistry()
 	m.StartTime = time.Now()
 	m.PID = os.Getpid()
-	m.ClientsKnown = len(cfg.Automats)
+	m.ClientsKnown = clientsKnown
 	m.ClientsConnected = metrics.NewCounter()
-	metrics.Register("ClientsConnected", m.ClientsConnected)
+	m.registry.Register("ClientsConnected", m.ClientsConnected)
+	m.SorterJams = metrics.NewCounter()
+	m.registry.Register("SorterJams", m.SorterJams)
+	m.LoginFailures = metrics.NewCounter()
+	m.registry.Register("LoginFailures", m.LoginFailures)
+	m.PatronLockouts = metrics.NewCounter()
+	m.registry.Register("PatronLockouts", m.PatronLockouts)
+	m.Transactions = metrics.NewCounter()
+	m.registry.Register("Transactions", m.Transactions)
+	m.Failures = metrics.NewCounter()
+	m.registry.Register("Failures", m.Failures)
+	m.automats = make(map[string]*automatStatus)
 
 	return &m
 }
@@ -37,10 +87,149 @@ func (m *appMetrics) Export() *exportMetrics {
 	now := time.Now()
 	uptime := now.Sub(m.StartTime)
 
+	m.mu.Lock()
+	known := m.ClientsKnown
+	automats := make(map[string]automatStatus, len(m.automats))
+	for ip, st := range m.automats {
+		automats[ip] = st.copy()
+	}
+	m.mu.Unlock()
+
+	locked := 0
+	if m.LockedPatrons != nil {
+		locked = m.LockedPatrons()
+	}
+
 	return &exportMetrics{
 		UpTime:           uptime.String(),
 		PID:              m.PID,
-		ClientsKnown:     m.ClientsKnown,
+		ClientsKnown:     known,
 		ClientsConnected: m.ClientsConnected.Count(),
+		SorterJams:       m.SorterJams.Count(),
+		LoginFailures:    m.LoginFailures.Count(),
+		PatronLockouts:   m.PatronLockouts.Count(),
+		Transactions:     m.Transactions.Count(),
+		Failures:         m.Failures.Count(),
+		LockedPatrons:    locked,
+		Automats:         automats,
+	}
+}
+
+// SetClientsKnown updates the number of configured automats
+func (m *appMetrics) SetClientsKnown(n int) {
+	m.mu.Lock()
+	m.ClientsKnown = n
+	m.mu.Unlock()
+}
+
+// copy returns a deep copy, safe to export while the original is updated
+func (st *automatStatus) copy() automatStatus {
+	c := *st
+	if st.Sorter != nil {
+		s := *st.Sorter
+		s.FullBins = append([]int(nil), st.Sorter.FullBins...)
+		c.Sorter = &s
+	}
+	return c
+}
+
+// automat returns the status of the automat with the given IP, creating it
+// if needed. Must be called with m.mu held.
+func (m *appMetrics) automat(ip string) *automatStatus {
+	st, ok := m.automats[ip]
+	if !ok {
+		st = &automatStatus{}
+		m.automats[ip] = st
 	}
+	return st
+}
+
+// SorterEvent records an event from an automat's sorting machine
+func (m *appMetrics) SorterEvent(ip string, ev sorterEvent) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st := m.automat(ip)
+	if st.Sorter == nil {
+		st.Sorter = &sorterStatus{}
+	}
+	s := st.Sorter
+	s.LastEvent, s.Message, s.Time = ev.Event, ev.Message, time.Now()
+	switch ev.Event {
+	case sorterJam:
+		if !s.Jammed {
+			m.SorterJams.Inc(1)
+		}
+		s.Jammed = true
+	case sorterCleared:
+		s.Jammed = false
+	case sorterBinFull:
+		for _, b := range s.FullBins {
+			if b == ev.Bin {
+				return
+			}
+		}
+		s.FullBins = append(s.FullBins, ev.Bin)
+	case sorterBinEmpty:
+		for i, b := range s.FullBins {
+			if b == ev.Bin {
+				s.FullBins = append(s.FullBins[:i], s.FullBins[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// LoginFailed records a failed PIN login at an automat
+func (m *appMetrics) LoginFailed(ip string) {
+	m.LoginFailures.Inc(1)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.automat(ip).LoginFailures++
+}
+
+// AutomatConnected records an RFID service connecting to the hub, or
+// disconnecting when connected is false.
+func (m *appMetrics) AutomatConnected(ip string, connected bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st := m.automat(ip)
+	if connected {
+		st.Connections++
+		if st.Connections == 1 {
+			st.Since = time.Now()
+		}
+		return
+	}
+	st.Connections--
+	if st.Connections == 0 {
+		st.Since = time.Now()
+	}
+}
+
+// Transaction records the outcome of logins, checkins and checkouts at an
+// automat.
+func (m *appMetrics) Transaction(ip string, c usageCounts) {
+	n := c.Logins + c.LoginFailures + c.Checkins + c.Checkouts + c.Failures
+	if n == 0 {
+		return
+	}
+	m.Transactions.Inc(int64(n))
+	m.Failures.Inc(int64(c.Failures))
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.automat(ip).LastTransaction = time.Now()
+}
+
+// SetMaintenance records an automat going out of order, or back in service.
+func (m *appMetrics) SetMaintenance(ip string, on bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.automat(ip).Maintenance = on
+}
+
+// SetHours records the opening hours mode of an automat.
+func (m *appMetrics) SetHours(ip, mode string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.automat(ip).Hours = mode
 }
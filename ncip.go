@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// NCIPBackend talks NCIP 2.0 (ANSI/NISO Z39.83) over HTTP, for library
+// systems where SIP2 is not available.
+type NCIPBackend struct {
+	url    string // NCIP responder endpoint
+	agency string // our agency id
+	client *http.Client
+}
+
+func newNCIPBackend(url, agency string) *NCIPBackend {
+	return &NCIPBackend{
+		url:    url,
+		agency: agency,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// NCIP messages ///////////////////////////////////////////////////////////
+
+type ncipAgencyID struct {
+	AgencyID string `xml:"AgencyId"`
+}
+
+type ncipHeader struct {
+	From ncipAgencyID `xml:"FromAgencyId"`
+	To   ncipAgencyID `xml:"ToAgencyId"`
+}
+
+type ncipUserID struct {
+	AgencyID string `xml:"AgencyId,omitempty"`
+	Value    string `xml:"UserIdentifierValue"`
+}
+
+type ncipItemID struct {
+	AgencyID string `xml:"AgencyId,omitempty"`
+	Value    string `xml:"ItemIdentifierValue"`
+}
+
+type ncipAuthInput struct {
+	Data   string `xml:"AuthenticationInputData"`
+	Format string `xml:"AuthenticationDataFormatType"`
+	Type   string `xml:"AuthenticationInputType"`
+}
+
+type ncipRequest struct {
+	Header       ncipHeader      `xml:"InitiationHeader"`
+	AuthInput    []ncipAuthInput `xml:"AuthenticationInput,omitempty"`
+	UserID       *ncipUserID     `xml:"UserId,omitempty"`
+	ItemID       *ncipItemID     `xml:"ItemId,omitempty"`
+	ItemElements []string        `xml:"ItemElementType,omitempty"`
+	UserElements []string        `xml:"UserElementType,omitempty"`
+}
+
+type ncipMessage struct {
+	XMLName          xml.Name     `xml:"http://www.niso.org/2008/ncip NCIPMessage"`
+	Version          string       `xml:"version,attr"`
+	AuthenticateUser *ncipRequest `xml:"AuthenticateUser,omitempty"`
+	LookupUser       *ncipRequest `xml:"LookupUser,omitempty"`
+	LookupItem       *ncipRequest `xml:"LookupItem,omitempty"`
+	CheckInItem      *ncipRequest `xml:"CheckInItem,omitempty"`
+	CheckOutItem     *ncipRequest `xml:"CheckOutItem,omitempty"`
+	RenewItem        *ncipRequest `xml:"RenewItem,omitempty"`
+}
+
+type ncipProblem struct {
+	Type   string `xml:"ProblemType"`
+	Detail string `xml:"ProblemDetail"`
+}
+
+type ncipResponseBody struct {
+	Problem  []ncipProblem `xml:"Problem"`
+	UserID   ncipUserID    `xml:"UserId"`
+	ItemID   ncipItemID    `xml:"ItemId"`
+	DateDue  string        `xml:"DateDue"`
+	Title    string        `xml:"ItemOptionalFields>BibliographicDescription>Title"`
+	CircStat string        `xml:"ItemOptionalFields>CirculationStatus"`
+	UserName string        `xml:"UserOptionalFields>NameInformation>PersonalNameInformation>UnstructuredPersonalUserName"`
+}
+
+type ncipResponse struct {
+	AuthenticateUser *ncipResponseBody `xml:"AuthenticateUserResponse"`
+	LookupUser       *ncipResponseBody `xml:"LookupUserResponse"`
+	LookupItem       *ncipResponseBody `xml:"LookupItemResponse"`
+	CheckInItem      *ncipResponseBody `xml:"CheckInItemResponse"`
+	CheckOutItem     *ncipResponseBody `xml:"CheckOutItemResponse"`
+	RenewItem        *ncipResponseBody `xml:"RenewItemResponse"`
+}
+
+// body returns the response body, whichever service it is for.
+func (r *ncipResponse) body() *ncipResponseBody {
+	for _, b := range []*ncipResponseBody{r.AuthenticateUser, r.LookupUser,
+		r.LookupItem, r.CheckInItem, r.CheckOutItem, r.RenewItem} {
+		if b != nil {
+			return b
+		}
+	}
+	return nil
+}
+
+// problem returns a message describing the first problem, or "" if none.
+func (b *ncipResponseBody) problem() string {
+	if len(b.Problem) == 0 {
+		return ""
+	}
+	p := b.Problem[0]
+	if p.Detail != "" {
+		return p.Detail
+	}
+	return p.Type
+}
+
+// ncipDate turns an NCIP dateTime into an isoDate.
+func ncipDate(s string) string {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return s
+	}
+	return t.Format(isoDate)
+}
+
+// masked returns a copy of msg with the PIN replaced, for logging.
+func (msg ncipMessage) masked() *ncipMessage {
+	if msg.AuthenticateUser == nil {
+		return &msg
+	}
+	req := *msg.AuthenticateUser
+	req.AuthInput = append([]ncipAuthInput(nil), req.AuthInput...)
+	for i := range req.AuthInput {
+		if req.AuthInput[i].Type == "PIN" {
+			req.AuthInput[i].Data = "*****"
+		}
+	}
+	msg.AuthenticateUser = &req
+	return &msg
+}
+
+// do sends a request and returns the response body of the service.
+func (b *NCIPBackend) do(msg *ncipMessage) (*ncipResponseBody, error) {
+	msg.Version = "http://www.niso.org/schemas/ncip/v2_02/ncip_v2_02.xsd"
+	out, err := xml.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	out = append([]byte(xml.Header), out...)
+
+	logged, _ := xml.Marshal(msg.masked())
+	log.Println("-> NCIP", xml.Header+string(logged))
+	resp, err := b.client.Post(b.url, "application/xml; charset=utf-8", bytes.NewReader(out))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("NCIP server responded: %s", resp.Status)
+	}
+
+	var r ncipResponse
+	err = xml.NewDecoder(resp.Body).Decode(&r)
+	if err != nil {
+		return nil, err
+	}
+	body := r.body()
+	if body == nil {
+		return nil, fmt.Errorf("NCIP: unexpected response")
+	}
+	log.Printf("<- NCIP %+v", *body)
+	return body, nil
+}
+
+func (b *NCIPBackend) header() ncipHeader {
+	return ncipHeader{From: ncipAgencyID{b.agency}, To: ncipAgencyID{b.agency}}
+}
+
+func (b *NCIPBackend) Authenticate(dept, username, pin string) (*UIResponse, error) {
+	res, err := b.do(&ncipMessage{AuthenticateUser: &ncipRequest{
+		Header: b.header(),
+		AuthInput: []ncipAuthInput{
+			{Data: username, Format: "text/plain", Type: "Username"},
+			{Data: pin, Format: "text/plain", Type: "PIN"},
+		},
+	}})
+	if err != nil {
+		return nil, err
+	}
+	r := &UIResponse{Action: "LOGIN", Patron: username, Message: res.problem()}
+	switch {
+	case len(res.Problem) > 0 && strings.EqualFold(res.Problem[0].Type, "Unknown User"):
+		r.Reason = loginInvalidPatron
+	case len(res.Problem) > 0 || res.UserID.Value == "":
+		r.Reason = loginWrongPIN
+	default:
+		r.Authenticated = true
+	}
+	return r, nil
+}
+
+func (b *NCIPBackend) Checkin(dept, barcode string) (*UIResponse, error) {
+	res, err := b.do(&ncipMessage{CheckInItem: &ncipRequest{
+		Header:       b.header(),
+		ItemID:       &ncipItemID{AgencyID: dept, Value: barcode},
+		ItemElements: []string{"Bibliographic Description"},
+	}})
+	if err != nil {
+		return nil, err
+	}
+	if p := res.problem(); p != "" {
+		return &UIResponse{Item: item{OK: false, Title: res.Title, Barcode: barcode, Status: p}}, nil
+	}
+	return &UIResponse{Item: item{OK: true, Title: res.Title, Barcode: barcode,
+		Event: eventCheckedIn, Date: time.Now().Format(isoDate)}}, nil
+}
+
+func (b *NCIPBackend) Checkout(dept, username, barcode string) (*UIResponse, error) {
+	res, err := b.do(&ncipMessage{CheckOutItem: &ncipRequest{
+		Header:       b.header(),
+		UserID:       &ncipUserID{AgencyID: dept, Value: username},
+		ItemID:       &ncipItemID{AgencyID: dept, Value: barcode},
+		ItemElements: []string{"Bibliographic Description"},
+	}})
+	if err != nil {
+		return nil, err
+	}
+	if p := res.problem(); p != "" {
+		return &UIResponse{Item: item{OK: false, Title: res.Title, Status: p}}, nil
+	}
+	return &UIResponse{Item: item{OK: true, Title: res.Title,
+		Event: eventCheckedOut, Date: ncipDate(res.DateDue)}}, nil
+}
+
+func (b *NCIPBackend) PatronInfo(dept, username string) (*UIResponse, error) {
+	res, err := b.do(&ncipMessage{LookupUser: &ncipRequest{
+		Header:       b.header(),
+		UserID:       &ncipUserID{AgencyID: dept, Value: username},
+		UserElements: []string{"Name Information"},
+	}})
+	if err != nil {
+		return nil, err
+	}
+	r := &UIResponse{Action: "PATRON", Patron: username, Message: res.problem()}
+	if r.Message == "" {
+		r.Message = res.UserName
+		r.Authenticated = true
+	} else {
+		r.Reason = loginInvalidPatron
+	}
+	return r, nil
+}
+
+func (b *NCIPBackend) Renew(dept, username, barcode string) (*UIResponse, error) {
+	res, err := b.do(&ncipMessage{RenewItem: &ncipRequest{
+		Header:       b.header(),
+		UserID:       &ncipUserID{AgencyID: dept, Value: username},
+		ItemID:       &ncipItemID{AgencyID: dept, Value: barcode},
+		ItemElements: []string{"Bibliographic Description"},
+	}})
+	if err != nil {
+		return nil, err
+	}
+	if p := res.problem(); p != "" {
+		return &UIResponse{Item: item{OK: false, Title: res.Title, Status: p}}, nil
+	}
+	return &UIResponse{Item: item{OK: true, Title: res.Title,
+		Event: eventRenewed, Date: ncipDate(res.DateDue)}}, nil
+}
+
+func (b *NCIPBackend) ItemInfo(dept, barcode string) (*UIResponse, error) {
+	res, err := b.do(&ncipMessage{LookupItem: &ncipRequest{
+		Header:       b.header(),
+		ItemID:       &ncipItemID{AgencyID: dept, Value: barcode},
+		ItemElements: []string{"Bibliographic Description", "Circulation Status"},
+	}})
+	if err != nil {
+		return nil, err
+	}
+	if p := res.problem(); p != "" {
+		return &UIResponse{Item: item{OK: false, Status: p}}, nil
+	}
+	circ := ncipCircStatus[strings.ToLower(res.CircStat)]
+	if circ == "" {
+		circ = circOther
+	}
+	ok := circ == circAvailable
+	return &UIResponse{Item: item{OK: ok, Title: res.Title, Status: res.CircStat,
+		Barcode: barcode, CircStatus: circ}}, nil
+}
+
+// ncipCircStatus maps NCIP circulation status values to SIP codes
+var ncipCircStatus = map[string]string{
+	"available on shelf":                   circAvailable,
+	"available for pickup":                 circOnHoldShelf,
+	"on loan":                              circCharged,
+	"on order":                             circOnOrder,
+	"in process":                           circInProcess,
+	"in transit between library locations": circInTransit,
+	"claimed returned or never borrowed":   circClaimedReturned,
+	"lost":                                 circLost,
+	"missing":                              circMissing,
+}
+
+// FeePaid is not supported; NCIP has no fee payment service.
+func (b *NCIPBackend) FeePaid(dept, username string, p payment) (*UIResponse, error) {
+	return nil, errors.New("fee payment is not supported by the NCIP backend")
+}
+
+// EndSession is a no-op; NCIP is stateless.
+func (b *NCIPBackend) EndSession(dept, username string) (*UIResponse, error) {
+	return &UIResponse{Action: "LOGOUT", Patron: username}, nil
+}
+
+func (b *NCIPBackend) BlockPatron(dept, username, msg string) (*UIResponse, error) {
+	return nil, errors.New("blocking patrons is not supported by the NCIP backend")
+}
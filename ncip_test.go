@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/knakk/specs"
+)
+
+// fakeNCIPServer responds with the given XML, and records the request body.
+func fakeNCIPServer(resp string, req *string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		*req = string(b)
+		w.Header().Set("Content-Type", "application/xml")
+		io.WriteString(w, resp)
+	}))
+}
+
+func TestNCIPAuthenticate(t *testing.T) {
+	s := specs.New(t)
+	var req string
+	srv := fakeNCIPServer(`<?xml version="1.0"?>
+<NCIPMessage xmlns="http://www.niso.org/2008/ncip" version="2.02">
+  <AuthenticateUserResponse>
+    <UserId><UserIdentifierValue>patronid1</UserIdentifierValue></UserId>
+  </AuthenticateUserResponse>
+</NCIPMessage>`, &req)
+	defer srv.Close()
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	b := newNCIPBackend(srv.URL, "HUTL")
+	res, err := b.Authenticate("HUTL", "patronid1", "pass")
+	log.SetOutput(os.Stderr)
+	s.ExpectNil(err)
+	s.Expect(true, res.Authenticated)
+	s.Expect("patronid1", res.Patron)
+
+	// the PIN is not logged
+	s.Expect(false, strings.Contains(logged.String(), "pass"))
+	s.Expect(true, strings.Contains(logged.String(), "<AuthenticationInputData>*****</AuthenticationInputData>"))
+
+	var msg ncipMessage
+	err = xml.Unmarshal([]byte(req), &msg)
+	s.ExpectNil(err)
+	s.Expect(2, len(msg.AuthenticateUser.AuthInput))
+	s.Expect("pass", msg.AuthenticateUser.AuthInput[1].Data)
+}
+
+func TestNCIPCheckout(t *testing.T) {
+	s := specs.New(t)
+	var req string
+	srv := fakeNCIPServer(`<NCIPMessage xmlns="http://www.niso.org/2008/ncip">
+  <CheckOutItemResponse>
+    <ItemId><ItemIdentifierValue>03011174511003</ItemIdentifierValue></ItemId>
+    <UserId><UserIdentifierValue>2</UserIdentifierValue></UserId>
+    <DateDue>2014-02-21T23:59:00Z</DateDue>
+    <ItemOptionalFields><BibliographicDescription><Title>Krutt-Kim</Title></BibliographicDescription></ItemOptionalFields>
+  </CheckOutItemResponse>
+</NCIPMessage>`, &req)
+	defer srv.Close()
+
+	b := newNCIPBackend(srv.URL, "HUTL")
+	res, err := b.Checkout("HUTL", "2", "03011174511003")
+	s.ExpectNil(err)
+	s.Expect(true, res.Item.OK)
+	s.Expect("Krutt-Kim", res.Item.Title)
+	s.Expect(eventCheckedOut, res.Item.Event)
+	s.Expect("2014-02-21", res.Item.Date)
+	s.Expect(true, strings.Contains(req, "<ItemIdentifierValue>03011174511003</ItemIdentifierValue>"))
+}
+
+func TestNCIPProblem(t *testing.T) {
+	s := specs.New(t)
+	var req string
+	srv := fakeNCIPServer(`<NCIPMessage xmlns="http://www.niso.org/2008/ncip">
+  <CheckInItemResponse>
+    <Problem>
+      <ProblemType>Item Not Checked Out</ProblemType>
+      <ProblemDetail>Item not checked out</ProblemDetail>
+    </Problem>
+  </CheckInItemResponse>
+</NCIPMessage>`, &req)
+	defer srv.Close()
+
+	b := newNCIPBackend(srv.URL, "HUTL")
+	res, err := b.Checkin("HUTL", "234567890")
+	s.ExpectNil(err)
+	s.Expect(false, res.Item.OK)
+	s.Expect("Item not checked out", res.Item.Status)
+	s.Expect("234567890", res.Item.Barcode)
+}
+
+func TestNCIPCheckin(t *testing.T) {
+	s := specs.New(t)
+	var req string
+	srv := fakeNCIPServer(`<NCIPMessage xmlns="http://www.niso.org/2008/ncip">
+  <CheckInItemResponse>
+    <ItemId><ItemIdentifierValue>03011174511003</ItemIdentifierValue></ItemId>
+    <ItemOptionalFields><BibliographicDescription><Title>Krutt-Kim</Title></BibliographicDescription></ItemOptionalFields>
+  </CheckInItemResponse>
+</NCIPMessage>`, &req)
+	defer srv.Close()
+
+	b := newNCIPBackend(srv.URL, "HUTL")
+	res, err := b.Checkin("HUTL", "03011174511003")
+	s.ExpectNil(err)
+	s.Expect(true, res.Item.OK)
+	s.Expect("Krutt-Kim", res.Item.Title)
+	s.Expect("03011174511003", res.Item.Barcode)
+	s.Expect(eventCheckedIn, res.Item.Event)
+}
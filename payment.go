@@ -0,0 +1,222 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Outstanding fees of a patron, from a Patron Information Response (64)
+type fees struct {
+	Amount    string   // BV, total fee amount
+	Currency  string   // BH
+	Limit     string   // CC, fee limit
+	OverLimit bool     // blocked from borrowing until fees are paid
+	Items     []string // AV, fine items
+}
+
+// SIP payment types
+const (
+	paymentCash       = "00"
+	paymentVISA       = "01"
+	paymentCreditCard = "02"
+)
+
+// payment is a fee payment, to be recorded in the library system.
+type payment struct {
+	Amount    int    // in minor units (øre)
+	Currency  string // ISO 4217, i.e. NOK
+	Type      string // SIP payment type
+	FeeID     string // fee paid; empty means all fees
+	Reference string // payment terminal transaction reference
+}
+
+// paymentResult is the outcome of a PAY request, sent to the user interface.
+type paymentResult struct {
+	Accepted      bool
+	TransactionID string   // library system transaction id
+	Receipt       *receipt `json:",omitempty"`
+}
+
+// receipt is proof of a payment, shown in the UI and printed by the RFID
+// service.
+type receipt struct {
+	Time          time.Time
+	Automat       string
+	Patron        string
+	Amount        string
+	Currency      string
+	Reference     string // payment terminal
+	TransactionID string // library system
+}
+
+// String formats the receipt for printing, in the default language.
+func (r *receipt) String() string {
+	return r.text(defaultLanguage)
+}
+
+// text formats the receipt for printing, in lang.
+func (r *receipt) text(lang string) string {
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 8, 1, ' ', 0)
+	fmt.Fprintf(w, "%s\n", translate(lang, msgReceipt))
+	fmt.Fprintf(w, "%s %s\n", formatDate(lang, r.Time.Format(isoDate)), r.Time.Format("15:04:05"))
+	fmt.Fprintf(w, "%s:\t%s\n", translate(lang, msgReceiptAutomat), r.Automat)
+	fmt.Fprintf(w, "%s:\t%s\n", translate(lang, msgReceiptPatron), r.Patron)
+	fmt.Fprintf(w, "%s:\t%s %s\n", translate(lang, msgReceiptPaid), r.Amount, r.Currency)
+	fmt.Fprintf(w, "%s:\t%s\n", translate(lang, msgReceiptReference), r.Reference)
+	if r.TransactionID != "" {
+		fmt.Fprintf(w, "%s:\t%s\n", translate(lang, msgReceiptTransaction), r.TransactionID)
+	}
+	w.Flush()
+	return b.String()
+}
+
+// parseAmount parses a SIP amount ("25", "25.5", "25.50") into minor units.
+func parseAmount(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	whole, frac := s, ""
+	if i := strings.IndexAny(s, ".,"); i >= 0 {
+		whole, frac = s[:i], s[i+1:]
+	}
+	if len(frac) > 2 {
+		return 0, fmt.Errorf("invalid amount: %q", s)
+	}
+	frac += strings.Repeat("0", 2-len(frac))
+	neg := strings.HasPrefix(whole, "-")
+	whole = strings.TrimPrefix(whole, "-")
+	if whole == "" {
+		whole = "0"
+	}
+	w, err := strconv.Atoi(whole)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount: %q", s)
+	}
+	f, err := strconv.Atoi(frac)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount: %q", s)
+	}
+	n := w*100 + f
+	if neg {
+		n = -n
+	}
+	return n, nil
+}
+
+// formatAmount formats minor units as a SIP amount: "25.50"
+func formatAmount(n int) string {
+	sign := ""
+	if n < 0 {
+		sign, n = "-", -n
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, n/100, n%100)
+}
+
+// Payment terminals //////////////////////////////////////////////////////////
+
+// paymentTerminal is a card payment terminal attached to an automat.
+type paymentTerminal interface {
+	// Charge asks the patron to pay amount, and returns the terminal's
+	// transaction reference if approved.
+	Charge(amount int, currency string) (reference string, err error)
+
+	// Refund reverses a charge, i.e. when the library system did not
+	// accept the payment.
+	Refund(reference string) error
+}
+
+// errPaymentDeclined is returned by a terminal when the payment is declined
+var errPaymentDeclined = errors.New("payment declined")
+
+// newPaymentTerminal returns a terminal driver by name. An empty name means
+// the automat has no terminal.
+func newPaymentTerminal(driver string) (paymentTerminal, error) {
+	switch driver {
+	case "":
+		return nil, nil
+	case "stub":
+		return &stubTerminal{}, nil
+	}
+	return nil, fmt.Errorf("unknown payment terminal driver: %q", driver)
+}
+
+// stubTerminal approves every charge, without moving any money. For testing.
+type stubTerminal struct {
+	mu      sync.Mutex
+	n       int
+	Charged map[string]int
+	Decline bool // decline all charges
+}
+
+func (t *stubTerminal) Charge(amount int, currency string) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.Decline || amount <= 0 {
+		return "", errPaymentDeclined
+	}
+	t.n++
+	ref := fmt.Sprintf("STUB%06d", t.n)
+	if t.Charged == nil {
+		t.Charged = make(map[string]int)
+	}
+	t.Charged[ref] = amount
+	return ref, nil
+}
+
+func (t *stubTerminal) Refund(reference string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.Charged[reference]; !ok {
+		return fmt.Errorf("unknown transaction: %q", reference)
+	}
+	delete(t.Charged, reference)
+	return nil
+}
+
+// payFees charges the patron on the terminal and records the payment in the
+// library system. If the library system does not accept the payment, the
+// charge is refunded.
+func payFees(b Backend, t paymentTerminal, dept, automat, patron string, p payment) (*UIResponse, error) {
+	if t == nil {
+		return nil, errors.New("this automat has no payment terminal")
+	}
+	ref, err := t.Charge(p.Amount, p.Currency)
+	if err == errPaymentDeclined {
+		return &UIResponse{Action: "PAY", Patron: patron, Status: "DECLINED",
+			Payment: &paymentResult{Accepted: false}}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.Reference = ref
+
+	res, err := b.FeePaid(dept, patron, p)
+	if err == nil && (res.Payment == nil || !res.Payment.Accepted) {
+		err = fmt.Errorf("payment not accepted by library system: %s", res.Message)
+	}
+	if err != nil {
+		if rerr := t.Refund(ref); rerr != nil {
+			return nil, fmt.Errorf("%v; refund of %s failed: %v", err, ref, rerr)
+		}
+		return nil, err
+	}
+
+	res.Action = "PAY"
+	res.Payment.Receipt = &receipt{
+		Time:          time.Now(),
+		Automat:       automat,
+		Patron:        patron,
+		Amount:        formatAmount(p.Amount),
+		Currency:      p.Currency,
+		Reference:     ref,
+		TransactionID: res.Payment.TransactionID,
+	}
+	return res, nil
+}
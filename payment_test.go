@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/knakk/specs"
+)
+
+func TestAmounts(t *testing.T) {
+	s := specs.New(t)
+	tests := []struct {
+		in   string
+		want int
+	}{
+		{"", 0},
+		{"25", 2500},
+		{"25.5", 2550},
+		{"25,50", 2550},
+		{".75", 75},
+		{"-10.00", -1000},
+	}
+	for _, tt := range tests {
+		n, err := parseAmount(tt.in)
+		s.ExpectNil(err)
+		s.Expect(tt.want, n)
+	}
+	_, err := parseAmount("1.234")
+	s.Expect(true, err != nil)
+	_, err = parseAmount("abc")
+	s.Expect(true, err != nil)
+
+	s.Expect("25.50", formatAmount(2550))
+	s.Expect("0.05", formatAmount(5))
+	s.Expect("-10.00", formatAmount(-1000))
+}
+
+func TestSIPPatronFees(t *testing.T) {
+	s := specs.New(t)
+	res, err := authParse("64              01220140123    093212000000030003000200000000AOHUTL|AApatronid1|AEFillip Wahl|BLY|CQY|BHNOK|BV150.00|CC100.00|AVLate fee 50|AVLost item 100|\r")
+
+	s.ExpectNil(err)
+	s.Expect(true, res.Authenticated)
+	s.Expect("150.00", res.Fees.Amount)
+	s.Expect("NOK", res.Fees.Currency)
+	s.Expect(true, res.Fees.OverLimit)
+	s.Expect([]string{"Late fee 50", "Lost item 100"}, res.Fees.Items)
+}
+
+func TestPayFees(t *testing.T) {
+	s := specs.New(t)
+	p := &ConnPool{}
+	p.Init(1, fakeSIPResponse("38Y20140124    110740AOHUTL|AApatronid1|BKtx42|\r"))
+	term := &stubTerminal{}
+
+	res, err := payFees(&SIPBackend{pool: p}, term, "HUTL", "Maj1", "patronid1",
+		payment{Amount: 15000, Currency: "NOK", Type: paymentCreditCard})
+	s.ExpectNil(err)
+	s.Expect("PAY", res.Action)
+	s.Expect(true, res.Payment.Accepted)
+	s.Expect("tx42", res.Payment.TransactionID)
+	s.Expect("150.00", res.Payment.Receipt.Amount)
+	s.Expect(true, strings.Contains(res.Payment.Receipt.String(), "Betalt:    150.00 NOK"))
+	s.Expect(1, len(term.Charged))
+
+	// not accepted by the library system: refunded
+	p.Init(1, fakeSIPResponse("38N20140124    110740AOHUTL|AApatronid1|AFNo such fee|\r"))
+	_, err = payFees(&SIPBackend{pool: p}, term, "HUTL", "Maj1", "patronid1",
+		payment{Amount: 100, Currency: "NOK", Type: paymentCreditCard})
+	s.Expect(true, err != nil)
+	s.Expect(1, len(term.Charged))
+
+	// declined by the terminal
+	term.Decline = true
+	res, err = payFees(&SIPBackend{pool: p}, term, "HUTL", "Maj1", "patronid1",
+		payment{Amount: 100, Currency: "NOK", Type: paymentCreditCard})
+	s.ExpectNil(err)
+	s.Expect("DECLINED", res.Status)
+	s.Expect(false, res.Payment.Accepted)
+}
+
+func TestPayNoMoreThanOwed(t *testing.T) {
+	s := specs.New(t)
+	a := newTestAutomat()
+	a.Authenticated, a.Patron = true, "patronid1"
+	lastUI := func() UIResponse {
+		var res UIResponse
+		m, _ := a.ToUI.Get(nil)
+		json.Unmarshal(m, &res)
+		return res
+	}
+
+	// no fees
+	a.pay(UIRequest{Action: "PAY", Amount: "10.00"})
+	s.Expect("ERROR", lastUI().Action)
+
+	// overpayment, also of a single fee
+	a.Fees = &fees{Amount: "150.00", Currency: "NOK"}
+	a.pay(UIRequest{Action: "PAY", Amount: "150.01"})
+	s.Expect("150.01 is more than the fees owed, 150.00", lastUI().ErrorDetails)
+	a.pay(UIRequest{Action: "PAY", Amount: "200", FeeID: "fee1"})
+	s.Expect("ERROR", lastUI().Action)
+	s.Expect(0, len(a.sipJobs))
+
+	a.pay(UIRequest{Action: "PAY", Amount: "50.00", FeeID: "fee1"})
+	a.pay(UIRequest{Action: "PAY"})
+	s.Expect(2, len(a.sipJobs))
+	s.Expect(0, a.ToUI.Len())
+}
@@ -2,37 +2,70 @@ package main
 
 import (
 	"bufio"
+	"crypto/tls"
 	"errors"
-	"fmt"
 	"log"
 	"net"
 	"strings"
+	"sync"
+	"time"
 )
 
-// TODO monitoring? what if a connection is lost? how to detect?
+// Maximum number of connections in a pool
+const maxPoolSize = 64
+
+// How long connecting and logging in to the SIP server may take
+const sipDialTimeout = 10 * time.Second
+
+// How often to try replacing broken connections, while it fails
+const redialInterval = 10 * time.Second
 
 // ConnPool keeps a pool of <size> TCP connections
 type ConnPool struct {
-	size int
-	conn chan net.Conn
+	mu     sync.Mutex
+	size   int // connections, idle or in use
+	retire int // connections to close when released, after shrinking
+	conn   chan net.Conn
+	initFn InitFunction
+
+	resizing  sync.Mutex // one Resize or refill at a time
+	want      int        // configured size
+	refilling bool       // replacing broken connections
 }
 
 // InitFunction
 type InitFunction func(interface{}) (net.Conn, error)
 
-func initSIPConn(i interface{}) (net.Conn, error) {
-	conn, err := net.Dial("tcp", cfg.SIPServer)
+// sipDialer returns an InitFunction connecting and logging in to the SIP
+// server of c, with TLS if certs is given.
+func sipDialer(c *config, certs *certStore) InitFunction {
+	return func(i interface{}) (net.Conn, error) {
+		return initSIPConn(c, certs, i.(int))
+	}
+}
+
+func initSIPConn(cfg *config, certs *certStore, i int) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: sipDialTimeout}
+	if certs != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", cfg.SIPServer, certs.clientConfig(cfg.SIPServer))
+	} else {
+		conn, err = dialer.Dial("tcp", cfg.SIPServer)
+	}
 	if err != nil {
 		return nil, err
 	}
+	conn.SetDeadline(time.Now().Add(sipDialTimeout))
+	defer conn.SetDeadline(time.Time{})
 
-	out := fmt.Sprintf(sipMsg93, i.(int), i.(int))
+	out := sipFormMsgLogin(cfg, i)
 	_, err = conn.Write([]byte(out))
 	if err != nil {
 		log.Println("ERROR", err)
 		return nil, err
 	}
-	log.Println("-> SIP", strings.Trim(out, "\n\r"))
+	log.Println("-> SIP", strings.Trim(sipMasked(out), "\n\r"))
 
 	reader := bufio.NewReader(conn)
 	in, err := reader.ReadString('\r')
@@ -42,7 +75,7 @@ func initSIPConn(i interface{}) (net.Conn, error) {
 	}
 
 	// fail if response == 940 (success == 941)
-	if in[2] == '0' {
+	if len(in) < 3 || in[2] == '0' {
 		return nil, errors.New("SIP login failed")
 	}
 
@@ -53,7 +86,12 @@ func initSIPConn(i interface{}) (net.Conn, error) {
 
 // Init sets up <size> connections
 func (p *ConnPool) Init(size int, initFn InitFunction) {
-	p.conn = make(chan net.Conn, size)
+	if size > maxPoolSize {
+		size = maxPoolSize
+	}
+	p.conn = make(chan net.Conn, maxPoolSize)
+	p.initFn = initFn
+	p.want = size
 	var count = 0
 	for i := 1; i <= size; i++ {
 		conn, err := initFn(i)
@@ -66,10 +104,11 @@ func (p *ConnPool) Init(size int, initFn InitFunction) {
 	p.size = count
 }
 
-// NewSIPCOnnPool creates a new pool with <size> SIP connections
-func NewSIPConnPool(size int) *ConnPool {
+// NewSIPConnPool creates a new pool with the configured number of SIP
+// connections
+func NewSIPConnPool(c *config, certs *certStore) *ConnPool {
 	p := &ConnPool{}
-	p.Init(size, initSIPConn)
+	p.Init(c.NumSIPConnections, sipDialer(c, certs))
 	return p
 }
 
@@ -80,5 +119,110 @@ func (p *ConnPool) Get() net.Conn {
 
 // Release returns the connection back to the pool
 func (p *ConnPool) Release(c net.Conn) {
+	p.mu.Lock()
+	if p.retire > 0 {
+		p.retire--
+		p.size--
+		p.mu.Unlock()
+		c.Close()
+		return
+	}
+	p.mu.Unlock()
 	p.conn <- c
 }
+
+// Discard closes a broken connection instead of returning it to the pool.
+// A new one is dialed in the background.
+func (p *ConnPool) Discard(c net.Conn) {
+	c.Close()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.size--
+	if p.retire > 0 {
+		p.retire--
+		return
+	}
+	if !p.refilling {
+		p.refilling = true
+		go p.refill()
+	}
+}
+
+// refill dials connections until the pool is back at its configured size.
+func (p *ConnPool) refill() {
+	for {
+		p.resizing.Lock()
+		p.mu.Lock()
+		want := p.want
+		p.mu.Unlock()
+		p.grow(want)
+		p.resizing.Unlock()
+
+		p.mu.Lock()
+		if p.size >= p.want {
+			p.refilling = false
+			p.mu.Unlock()
+			return
+		}
+		p.mu.Unlock()
+		time.Sleep(redialInterval)
+	}
+}
+
+// Resize grows or shrinks the pool to <size> connections. Idle connections
+// are closed at once, connections in use when they are released. New
+// connections are dialed without holding the lock, so Get and Release
+// carry on meanwhile.
+func (p *ConnPool) Resize(size int) {
+	if size > maxPoolSize {
+		size = maxPoolSize
+	}
+	p.resizing.Lock()
+	defer p.resizing.Unlock()
+
+	p.mu.Lock()
+	p.want = size
+	for p.size-p.retire < size && p.retire > 0 {
+		p.retire--
+	}
+	p.mu.Unlock()
+	p.grow(size)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for p.size-p.retire > size {
+		select {
+		case c := <-p.conn:
+			c.Close()
+			p.size--
+		default:
+			p.retire++
+		}
+	}
+}
+
+// grow dials connections until there are <size>. The caller holds
+// p.resizing.
+func (p *ConnPool) grow(size int) {
+	p.mu.Lock()
+	next := p.size + 1
+	p.mu.Unlock()
+	for ; next <= size; next++ {
+		conn, err := p.initFn(next)
+		if err != nil {
+			log.Println("ERROR", "growing connection pool:", err)
+			return
+		}
+		p.mu.Lock()
+		p.size++
+		p.mu.Unlock()
+		p.conn <- conn
+	}
+}
+
+// Size returns the number of connections in the pool.
+func (p *ConnPool) Size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.size - p.retire
+}
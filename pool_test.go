@@ -77,3 +77,94 @@ func TestConnectionPool(t *testing.T) {
 	}
 
 }
+
+func TestConnectionPoolResize(t *testing.T) {
+	s := specs.New(t)
+
+	p := &ConnPool{}
+	p.Init(2, initFakeConn)
+	inUse := p.Get()
+
+	p.Resize(4)
+	s.Expect(4, p.Size())
+	s.Expect(3, len(p.conn))
+
+	// idle connections are closed at once, those in use when released
+	inUse2 := p.Get()
+	p.Resize(1)
+	s.Expect(1, p.Size())
+	s.Expect(0, len(p.conn))
+	p.Release(inUse)
+	s.Expect(1, p.size)
+	s.Expect(0, len(p.conn))
+	p.Release(inUse2)
+	s.Expect(1, len(p.conn))
+
+	p.Resize(2)
+	s.Expect(2, p.Size())
+	s.Expect(2, len(p.conn))
+}
+
+func TestConnectionPoolResizeDoesNotBlockRelease(t *testing.T) {
+	s := specs.New(t)
+
+	dialing := make(chan bool)
+	p := &ConnPool{}
+	p.Init(1, func(i interface{}) (net.Conn, error) {
+		if i.(int) > 1 {
+			<-dialing // a slow SIP server
+		}
+		return initFakeConn(i)
+	})
+	c := p.Get()
+	go p.Resize(2)
+	time.Sleep(10 * time.Millisecond)
+
+	released := make(chan bool)
+	go func() {
+		p.Release(c)
+		close(released)
+	}()
+	select {
+	case <-released:
+	case <-time.After(time.Second):
+		t.Fatal("Release blocked while Resize was dialing")
+	}
+	s.Expect(1, p.Size())
+	close(dialing)
+	p.Get()
+	p.Get()
+	s.Expect(2, p.Size())
+}
+
+func TestConnectionPoolReplacesBroken(t *testing.T) {
+	s := specs.New(t)
+
+	p := &ConnPool{}
+	p.Init(1, initFakeConn)
+	echo := func(s string) (*UIResponse, error) { return &UIResponse{Message: s}, nil }
+
+	res, err := DoSIPCall(p, "99\r", echo)
+	s.ExpectNil(err)
+	s.Expect("result #1\r", res.Message)
+
+	// the connection has nothing more to read: closed, and redialed
+	_, err = DoSIPCall(p, "99\r", echo)
+	s.Expect(io.EOF, err)
+	for i := 0; i < 100 && len(p.conn) == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	s.Expect(1, p.Size())
+	res, err = DoSIPCall(p, "99\r", echo)
+	s.ExpectNil(err)
+	s.Expect("result #1\r", res.Message)
+
+	// not replaced when the pool was shrunk meanwhile
+	c := p.Get()
+	p.Resize(0)
+	p.Discard(c)
+	s.Expect(0, p.Size())
+	p.mu.Lock()
+	s.Expect(false, p.refilling)
+	p.mu.Unlock()
+}
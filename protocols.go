@@ -11,8 +11,15 @@ type RFIDRequest struct {
 	ReaderID string
 	TagID    string
 	Barcode  string
+	Bin      int // sorter bin, for Command "SORTER"
 }
 
+// RFID request commands, other than item reads (empty Command)
+const (
+	rfidCmdSorter     = "SORTER"      // sorter event
+	rfidCmdPatronCard = "PATRON-CARD" // library card read; card number in Barcode
+)
+
 // reponse message from RFID-reader
 type RFIDResponse struct {
 	Command  string
@@ -47,6 +54,9 @@ type UIRequest struct {
 	Action   string
 	Username string
 	PIN      string
+	Language string // SET_LANGUAGE: nb, nn or en
+	Amount   string // PAY: amount to pay, i.e. "25.00"
+	FeeID    string // PAY: fee to pay, if not all
 }
 
 // response from the state machine to UI
@@ -58,23 +68,116 @@ type UIResponse struct {
 	Message       string
 	ErrorDetails  string
 	Item          item
+	Reason        string         `json:",omitempty"` // LOGIN: why not authenticated; see login* codes
+	Blocks        []string       `json:",omitempty"` // LOGIN: restrictions on the patron; see block* codes
+	Fees          *fees          `json:",omitempty"`
+	Payment       *paymentResult `json:",omitempty"`
 	// Loans         []item
 	// Holdings      []item
 }
 
+// session state sent to a user interface when it (re)connects
+type UISnapshot struct {
+	Action        string // "SNAPSHOT"
+	Mode          string // WAITING, CHECKIN, CHECKOUT, STATUS, MAINTENANCE, CLOSED
+	Authenticated bool
+	Patron        string
+	Fees          *fees `json:",omitempty"`
+	Checkins      []item
+	Checkouts     []item
+	Language      string
+	Hours         string // opening hours mode: open, return-only or closed
+	Message       string `json:",omitempty"` // out of order, closed or return-only: notice for patrons
+}
+
+// UIAnnouncements gives a user interface the announcements to show, highest
+// priority first. It replaces those sent before.
+type UIAnnouncements struct {
+	Action        string // "ANNOUNCEMENTS"
+	Announcements []announcement
+}
+
+// UILanguage gives a user interface the texts of the language of the
+// session.
+type UILanguage struct {
+	Action   string // "LANGUAGE"
+	Language string
+	Texts    map[string]string
+}
+
 type item struct {
 	Title  string // [bok] Forfatter - tittel
-	Status string // forfaller 10/03/2013
+	Status string // forfaller 10/03/2013; made from Event by the automat
 	OK     bool   // false = mangler brikke / klarte ikke lese den
+	Event  string `json:",omitempty"` // see event* codes
+	Date   string `json:",omitempty"` // of the Event, YYYY-MM-DD
+
+	// Set by item information lookups
+	Barcode    string   `json:",omitempty"`
+	CircStatus string   `json:",omitempty"` // SIP circulation status, 01-13
+	MediaType  string   `json:",omitempty"` // SIP media type, 000-010
+	HoldQueue  int      `json:",omitempty"` // number of holds on the item
+	HoldPatron string   `json:"-"`          // patron the item is waiting for
+	Location   string   `json:",omitempty"` // permanent location
+	Reason     string   `json:",omitempty"` // why OK is false; see reason* codes
+	Warnings   []string `json:",omitempty"` // see warn* codes
+
+	// Set on checkin
+	Routing *checkinRouting `json:",omitempty"`
 }
 
-func ErrorResponse(errMsg error) []byte {
-	b, err := json.Marshal(&UIResponse{
+// Reason codes for refused transactions, and warnings for transactions that
+// went ahead. The user interface translates these into instructions.
+const (
+	reasonUnknownItem     = "UNKNOWN_ITEM"
+	reasonReferenceOnly   = "REFERENCE_ONLY"
+	reasonOnHoldForOther  = "ON_HOLD_FOR_OTHER"
+	reasonNotAvailable    = "NOT_AVAILABLE"
+	reasonInTransit       = "IN_TRANSIT"
+	reasonLost            = "LOST"
+	reasonMissing         = "MISSING"
+	reasonClaimedReturned = "CLAIMED_RETURNED"
+
+	warnHoldQueue  = "HOLD_QUEUE" // others are waiting; loan can't be renewed
+	warnOnHold     = "ON_HOLD"    // on the hold shelf, maybe for this patron
+	warnCheckedOut = "ON_LOAN"    // already on loan
+)
+
+// ErrorResponse tells the user interface something went wrong, in lang.
+func ErrorResponse(lang string, errMsg error) []byte {
+	b, _ := json.Marshal(&UIResponse{
 		Action:       "ERROR",
-		Message:      "Noe gikk galt, det er ikke din feil!",
+		Message:      translate(lang, msgError),
 		ErrorDetails: errMsg.Error()})
-	if err != nil {
-		return []byte(`{"Action": "ERROR", "Message": "something went wrong, not your fault!", "ErrorDetails": "kuk i kompjuderen"}`)
-	}
 	return b
 }
+
+// Reasons a LOGIN failed
+const (
+	loginInvalidPatron = "INVALID_PATRON" // no such patron
+	loginWrongPIN      = "WRONG_PIN"
+	loginCardLost      = "CARD_LOST"    // card reported lost; must see staff
+	loginCardExpired   = "CARD_EXPIRED" // card expired (PA); must see staff to renew it
+	loginLocked        = "LOCKED"       // too many failed logins; try again later
+)
+
+// Restrictions on a logged in patron. Decoded from the patron status field
+// of the Patron Information Response (64).
+const (
+	blockChargeDenied   = "CHARGE_DENIED"
+	blockRenewalDenied  = "RENEWAL_DENIED"
+	blockRecallDenied   = "RECALL_DENIED"
+	blockHoldDenied     = "HOLD_DENIED"
+	blockCardLost       = "CARD_LOST"
+	blockTooManyItems   = "TOO_MANY_ITEMS"
+	blockTooManyOverdue = "TOO_MANY_OVERDUE"
+	blockTooManyRenewal = "TOO_MANY_RENEWALS"
+	blockTooManyClaims  = "TOO_MANY_CLAIMS"
+	blockTooManyLost    = "TOO_MANY_LOST"
+	blockExcessiveFines = "EXCESSIVE_FINES"
+	blockExcessiveFees  = "EXCESSIVE_FEES"
+	blockRecallOverdue  = "RECALL_OVERDUE"
+	blockTooManyBilled  = "TOO_MANY_BILLED"
+	blockCardExpired    = "CARD_EXPIRED"
+	blockFeeLimit       = "FEE_LIMIT" // fees over the limit (BV >= CC)
+)
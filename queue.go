@@ -0,0 +1,183 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+)
+
+// Priority of an outbound message. High priority messages are delivered
+// before normal ones, and are the last to be dropped when a queue is full.
+type priority uint8
+
+const (
+	prioNormal priority = iota
+	prioHigh
+)
+
+// What to do when a message is pushed onto a full queue.
+type queuePolicy uint8
+
+const (
+	// Discard the oldest message of the lowest priority present.
+	dropOldest queuePolicy = iota
+
+	// Keep the message, but mark the queue as overflowed. The reader can
+	// watch Overflow() and treat the peer as too slow (i.e. disconnect).
+	overflow
+)
+
+// outQueue is a bounded, prioritized queue of outbound messages to one peer
+// (RFID service or user interface). Pushing never blocks, so the automat
+// state machine can never be stalled by a slow or absent peer.
+type outQueue struct {
+	name   string
+	limit  int
+	policy queuePolicy
+
+	mu         sync.Mutex
+	high       [][]byte
+	normal     [][]byte
+	closed     bool
+	overflowed bool
+
+	ready chan bool // holds a value when the queue is non-empty
+	done  chan bool // closed when the queue is closed
+	over  chan bool // closed on first overflow (policy overflow only)
+}
+
+// newOutQueue returns a queue holding at most <limit> messages.
+func newOutQueue(name string, limit int, policy queuePolicy) *outQueue {
+	return &outQueue{
+		name:   name,
+		limit:  limit,
+		policy: policy,
+		ready:  make(chan bool, 1),
+		done:   make(chan bool),
+		over:   make(chan bool),
+	}
+}
+
+// Push adds a message to the queue. It returns false if a message had to be
+// dropped to make room (or the queue is closed).
+func (q *outQueue) Push(msg []byte, p priority) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return false
+	}
+
+	ok := true
+	if len(q.high)+len(q.normal) >= q.limit {
+		switch q.policy {
+		case dropOldest:
+			q.dropOne()
+		case overflow:
+			if !q.overflowed {
+				q.overflowed = true
+				close(q.over)
+			}
+		}
+		ok = false
+	}
+
+	if p == prioHigh {
+		q.high = append(q.high, msg)
+	} else {
+		q.normal = append(q.normal, msg)
+	}
+	q.signal()
+	return ok
+}
+
+// PushFront puts a message back at the head of the queue, i.e. after a
+// failed write. It is never dropped.
+func (q *outQueue) PushFront(msg []byte) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+	q.high = append([][]byte{msg}, q.high...)
+	q.signal()
+}
+
+// Get returns the next message, blocking until one is available. It returns
+// false if the queue is closed or cancel is closed.
+func (q *outQueue) Get(cancel <-chan bool) ([]byte, bool) {
+	for {
+		if msg, ok := q.pop(); ok {
+			return msg, true
+		}
+		select {
+		case <-q.ready:
+		case <-q.done:
+			return nil, false
+		case <-cancel:
+			return nil, false
+		}
+	}
+}
+
+// Len returns the number of queued messages.
+func (q *outQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.high) + len(q.normal)
+}
+
+// Overflow returns a channel which is closed when a queue with the overflow
+// policy exceeds its limit.
+func (q *outQueue) Overflow() <-chan bool {
+	return q.over
+}
+
+// Close closes the queue, releasing any readers blocked in Get.
+func (q *outQueue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+	q.closed = true
+	q.high, q.normal = nil, nil
+	close(q.done)
+}
+
+func (q *outQueue) pop() ([]byte, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var msg []byte
+	switch {
+	case len(q.high) > 0:
+		msg, q.high = q.high[0], q.high[1:]
+	case len(q.normal) > 0:
+		msg, q.normal = q.normal[0], q.normal[1:]
+	default:
+		return nil, false
+	}
+	if len(q.high)+len(q.normal) > 0 {
+		q.signal()
+	}
+	return msg, true
+}
+
+// dropOne discards the oldest message of the lowest priority. Must be called
+// with q.mu held.
+func (q *outQueue) dropOne() {
+	var msg []byte
+	if len(q.normal) > 0 {
+		msg, q.normal = q.normal[0], q.normal[1:]
+	} else {
+		msg, q.high = q.high[0], q.high[1:]
+	}
+	log.Println("WARN", q.name, "queue full, dropping:", strings.TrimRight(string(msg), "\n"))
+}
+
+// signal wakes up a reader. Must be called with q.mu held.
+func (q *outQueue) signal() {
+	select {
+	case q.ready <- true:
+	default:
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/knakk/specs"
+)
+
+func TestOutQueuePriority(t *testing.T) {
+	s := specs.New(t)
+	q := newOutQueue("test", 10, dropOldest)
+
+	q.Push([]byte("a"), prioNormal)
+	q.Push([]byte("b"), prioHigh)
+	q.Push([]byte("c"), prioNormal)
+
+	for _, want := range []string{"b", "a", "c"} {
+		msg, ok := q.Get(nil)
+		s.Expect(true, ok)
+		s.Expect(want, string(msg))
+	}
+}
+
+func TestOutQueuePolicies(t *testing.T) {
+	s := specs.New(t)
+
+	q := newOutQueue("test", 2, dropOldest)
+	s.Expect(true, q.Push([]byte("a"), prioHigh))
+	s.Expect(true, q.Push([]byte("b"), prioNormal))
+	s.Expect(false, q.Push([]byte("c"), prioNormal))
+	// the oldest normal message goes first
+	s.Expect(false, q.Push([]byte("d"), prioNormal))
+	s.Expect(2, q.Len())
+	msg, _ := q.Get(nil)
+	s.Expect("a", string(msg))
+	msg, _ = q.Get(nil)
+	s.Expect("d", string(msg))
+
+	q = newOutQueue("test", 1, overflow)
+	q.Push([]byte("a"), prioNormal)
+	select {
+	case <-q.Overflow():
+		t.Fatal("overflow signalled too early")
+	default:
+	}
+	q.Push([]byte("b"), prioNormal)
+	select {
+	case <-q.Overflow():
+	default:
+		t.Fatal("overflow not signalled")
+	}
+	s.Expect(2, q.Len())
+}
+
+func TestOutQueueClose(t *testing.T) {
+	s := specs.New(t)
+	q := newOutQueue("test", 2, dropOldest)
+
+	done := make(chan bool)
+	go func() {
+		_, ok := q.Get(nil)
+		done <- ok
+	}()
+	q.Close()
+	s.Expect(false, <-done)
+	s.Expect(false, q.Push([]byte("a"), prioNormal))
+
+	cancel := make(chan bool)
+	close(cancel)
+	q = newOutQueue("test", 2, dropOldest)
+	_, ok := q.Get(cancel)
+	s.Expect(false, ok)
+}
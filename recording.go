@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Recordings of automat sessions. Everything going in and out of the state
+// machine is written to a file, one JSON event per line, so that a session
+// can be replayed later; see replay.
+
+// Kinds of recorded events
+const (
+	recStart     = "START"      // recording started; Data is a recSetup, State the session
+	recConfig    = "CONFIG"     // new configuration applied
+	recRFIDIn    = "RFID-IN"    // message from the RFID service
+	recRFIDOut   = "RFID-OUT"   // command to the RFID service
+	recUIIn      = "UI-IN"      // message from the user interface
+	recUIOut     = "UI-OUT"     // message to the user interface
+	recUIConnect = "UI-CONNECT" // user interface (re)connected
+	recSorter    = "SORTER"     // event from the sorting machine
+	recSIPReq    = "SIP-REQ"    // library system request, i.e. "Checkout HUTL patron1 0301..."
+	recSIPResp   = "SIP-RESP"   // library system response, JSON
+	recResult    = "RESULT"     // SIP result applied by the state machine, JSON
+	recHours     = "HOURS"      // opening hours mode changed
+	recNews      = "NEWS"       // announcements changed, JSON
+)
+
+// recSetup is what an automat was set up with, recorded in the START event.
+type recSetup struct {
+	Automat                automat
+	ItemInfoBeforeCheckout bool
+	ReferenceOnlyLocations []string
+}
+
+// recEvent is a recorded event.
+type recEvent struct {
+	Time  time.Time
+	Kind  string
+	Data  string
+	Error string `json:",omitempty"` // SIP-RESP and RESULT: the request failed
+	State string `json:",omitempty"` // START: session snapshot
+}
+
+// input reports if the event is something the state machine reacts to.
+func (e recEvent) input() bool {
+	switch e.Kind {
+	case recRFIDIn, recUIIn, recUIConnect, recSorter, recResult, recConfig, recHours, recNews:
+		return true
+	}
+	return false
+}
+
+// recorder records the events of an automat. It is off until started, and
+// safe to use from several goroutines.
+type recorder struct {
+	mu   sync.Mutex
+	sink func(recEvent) // nil when off
+	done func()
+	now  func() time.Time
+}
+
+func newRecorder() *recorder {
+	return &recorder{now: time.Now}
+}
+
+// recording reports if the recorder is on.
+func (r *recorder) recording() bool {
+	if r == nil {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.sink != nil
+}
+
+// start records to sink, until stop. done is called on stop.
+func (r *recorder) start(sink func(recEvent), done func()) {
+	r.stop()
+	r.mu.Lock()
+	r.sink, r.done = sink, done
+	r.mu.Unlock()
+}
+
+// startFile records to a new file in dir, named after the automat.
+func (r *recorder) startFile(dir, name string) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	name = strings.NewReplacer(":", "_", "/", "_", " ", "_").Replace(name)
+	file := filepath.Join(dir, fmt.Sprintf("%s-%s.jsonl", name, r.now().Format("20060102-150405")))
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return "", err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	r.start(func(e recEvent) {
+		if err := enc.Encode(e); err != nil {
+			log.Println("ERROR", "recording to", file, err)
+		}
+		w.Flush()
+	}, func() { f.Close() })
+	return file, nil
+}
+
+// stop stops recording.
+func (r *recorder) stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.done != nil {
+		r.done()
+	}
+	r.sink, r.done = nil, nil
+}
+
+// record records an event, if recording.
+func (r *recorder) record(e recEvent) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.sink == nil {
+		return
+	}
+	e.Time = r.now()
+	r.sink(e)
+}
+
+func (r *recorder) event(kind string, data []byte) {
+	r.record(recEvent{Kind: kind, Data: strings.TrimRight(string(data), "\n")})
+}
+
+// result records a response or result, and its error.
+func (r *recorder) result(kind string, res *UIResponse, err error) {
+	if !r.recording() {
+		return
+	}
+	e := recEvent{Kind: kind}
+	if err != nil {
+		e.Error = err.Error()
+	} else {
+		b, _ := json.Marshal(res)
+		e.Data = string(b)
+	}
+	r.record(e)
+}
+
+// maskPIN hides the PIN of a message from the user interface, so that
+// recordings hold no PINs.
+func maskPIN(msg []byte) []byte {
+	var req UIRequest
+	if err := json.Unmarshal(msg, &req); err != nil || req.PIN == "" {
+		return msg
+	}
+	req.PIN = "****"
+	b, _ := json.Marshal(req)
+	return b
+}
+
+// loadRecording reads a recording.
+func loadRecording(file string) ([]recEvent, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var events []recEvent
+	dec := json.NewDecoder(f)
+	for dec.More() {
+		var e recEvent
+		if err := dec.Decode(&e); err != nil {
+			return nil, fmt.Errorf("%s: event %d: %v", file, len(events)+1, err)
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+// recordingBackend records the requests to a library system, and its
+// responses. In a replay, answer gives the recorded responses instead of
+// asking the Backend.
+type recordingBackend struct {
+	Backend
+	rec    *recorder
+	answer func(req string) (*UIResponse, error)
+}
+
+func (b *recordingBackend) call(req string, f func() (*UIResponse, error)) (*UIResponse, error) {
+	b.rec.record(recEvent{Kind: recSIPReq, Data: req})
+	var (
+		res *UIResponse
+		err error
+	)
+	if b.answer != nil {
+		res, err = b.answer(req)
+	} else {
+		res, err = f()
+	}
+	b.rec.result(recSIPResp, res, err)
+	return res, err
+}
+
+func (b *recordingBackend) Authenticate(dept, username, pin string) (*UIResponse, error) {
+	return b.call(fmt.Sprintf("Authenticate %s %s ****", dept, username), func() (*UIResponse, error) {
+		return b.Backend.Authenticate(dept, username, pin)
+	})
+}
+
+func (b *recordingBackend) Checkin(dept, barcode string) (*UIResponse, error) {
+	return b.call(fmt.Sprintf("Checkin %s %s", dept, barcode), func() (*UIResponse, error) {
+		return b.Backend.Checkin(dept, barcode)
+	})
+}
+
+func (b *recordingBackend) Checkout(dept, username, barcode string) (*UIResponse, error) {
+	return b.call(fmt.Sprintf("Checkout %s %s %s", dept, username, barcode), func() (*UIResponse, error) {
+		return b.Backend.Checkout(dept, username, barcode)
+	})
+}
+
+func (b *recordingBackend) PatronInfo(dept, username string) (*UIResponse, error) {
+	return b.call(fmt.Sprintf("PatronInfo %s %s", dept, username), func() (*UIResponse, error) {
+		return b.Backend.PatronInfo(dept, username)
+	})
+}
+
+func (b *recordingBackend) Renew(dept, username, barcode string) (*UIResponse, error) {
+	return b.call(fmt.Sprintf("Renew %s %s %s", dept, username, barcode), func() (*UIResponse, error) {
+		return b.Backend.Renew(dept, username, barcode)
+	})
+}
+
+func (b *recordingBackend) ItemInfo(dept, barcode string) (*UIResponse, error) {
+	return b.call(fmt.Sprintf("ItemInfo %s %s", dept, barcode), func() (*UIResponse, error) {
+		return b.Backend.ItemInfo(dept, barcode)
+	})
+}
+
+func (b *recordingBackend) FeePaid(dept, username string, p payment) (*UIResponse, error) {
+	return b.call(fmt.Sprintf("FeePaid %s %s %s %s", dept, username, formatAmount(p.Amount), p.FeeID), func() (*UIResponse, error) {
+		return b.Backend.FeePaid(dept, username, p)
+	})
+}
+
+func (b *recordingBackend) EndSession(dept, username string) (*UIResponse, error) {
+	return b.call(fmt.Sprintf("EndSession %s %s", dept, username), func() (*UIResponse, error) {
+		return b.Backend.EndSession(dept, username)
+	})
+}
+
+func (b *recordingBackend) BlockPatron(dept, username, msg string) (*UIResponse, error) {
+	return b.call(fmt.Sprintf("BlockPatron %s %s %s", dept, username, msg), func() (*UIResponse, error) {
+		return b.Backend.BlockPatron(dept, username, msg)
+	})
+}
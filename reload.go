@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// How often the config file is checked for changes
+const configCheckInterval = 5 * time.Second
+
+// watchConfig reloads the config file when it changes, or on SIGHUP.
+func (app *App) watchConfig(file string, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	mod := fileModTime(file)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-app.quit:
+			return
+		case <-hup:
+			log.Println("INFO", "SIGHUP: reloading", file)
+		case <-ticker.C:
+			m := fileModTime(file)
+			if !m.After(mod) {
+				continue
+			}
+			mod = m
+			log.Println("INFO", file, "changed: reloading")
+		}
+		if err := app.reloadConfig(file); err != nil {
+			log.Println("ERROR", "config not reloaded:", err)
+		}
+	}
+}
+
+func fileModTime(file string) time.Time {
+	fi, err := os.Stat(file)
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
+
+// reloadConfig reads and validates the config file, and applies it. Connected
+// automats keep their sessions. Settings which can't change while running
+// are kept until restart.
+func (app *App) reloadConfig(file string) error {
+	app.confMu.Lock()
+	defer app.confMu.Unlock()
+
+	n, errs := loadConfig(file, os.LookupEnv)
+	if len(errs) > 0 {
+		msgs := make([]string, len(errs))
+		for i, err := range errs {
+			msgs[i] = err.Error()
+		}
+		return errors.New(strings.Join(msgs, "; "))
+	}
+
+	c, restart := app.server.config().reloaded(n)
+	if len(restart) > 0 {
+		log.Println("WARN", "changed settings take effect on restart:", strings.Join(restart, ", "))
+	}
+	if app.logOutput != nil {
+		if err := app.logOutput.setLevel(c.logLevel()); err != nil {
+			return err
+		}
+	}
+	if app.sipPool != nil && app.sipPool.Size() != c.NumSIPConnections {
+		log.Println("INFO", "Resizing SIP Connection pool to:", c.NumSIPConnections)
+		app.sipPool.Resize(c.NumSIPConnections)
+	}
+	app.stats.SetClientsKnown(len(c.Automats))
+	app.server.reconfigure(app.withMaintenance(c))
+	log.Println("INFO", "config reloaded:", len(c.Automats), "automats")
+	return nil
+}
+
+// maintenanceOverride is the maintenance flag of an automat as set with the
+// admin endpoint. It takes precedence over the config file until restart.
+type maintenanceOverride struct {
+	On      bool
+	Message string
+}
+
+// withMaintenance returns c with the maintenance overrides applied.
+func (app *App) withMaintenance(c *config) *config {
+	if len(app.maintenance) == 0 {
+		return c
+	}
+	r := *c
+	r.Automats = make([]automat, len(c.Automats))
+	for i, a := range c.Automats {
+		if o, ok := app.maintenance[a.IP]; ok {
+			a.Maintenance, a.MaintenanceMessage = o.On, o.Message
+		}
+		r.Automats[i] = a
+	}
+	return &r
+}
+
+// setMaintenance takes the automat with the given name or IP out of order,
+// or back in service, and applies it to the running config.
+func (app *App) setMaintenance(automat string, o maintenanceOverride) error {
+	app.confMu.Lock()
+	defer app.confMu.Unlock()
+
+	c := app.server.config()
+	for _, a := range c.Automats {
+		if a.IP == automat || a.Name == automat {
+			app.maintenance[a.IP] = o
+			app.server.reconfigure(app.withMaintenance(c))
+			return nil
+		}
+	}
+	return fmt.Errorf("no automat %q in config", automat)
+}
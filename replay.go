@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+// Replay of recorded automat sessions. The recorded inputs are fed to a new
+// state machine one at a time, with the library system answering from the
+// recording, and what the state machine does is compared to the recording.
+// Replays are deterministic: SIP requests are performed at the point where
+// their result was applied in the recording.
+//
+// The login guard is not replayed, so logins refused as locked show up as
+// differences.
+
+// replayDiff is a recorded input after which the replay did something else
+// than the recording.
+type replayDiff struct {
+	N        int // number of the event in the recording, from 1
+	Input    recEvent
+	Expected []string // events recorded after the input
+	Got      []string // events in the replay
+}
+
+// replayReport is the outcome of a replay.
+type replayReport struct {
+	Events int
+	Inputs int
+	Diffs  []replayDiff
+}
+
+// errNotRecorded answers library system requests not in the recording.
+var errNotRecorded = errors.New("replay: request not in recording")
+
+// recordedAnswers returns the library system responses of a recording, in
+// the order they were requested.
+func recordedAnswers(events []recEvent) func(req string) (*UIResponse, error) {
+	type answer struct {
+		req  string
+		resp recEvent
+	}
+	var answers []answer
+	for i, e := range events {
+		if e.Kind != recSIPReq {
+			continue
+		}
+		// the response is the next one; SIP requests are performed one at a time
+		for _, r := range events[i+1:] {
+			if r.Kind == recSIPResp {
+				answers = append(answers, answer{e.Data, r})
+				break
+			}
+		}
+	}
+	return func(req string) (*UIResponse, error) {
+		if len(answers) == 0 || answers[0].req != req {
+			return nil, errNotRecorded
+		}
+		a := answers[0]
+		answers = answers[1:]
+		return decodeResult(a.resp)
+	}
+}
+
+// decodeResult returns the response or result of a recorded event.
+func decodeResult(e recEvent) (*UIResponse, error) {
+	if e.Error != "" {
+		return nil, errors.New(e.Error)
+	}
+	var res UIResponse
+	if err := json.Unmarshal([]byte(e.Data), &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+func (e recEvent) String() string {
+	if e.Error != "" {
+		return e.Kind + " ERROR " + e.Error
+	}
+	return e.Kind + " " + e.Data
+}
+
+// replay replays a recording.
+func replay(events []recEvent) (*replayReport, error) {
+	if len(events) == 0 || events[0].Kind != recStart {
+		return nil, errors.New("replay: recording does not begin with a START event")
+	}
+	var setup recSetup
+	if err := json.Unmarshal([]byte(events[0].Data), &setup); err != nil {
+		return nil, fmt.Errorf("replay: START: %v", err)
+	}
+
+	c, _ := net.Pipe()
+	a := newAutomat(c)
+	a.IP = setup.Automat.IP
+	a.replaying = true
+	a.checkItems = setup.ItemInfoBeforeCheckout
+	a.refOnly = setup.ReferenceOnlyLocations
+	var got []recEvent
+	a.rec.start(func(e recEvent) { got = append(got, e) }, nil)
+	a.backend = &recordingBackend{rec: a.rec, answer: recordedAnswers(events)}
+	setup.Automat.Record = true // keeps the recorder on
+	a.configure(setup.Automat)
+
+	var snap UISnapshot
+	if err := json.Unmarshal([]byte(events[0].State), &snap); err != nil {
+		return nil, fmt.Errorf("replay: START: %v", err)
+	}
+	a.State = parseUIState(snap.Mode)
+	a.Authenticated, a.Patron, a.Fees = snap.Authenticated, snap.Patron, snap.Fees
+	a.Checkins, a.Checkouts = snap.Checkins, snap.Checkouts
+	if snap.Language != "" {
+		a.lang = snap.Language
+	}
+
+	r := &replayReport{Events: len(events)}
+	for i, e := range events {
+		if !e.input() {
+			continue
+		}
+		r.Inputs++
+		got = nil
+		if err := a.replayInput(e); err != nil {
+			got = append(got, recEvent{Kind: e.Kind, Error: err.Error()})
+		}
+		want := replayed(append([]recEvent{e}, outputsAfter(events[i+1:])...))
+		have := replayed(got)
+		if strings.Join(want, "\n") != strings.Join(have, "\n") {
+			r.Diffs = append(r.Diffs, replayDiff{N: i + 1, Input: e, Expected: want, Got: have})
+		}
+		// nobody reads the queues in a replay
+		for a.ToUI.Len() > 0 {
+			a.ToUI.Get(nil)
+		}
+		for a.ToRFID.Len() > 0 {
+			a.ToRFID.Get(nil)
+		}
+	}
+	return r, nil
+}
+
+// replayInput feeds a recorded input to the state machine, as run would.
+func (a *Automat) replayInput(e recEvent) error {
+	switch e.Kind {
+	case recRFIDIn:
+		a.handleRFID([]byte(e.Data))
+	case recUIIn:
+		a.handleUI([]byte(e.Data))
+	case recUIConnect:
+		a.greetUI()
+	case recSorter:
+		var ev sorterEvent
+		if err := json.Unmarshal([]byte(e.Data), &ev); err != nil {
+			return err
+		}
+		a.rec.event(recSorter, []byte(e.Data))
+		a.handleSorterEvent(ev)
+	case recConfig:
+		var ac automat
+		if err := json.Unmarshal([]byte(e.Data), &ac); err != nil {
+			return err
+		}
+		a.configure(ac)
+	case recHours:
+		a.setHours(e.Data)
+	case recNews:
+		var n []announcement
+		if err := json.Unmarshal([]byte(e.Data), &n); err != nil {
+			return err
+		}
+		a.setNews(n)
+	case recResult:
+		select {
+		case j := <-a.sipJobs:
+			res, err := j.call()
+			a.handleSIPResult(sipResult{job: j, res: res, err: err})
+		default:
+			return errors.New("no SIP request waiting for this result")
+		}
+	}
+	return nil
+}
+
+// outputsAfter returns the outputs of the state machine up to the next
+// input.
+func outputsAfter(events []recEvent) []recEvent {
+	var out []recEvent
+	for _, e := range events {
+		if e.input() {
+			break
+		}
+		out = append(out, e)
+	}
+	return out
+}
+
+// replayed returns the events to compare. SIP requests and responses are
+// left out: they are made by another goroutine, so where they turn up in a
+// recording varies. Differences in them show in the results.
+func replayed(events []recEvent) []string {
+	var s []string
+	for _, e := range events {
+		switch e.Kind {
+		case recSIPReq, recSIPResp, recStart:
+			continue
+		}
+		s = append(s, e.String())
+	}
+	return s
+}
+
+// Print writes the report.
+func (r *replayReport) Print(out io.Writer) {
+	fmt.Fprintf(out, "%d events, %d inputs replayed, %d differences\n", r.Events, r.Inputs, len(r.Diffs))
+	for _, d := range r.Diffs {
+		fmt.Fprintf(out, "\n#%d %s %s\n", d.N, d.Input.Time.Format("15:04:05.000"), d.Input)
+		fmt.Fprintln(out, "  recorded:")
+		for _, e := range d.Expected {
+			fmt.Fprintln(out, "    ", e)
+		}
+		fmt.Fprintln(out, "  replayed:")
+		for _, e := range d.Got {
+			fmt.Fprintln(out, "    ", e)
+		}
+	}
+}
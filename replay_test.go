@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/knakk/specs"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	s := specs.New(t)
+	srv, p := startFakeSIP(t, sipFaults{}, 1)
+	defer srv.close()
+	dir, err := ioutil.TempDir("", "automathub-rec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := newTestAutomat()
+	a.backend = &recordingBackend{Backend: &SIPBackend{pool: p}, rec: a.rec}
+	a.recordDir = dir
+	a.configure(automat{IP: "10.0.0.1", Name: "Hoved.Venstre1", Department: "HUTL", Record: true})
+	a.greetUI()
+	a.handleUI([]byte(`{"Action": "LOGIN", "Username": "10", "PIN": "pass"}`))
+	runJob(a)
+	a.handleUI([]byte(`{"Action": "CHECKOUT"}`))
+	a.handleRFID([]byte(`{"Barcode": "03011000012001"}`))
+	runJob(a)
+	a.handleUI([]byte(`{"Action": "LOGOUT"}`))
+	a.rec.stop()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "Hoved.Venstre1-*.jsonl"))
+	s.Expect(1, len(files))
+	events, err := loadRecording(files[0])
+	s.ExpectNil(err)
+	s.Expect(recStart, events[0].Kind)
+	b, _ := ioutil.ReadFile(files[0])
+	s.Expect(false, strings.Contains(string(b), `"pass"`))
+
+	r, err := replay(events)
+	s.ExpectNil(err)
+	s.Expect(7, r.Inputs)
+	s.Expect(0, len(r.Diffs))
+
+	// the library system answering differently shows where it went another way
+	for i, e := range events {
+		if e.Kind == recSIPReq && e.Data == "Checkout HUTL 10 03011000012001" {
+			events[i+1] = recEvent{Kind: recSIPResp, Error: "connection reset"}
+		}
+	}
+	r, err = replay(events)
+	s.ExpectNil(err)
+	s.Expect(1, len(r.Diffs))
+	s.Expect(recResult, r.Diffs[0].Input.Kind)
+}
@@ -0,0 +1,56 @@
+package main
+
+// Where a returned item should go. The user interface tells the patron (or
+// staff) what to do with the item; automats with a sorting machine get the
+// sort bin from the library system.
+const (
+	routeShelve    = "SHELVE"     // back on the shelf
+	routeHoldShelf = "HOLD_SHELF" // on hold for a patron at this branch
+	routeTransit   = "TRANSIT"    // to be sent to another branch
+	routeStaff     = "STAFF"      // needs attention by staff
+)
+
+// SIP alert types (Checkin Response, field CV)
+const (
+	alertUnknown      = "00"
+	alertHoldLocal    = "01"
+	alertHoldRemote   = "02"
+	alertHoldILL      = "03"
+	alertSendToBranch = "04"
+	alertOther        = "99"
+)
+
+// checkinRouting is the routing information of a Checkin Response (10).
+type checkinRouting struct {
+	Action         string // see route* constants
+	Alert          bool
+	AlertType      string // SIP CV
+	MagneticMedia  bool
+	SortBin        string // SIP CL
+	Destination    string // SIP CT, destination location
+	HoldPatron     string `json:"-"` // SIP CY
+	HoldPatronName string `json:"-"` // SIP DA
+}
+
+// route decides what to do with a returned item, received at branch dept.
+func (r *checkinRouting) route(dept string) string {
+	switch r.AlertType {
+	case alertHoldLocal:
+		return routeHoldShelf
+	case alertHoldRemote, alertSendToBranch:
+		return routeTransit
+	case alertHoldILL, alertOther:
+		return routeStaff
+	}
+
+	// No (known) alert type; make the best of what we have
+	switch {
+	case r.HoldPatron != "" && (r.Destination == "" || r.Destination == dept):
+		return routeHoldShelf
+	case r.Destination != "" && r.Destination != dept:
+		return routeTransit
+	case r.Alert:
+		return routeStaff
+	}
+	return routeShelve
+}
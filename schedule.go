@@ -0,0 +1,96 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// Opening hours. Each branch may have a weekly schedule, with exceptions
+// for holidays; its automats switch between the modes below as it says.
+// Branches without a schedule are always open.
+
+// Opening hours modes
+const (
+	hoursOpen       = "open"
+	hoursReturnOnly = "return-only" // checkins only
+	hoursClosed     = "closed"
+)
+
+// How often the schedules are checked
+const scheduleCheckInterval = 15 * time.Second
+
+// openingHours is a period of a day, i.e. {"Hours": "09:00-19:00"}. Outside
+// the periods of a day, the automats are closed.
+type openingHours struct {
+	Hours string
+	Mode  string // open (default), return-only or closed
+}
+
+// branchSchedule is the opening hours of a branch.
+type branchSchedule struct {
+	Week     map[string][]openingHours // by weekday: mon, tue, wed, thu, fri, sat or sun
+	Holidays map[string][]openingHours // by date, "2014-12-24"; none given means closed all day
+}
+
+var weekdays = [...]string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// mode returns the opening hours mode at t.
+func (s branchSchedule) mode(t time.Time) string {
+	day, ok := s.Holidays[t.Format(isoDate)]
+	if !ok {
+		day = s.Week[weekdays[t.Weekday()]]
+	}
+	min := t.Hour()*60 + t.Minute()
+	for _, h := range day {
+		from, to, err := parseHours(h.Hours)
+		if err != nil || min < from || min >= to {
+			continue
+		}
+		if h.Mode == "" {
+			return hoursOpen
+		}
+		return h.Mode
+	}
+	return hoursClosed
+}
+
+// validate reports the problems of the schedule of a branch.
+func (s branchSchedule) validate(dept string, add func(format string, args ...interface{})) {
+	check := func(where string, day []openingHours) {
+		for _, h := range day {
+			if _, _, err := parseHours(h.Hours); err != nil {
+				add("Schedules[%q] %s: %v", dept, where, err)
+			}
+			switch h.Mode {
+			case "", hoursOpen, hoursReturnOnly, hoursClosed:
+			default:
+				add("Schedules[%q] %s: unknown Mode: %q", dept, where, h.Mode)
+			}
+		}
+	}
+	for d, day := range s.Week {
+		known := false
+		for _, w := range weekdays {
+			known = known || w == d
+		}
+		if !known {
+			add("Schedules[%q]: unknown weekday: %q (want one of %s)", dept, d, strings.Join(weekdays[:], ", "))
+		}
+		check(d, day)
+	}
+	for d, day := range s.Holidays {
+		if _, err := time.Parse(isoDate, d); err != nil {
+			add("Schedules[%q]: holiday %q is not a date like \"2014-12-24\"", dept, d)
+		}
+		check(d, day)
+	}
+}
+
+// hoursMode returns the opening hours mode of the automats of dept at t.
+func (c *config) hoursMode(dept string, t time.Time) string {
+	s, ok := c.Schedules[dept]
+	if !ok {
+		return hoursOpen
+	}
+	return s.mode(t)
+}
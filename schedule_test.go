@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/knakk/specs"
+)
+
+var testSchedule = branchSchedule{
+	Week: map[string][]openingHours{
+		"mon": {{Hours: "07:00-09:00", Mode: hoursReturnOnly}, {Hours: "09:00-19:00"}},
+		"sat": {{Hours: "10:00-16:00"}},
+	},
+	Holidays: map[string][]openingHours{
+		"2014-01-27": nil,
+	},
+}
+
+func TestScheduleMode(t *testing.T) {
+	s := specs.New(t)
+	at := func(day, h, min int) string {
+		return testSchedule.mode(time.Date(2014, 1, day, h, min, 0, 0, time.Local))
+	}
+	s.Expect(hoursClosed, at(20, 6, 59)) // Monday
+	s.Expect(hoursReturnOnly, at(20, 7, 0))
+	s.Expect(hoursOpen, at(20, 9, 0))
+	s.Expect(hoursOpen, at(20, 18, 59))
+	s.Expect(hoursClosed, at(20, 19, 0))
+	s.Expect(hoursClosed, at(21, 12, 0)) // Tuesday
+	s.Expect(hoursOpen, at(25, 12, 0))   // Saturday
+	s.Expect(hoursClosed, at(27, 12, 0)) // holiday Monday
+
+	c := &config{Schedules: map[string]branchSchedule{"ROA": testSchedule}}
+	s.Expect(hoursClosed, c.hoursMode("ROA", time.Date(2014, 1, 21, 12, 0, 0, 0, time.Local)))
+	s.Expect(hoursOpen, c.hoursMode("HUTL", time.Date(2014, 1, 21, 12, 0, 0, 0, time.Local)))
+
+	var problems []string
+	branchSchedule{
+		Week:     map[string][]openingHours{"monday": {{Hours: "9-19"}}, "sun": {{Hours: "12:00-16:00", Mode: "open-ish"}}},
+		Holidays: map[string][]openingHours{"24.12.2014": nil},
+	}.validate("ROA", func(format string, args ...interface{}) { problems = append(problems, format) })
+	s.Expect(4, len(problems))
+}
+
+func TestOpeningHours(t *testing.T) {
+	s := specs.New(t)
+	a := newTestAutomat()
+	a.backend = &fakeBackend{}
+	a.configure(automat{IP: "10.0.0.1", Name: "Røa1", Department: "ROA"})
+	ui := func() (r UIResponse) {
+		for a.ToUI.Len() > 0 {
+			m, _ := a.ToUI.Get(nil)
+			json.Unmarshal(m, &r)
+		}
+		return r
+	}
+	a.handleRFID([]byte(`{"Command": "PATRON-CARD", "Barcode": "card1"}`))
+	runJob(a)
+	s.Expect(true, a.Authenticated)
+
+	// return-only: the patron is logged out, but anyone can check in
+	a.setHours(hoursReturnOnly)
+	s.Expect(false, a.Authenticated)
+	s.Expect(uiWAITING, a.State)
+	var snap UISnapshot
+	m, _ := a.ToUI.Get(nil)
+	for a.ToUI.Len() > 0 {
+		m, _ = a.ToUI.Get(nil)
+	}
+	json.Unmarshal(m, &snap)
+	s.Expect(hoursReturnOnly, snap.Hours)
+	s.Expect("Nå kan du bare levere inn.", snap.Message)
+	a.handleRFID([]byte(`{"Command": "PATRON-CARD", "Barcode": "card1"}`))
+	s.Expect("RETURN_ONLY", ui().Action)
+	s.Expect(0, len(a.sipJobs))
+	a.handleUI([]byte(`{"Action": "CHECKIN"}`))
+	a.handleRFID([]byte(`{"Barcode": "03011174511003"}`))
+	s.Expect(1, len(a.sipJobs))
+	<-a.sipJobs
+
+	// closed: the reader is turned off
+	for a.ToRFID.Len() > 0 {
+		a.ToRFID.Get(nil)
+	}
+	a.setHours(hoursClosed)
+	s.Expect(uiCLOSED, a.State)
+	m, _ = a.ToRFID.Get(nil)
+	s.Expect(string(rfidReaderOff), string(m))
+	ui()
+	a.handleUI([]byte(`{"Action": "CHECKIN"}`))
+	r := ui()
+	s.Expect("CLOSED", r.Action)
+	s.Expect("Automaten er stengt.", r.Message)
+
+	// out of order while closed, and back in service while still closed
+	a.configure(automat{IP: "10.0.0.1", Name: "Røa1", Department: "ROA", Maintenance: true})
+	s.Expect(uiMAINTENANCE, a.State)
+	a.configure(automat{IP: "10.0.0.1", Name: "Røa1", Department: "ROA"})
+	s.Expect(uiCLOSED, a.State)
+
+	a.setHours(hoursOpen)
+	s.Expect(uiWAITING, a.State)
+	a.handleRFID([]byte(`{"Command": "PATRON-CARD", "Barcode": "card1"}`))
+	runJob(a)
+	s.Expect(true, a.Authenticated)
+}
+
+func TestScheduleOnConnect(t *testing.T) {
+	s := specs.New(t)
+	c := &config{TCPPort: "0", HTTPPort: "0",
+		Automats:  []automat{{IP: "127.0.0.1", Name: "test", Department: "HUTL"}},
+		Schedules: map[string]branchSchedule{"HUTL": {}}} // never open
+	app, err := NewApp(AppOptions{Config: c, Backend: &fakeBackend{}})
+	s.ExpectNil(err)
+	s.ExpectNil(app.Start())
+	defer app.Close()
+
+	_, port, _ := net.SplitHostPort(app.TCPAddr())
+	conn, err := net.Dial("tcp", "127.0.0.1:"+port)
+	s.ExpectNil(err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	s.ExpectNil(err)
+	s.Expect(string(rfidReaderOff), line)
+	s.Expect(hoursClosed, app.stats.Export().Automats["127.0.0.1"].Hours)
+}
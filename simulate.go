@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Virtual automats, for load testing a hub: each one connects as an RFID
+// service over TCP and as a user interface over websocket, and runs patron
+// sessions against the hub like a real automat.
+
+// simStep is one step of a patron session. Action "ITEM" is an item read
+// by the RFID reader, "RFID-CARD" a library card read by it; all other
+// actions are sent from the user interface. CHECKIN and CHECKOUT are done
+// when the hub turns the reader on.
+type simStep struct {
+	Action   string
+	Username string `json:",omitempty"`
+	PIN      string `json:",omitempty"`
+	Barcode  string `json:",omitempty"`
+}
+
+// replies reports if the hub answers the step on the user interface.
+func (s simStep) replies() bool {
+	switch s.Action {
+	case "LOGIN", "ITEM", "RFID-CARD", "LOGOUT", "PAY":
+		return true
+	}
+	return false
+}
+
+// expects reports if action is the reply to the step.
+func (s simStep) expects(action string) bool {
+	switch s.Action {
+	case "ITEM":
+		return action == "CHECKIN" || action == "CHECKOUT"
+	case "RFID-CARD":
+		return action == "LOGIN" || action == "CARD"
+	}
+	return action == s.Action
+}
+
+// simPushes are the messages the hub sends the user interface unasked.
+var simPushes = map[string]bool{"SNAPSHOT": true, "LANGUAGE": true, "ANNOUNCEMENTS": true}
+
+// measured reports if the step has a reply, or some other sign it is done.
+func (s simStep) measured() bool {
+	return s.replies() || s.Action == "CHECKIN" || s.Action == "CHECKOUT"
+}
+
+// simPatron is a patron the simulator may log in as.
+type simPatron struct {
+	ID  string
+	PIN string
+}
+
+// simConfig configures a simulation.
+type simConfig struct {
+	TCPAddr  string        // RFID service port of the hub
+	HTTPAddr string        // HTTP port of the hub
+	Secret   string        // automat secret, if the UI is not allowed by IP
+	Automats int           // number of virtual automats
+	Duration time.Duration // how long to run
+	Think    time.Duration // max pause between sessions
+	Timeout  time.Duration // max wait for a reply
+
+	// Sessions are run in turn by every automat. Without them, sessions
+	// are made up from Patrons and Items.
+	Script   [][]simStep
+	Patrons  []simPatron
+	Items    []string
+	MaxItems int // per random session
+}
+
+// loadSimScript reads sessions from a JSON file: an array of sessions, each
+// an array of steps.
+func loadSimScript(file string) ([][]simStep, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var script [][]simStep
+	if err := json.NewDecoder(f).Decode(&script); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return script, nil
+}
+
+// randomSession makes up a session: log in, check out or check in some
+// items, and log out.
+func (c *simConfig) randomSession(rnd *rand.Rand) []simStep {
+	p := c.Patrons[rnd.Intn(len(c.Patrons))]
+	steps := []simStep{{Action: "LOGIN", Username: p.ID, PIN: p.PIN}}
+	if rnd.Intn(2) == 0 {
+		steps = append(steps, simStep{Action: "CHECKOUT"})
+	} else {
+		steps = append(steps, simStep{Action: "CHECKIN"})
+	}
+	for i := rnd.Intn(c.MaxItems + 1); i > 0; i-- {
+		steps = append(steps, simStep{Action: "ITEM", Barcode: c.Items[rnd.Intn(len(c.Items))]})
+	}
+	return append(steps, simStep{Action: "LOGOUT"})
+}
+
+// simStats collects the outcome of the steps.
+type simStats struct {
+	mu        sync.Mutex
+	latencies map[string][]time.Duration
+	errors    map[string]int
+	sessions  int
+	unmatched int
+}
+
+func newSimStats() *simStats {
+	return &simStats{latencies: make(map[string][]time.Duration), errors: make(map[string]int)}
+}
+
+func (s *simStats) record(action string, d time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.errors[action]++
+		return
+	}
+	s.latencies[action] = append(s.latencies[action], d)
+}
+
+// leftover counts replies no step was waiting for.
+func (s *simStats) leftover(n int) {
+	s.mu.Lock()
+	s.unmatched += n
+	s.mu.Unlock()
+}
+
+func (s *simStats) session() {
+	s.mu.Lock()
+	s.sessions++
+	s.mu.Unlock()
+}
+
+// simResult sums up the steps of one action.
+type simResult struct {
+	Action        string
+	Count, Errors int
+	P50, P90, P99 time.Duration
+}
+
+// simReport is the outcome of a simulation.
+type simReport struct {
+	Automats   int
+	Duration   time.Duration
+	Sessions   int
+	Throughput float64 // measured steps per second
+	Results    []simResult
+	Unmatched  int      // replies left over at the end, which no step got
+	Errors     []string // connection problems, one per automat at most
+}
+
+// percentile returns the p'th percentile of sorted durations.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[(len(sorted)-1)*p/100]
+}
+
+func (s *simStats) report(automats int, d time.Duration) *simReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := &simReport{Automats: automats, Duration: d, Sessions: s.sessions, Unmatched: s.unmatched}
+	actions := make(map[string]bool)
+	for a := range s.latencies {
+		actions[a] = true
+	}
+	for a := range s.errors {
+		actions[a] = true
+	}
+	total := 0
+	for a := range actions {
+		l := s.latencies[a]
+		sort.Slice(l, func(i, j int) bool { return l[i] < l[j] })
+		r.Results = append(r.Results, simResult{Action: a, Count: len(l), Errors: s.errors[a],
+			P50: percentile(l, 50), P90: percentile(l, 90), P99: percentile(l, 99)})
+		total += len(l)
+	}
+	sort.Slice(r.Results, func(i, j int) bool { return r.Results[i].Action < r.Results[j].Action })
+	if d > 0 {
+		r.Throughput = float64(total) / d.Seconds()
+	}
+	return r
+}
+
+// Print writes the report as a table.
+func (r *simReport) Print(out io.Writer) {
+	fmt.Fprintf(out, "%d automats, %v, %d sessions, %.1f steps/s\n\n",
+		r.Automats, r.Duration.Round(time.Millisecond), r.Sessions, r.Throughput)
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "action\tcount\terrors\tp50\tp90\tp99")
+	for _, res := range r.Results {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%v\t%v\t%v\n", res.Action, res.Count, res.Errors,
+			res.P50.Round(time.Microsecond), res.P90.Round(time.Microsecond), res.P99.Round(time.Microsecond))
+	}
+	w.Flush()
+	if r.Unmatched > 0 {
+		fmt.Fprintln(out, "WARN", r.Unmatched, "replies not matched to a step")
+	}
+	for _, e := range r.Errors {
+		fmt.Fprintln(out, "ERROR", e)
+	}
+}
+
+// simReply is a message to the user interface.
+type simReply struct{ Action, ErrorDetails string }
+
+// virtualAutomat is one simulated automat.
+type virtualAutomat struct {
+	cfg      *simConfig
+	stats    *simStats
+	rnd      *rand.Rand
+	rfid     net.Conn
+	ui       *websocket.Conn
+	replies  chan simReply
+	readerOn chan bool // the hub turned the RFID reader on
+}
+
+var (
+	errSimTimeout      = errors.New("no reply")
+	errSimDisconnected = errors.New("disconnected from hub")
+)
+
+// connect connects the RFID service, and then the user interface of the
+// automat the hub made for it.
+func (v *virtualAutomat) connect() error {
+	conn, err := net.Dial("tcp", v.cfg.TCPAddr)
+	if err != nil {
+		return err
+	}
+	v.rfid = conn
+	v.readerOn = make(chan bool, rfidQueueSize)
+	go v.readRFID()
+
+	q := url.Values{"client": {conn.LocalAddr().String()}}
+	if v.cfg.Secret != "" {
+		q.Set("secret", v.cfg.Secret)
+	}
+	u := url.URL{Scheme: "ws", Host: v.cfg.HTTPAddr, Path: "/ws", RawQuery: q.Encode()}
+	ws, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("websocket: %v", err)
+	}
+	v.ui = ws
+	v.replies = make(chan simReply, uiBufferSize)
+	go v.readUI()
+	return nil
+}
+
+func (v *virtualAutomat) close() {
+	v.rfid.Close()
+	v.ui.Close()
+}
+
+// readRFID reads the commands to the RFID service. Only turning the reader
+// on matters; sort and print commands are ignored.
+func (v *virtualAutomat) readRFID() {
+	r := bufio.NewReader(v.rfid)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		var cmd struct{ Cmd, Data string }
+		if json.Unmarshal(line, &cmd) == nil && cmd.Cmd == "SET-READER" && cmd.Data == "ON" {
+			select {
+			case v.readerOn <- true:
+			default:
+			}
+		}
+	}
+}
+
+// readUI passes the messages to the user interface on to replies.
+func (v *virtualAutomat) readUI() {
+	defer close(v.replies)
+	for {
+		_, msg, err := v.ui.ReadMessage()
+		if err != nil {
+			return
+		}
+		// not every message is a UIResponse, i.e. LOGOUT
+		var res simReply
+		if err := json.Unmarshal(msg, &res); err != nil || simPushes[res.Action] {
+			continue
+		}
+		v.replies <- res
+	}
+}
+
+// do performs a step, and waits for the reply if there is one.
+func (v *virtualAutomat) do(s simStep) error {
+	var err error
+	if !s.replies() {
+		// forget earlier reader commands
+		for len(v.readerOn) > 0 {
+			<-v.readerOn
+		}
+	}
+	switch s.Action {
+	case "ITEM":
+		err = v.sendRFID(RFIDRequest{Barcode: s.Barcode})
+	case "RFID-CARD":
+		err = v.sendRFID(RFIDRequest{Command: rfidCmdPatronCard, Barcode: s.Username})
+	default:
+		b, _ := json.Marshal(UIRequest{Action: s.Action, Username: s.Username, PIN: s.PIN})
+		err = v.ui.WriteMessage(websocket.TextMessage, b)
+	}
+	if err != nil {
+		return errSimDisconnected
+	}
+	if !s.measured() {
+		return nil
+	}
+	if !s.replies() {
+		select {
+		case <-v.readerOn:
+			return nil
+		case <-time.After(v.cfg.Timeout):
+			return errSimTimeout
+		}
+	}
+	select {
+	case res, ok := <-v.replies:
+		if !ok {
+			return errSimDisconnected
+		}
+		if res.Action == "ERROR" {
+			return errors.New(res.ErrorDetails)
+		}
+		if !s.expects(res.Action) {
+			return fmt.Errorf("got %s in reply to %s", res.Action, s.Action)
+		}
+	case <-time.After(v.cfg.Timeout):
+		return errSimTimeout
+	}
+	return nil
+}
+
+func (v *virtualAutomat) sendRFID(req RFIDRequest) error {
+	b, _ := json.Marshal(req)
+	_, err := v.rfid.Write(append(b, '\n'))
+	return err
+}
+
+// run runs sessions until the deadline, or the hub disconnects.
+func (v *virtualAutomat) run(deadline time.Time) error {
+	for n := 0; time.Now().Before(deadline); n++ {
+		var session []simStep
+		if len(v.cfg.Script) > 0 {
+			session = v.cfg.Script[n%len(v.cfg.Script)]
+		} else {
+			session = v.cfg.randomSession(v.rnd)
+		}
+		for _, s := range session {
+			start := time.Now()
+			err := v.do(s)
+			if s.measured() {
+				v.stats.record(s.Action, time.Since(start), err)
+			}
+			if err == errSimDisconnected {
+				return err
+			}
+		}
+		v.stats.session()
+		if v.cfg.Think > 0 {
+			time.Sleep(time.Duration(v.rnd.Int63n(int64(v.cfg.Think))))
+		}
+	}
+	v.stats.leftover(len(v.replies))
+	return nil
+}
+
+// simulate runs the virtual automats against a hub, and reports how it did.
+func simulate(c simConfig) *simReport {
+	if c.Timeout == 0 {
+		c.Timeout = 10 * time.Second
+	}
+	if len(c.Script) == 0 && (len(c.Patrons) == 0 || len(c.Items) == 0) {
+		return &simReport{Errors: []string{"no script, and no patrons and items to make up sessions"}}
+	}
+	stats := newSimStats()
+	start := time.Now()
+	deadline := start.Add(c.Duration)
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []string
+	)
+	for i := 0; i < c.Automats; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			v := &virtualAutomat{cfg: &c, stats: stats, rnd: rand.New(rand.NewSource(start.UnixNano() + int64(i)))}
+			err := v.connect()
+			if err == nil {
+				err = v.run(deadline)
+				v.close()
+			}
+			if err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Sprintf("automat %d: %v", i+1, err))
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	r := stats.report(c.Automats, time.Since(start))
+	sort.Strings(errs)
+	r.Errors = errs
+	return r
+}
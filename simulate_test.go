@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/knakk/specs"
+)
+
+func TestSimulate(t *testing.T) {
+	s := specs.New(t)
+	srv, p := startFakeSIP(t, sipFaults{}, 4)
+	defer srv.close()
+	app := newTestApp(t, &SIPBackend{pool: p})
+	defer app.Close()
+	_, tcpPort, _ := net.SplitHostPort(app.TCPAddr())
+	_, httpPort, _ := net.SplitHostPort(app.HTTPAddr())
+
+	c := simConfig{
+		TCPAddr:  "127.0.0.1:" + tcpPort,
+		HTTPAddr: "127.0.0.1:" + httpPort,
+		Automats: 3,
+		Duration: 300 * time.Millisecond,
+		Timeout:  time.Second,
+		Script: [][]simStep{{
+			{Action: "LOGIN", Username: "10", PIN: "pass"},
+			{Action: "CHECKOUT"},
+			{Action: "ITEM", Barcode: "03011000012001"},
+			{Action: "LOGOUT"},
+			{Action: "LOGIN", Username: "10", PIN: "pass"},
+			{Action: "CHECKIN"},
+			{Action: "ITEM", Barcode: "03011000012001"},
+			{Action: "LOGOUT"},
+		}},
+	}
+	r := simulate(c)
+	s.Expect(0, len(r.Errors))
+	s.Expect(0, r.Unmatched)
+	s.Expect(true, r.Sessions > 0)
+	s.Expect(5, len(r.Results))
+	for _, res := range r.Results {
+		s.Expect(0, res.Errors)
+		s.Expect(true, res.Count > 0)
+		s.Expect(true, res.P50 <= res.P99)
+	}
+
+	// random sessions from the catalogue
+	c.Script = nil
+	c.Patrons = []simPatron{{ID: "1", PIN: "pass"}, {ID: "100", PIN: "pass"}}
+	c.Items = []string{"03011000012002", "03011000012003"}
+	c.MaxItems = 2
+	r = simulate(c)
+	s.Expect(0, len(r.Errors))
+	s.Expect(0, r.Unmatched)
+	s.Expect(true, r.Throughput > 0)
+
+	// each step gets its own reply, not the greeting of the UI
+	v := &virtualAutomat{cfg: &c, stats: newSimStats()}
+	s.ExpectNil(v.connect())
+	defer v.close()
+	s.ExpectNil(v.do(simStep{Action: "LOGIN", Username: "10", PIN: "pass"}))
+	s.Expect(0, len(v.replies))
+	s.ExpectNil(v.do(simStep{Action: "LOGOUT"}))
+	s.Expect(0, len(v.replies))
+	s.Expect(true, simStep{Action: "ITEM"}.expects("CHECKOUT"))
+	s.Expect(false, simStep{Action: "LOGIN"}.expects("LOGOUT"))
+}
@@ -2,8 +2,11 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"log"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -13,23 +16,56 @@ const (
 	sipDateLayout = "20060102    150405"
 
 	// 93: Login (established SIP connection)
-	sipMsg93 = "9300CNstresstest%d|COstresstest%d|CPHUTL|\r"
+	sipMsg93 = "9300CN%s|CO%s|CP%s|\r"
 
 	// 63: Patron information request
-	sipMsg63 = "63012%v          AO%s|AA%s|AC<terminalpassword>|AD%s|BP000|BQ9999|\r"
+	// (summary: fine items)
+	sipMsg63 = "63012%v   Y      AO%s|AA%s|AC<terminalpassword>|AD%s|BP000|BQ9999|\r"
 
 	// 09: Chekin
 	sipMsg09 = "09N%v%vAP<location>|AO%v|AB%v|AC<terminalpassword>|\r"
 
 	// 11: Checkout
 	sipMsg11 = "11YN%v%vAO<institutionid>|AA%s|AB%s|AC<terminalpassword>|\r"
+
+	// 63: Patron information request, without PIN
+	sipMsg63Info = "63012%v   Y      AO%s|AA%s|AC<terminalpassword>|BP000|BQ9999|\r"
+
+	// 17: Item information
+	sipMsg17 = "17%vAO%s|AB%s|AC<terminalpassword>|\r"
+
+	// 29: Renew
+	sipMsg29 = "29NN%v%vAO%s|AA%s|AB%s|AC<terminalpassword>|\r"
+
+	// 37: Fee paid (fee type 01: other/unknown)
+	sipMsg37 = "37%v01%s%sBV%s|AO%s|AA%s|AC<terminalpassword>|CG%s|BK%s|\r"
+
+	// 35: End patron session
+	sipMsg35 = "35%vAO%s|AA%s|AC<terminalpassword>|\r"
+
+	// 01: Block patron (card not retained)
+	sipMsg01 = "01N%vAO%s|AL%s|AA%s|AC<terminalpassword>|\r"
 )
 
+// errSIPBusy is returned when an automat has too many SIP requests waiting
+var errSIPBusy = errors.New("too many SIP requests waiting, try again")
+
 // TODO investigate SIP fileds, do Koha need them to be filled out?:
 // <terminalpassword>
 // <location>
 // <institutionid>
 
+// sipFormMsgLogin logs in SIP connection number i. Without a configured
+// user, each connection logs in as its own stresstest<i> user.
+func sipFormMsgLogin(c *config, i int) string {
+	user, pass := c.SIPUsername, c.SIPPassword
+	if user == "" {
+		user = fmt.Sprintf("stresstest%d", i)
+		pass = user
+	}
+	return fmt.Sprintf(sipMsg93, user, pass, c.SIPLocation)
+}
+
 func sipFormMsgAuthenticate(dept, username, pin string) string {
 	now := time.Now().Format(sipDateLayout)
 	return fmt.Sprintf(sipMsg63, now, dept, username, pin)
@@ -45,10 +81,54 @@ func sipFormMsgCheckout(username, barcode string) string {
 	return fmt.Sprintf(sipMsg11, now, now, username, barcode)
 }
 
+func sipFormMsgPatronInfo(dept, username string) string {
+	now := time.Now().Format(sipDateLayout)
+	return fmt.Sprintf(sipMsg63Info, now, dept, username)
+}
+
+func sipFormMsgItemInfo(dept, barcode string) string {
+	now := time.Now().Format(sipDateLayout)
+	return fmt.Sprintf(sipMsg17, now, dept, barcode)
+}
+
+func sipFormMsgRenew(dept, username, barcode string) string {
+	now := time.Now().Format(sipDateLayout)
+	return fmt.Sprintf(sipMsg29, now, now, dept, username, barcode)
+}
+
+func sipFormMsgFeePaid(dept, username string, p payment) string {
+	now := time.Now().Format(sipDateLayout)
+	return fmt.Sprintf(sipMsg37, now, p.Type, p.Currency, formatAmount(p.Amount), dept, username, p.FeeID, p.Reference)
+}
+
+func sipFormMsgEndSession(dept, username string) string {
+	now := time.Now().Format(sipDateLayout)
+	return fmt.Sprintf(sipMsg35, now, dept, username)
+}
+
+func sipFormMsgBlockPatron(dept, username, msg string) string {
+	now := time.Now().Format(sipDateLayout)
+	return fmt.Sprintf(sipMsg01, now, dept, msg, username)
+}
+
+// fieldValues returns all values of a repeatable field, i.e. AV (fine items)
+func fieldValues(msg, id string) []string {
+	var values []string
+	for _, pair := range strings.Split(strings.TrimRight(msg, "|\r"), "|") {
+		if len(pair) >= 2 && pair[0:2] == id {
+			values = append(values, pair[2:])
+		}
+	}
+	return values
+}
+
 func pairFieldIDandValue(msg string) map[string]string {
 	results := make(map[string]string)
 
 	for _, pair := range strings.Split(strings.TrimRight(msg, "|\r"), "|") {
+		if len(pair) < 2 {
+			continue
+		}
 		id, val := pair[0:2], pair[2:]
 		results[id] = val
 	}
@@ -57,85 +137,288 @@ func pairFieldIDandValue(msg string) map[string]string {
 
 // A parserFunc parses a SIP response. It extracts the desired information and
 // returns the JSON message to be sent to the user interface.
-type parserFunc func(string) *UIResponse
+type parserFunc func(string) (*UIResponse, error)
 
 // DoSIPCall performs a SIP request with an automat's SIP TCP-connection. It
 // takes a SIP message as a string and a parser function to transform the SIP
 // response into a UIResponse.
 func DoSIPCall(p *ConnPool, req string, parser parserFunc) (*UIResponse, error) {
-	// 0. Get connection from pool
+	// 0. Get connection from pool; broken connections are replaced
 	c := p.Get()
-	defer p.Release(c)
 
 	// 1. Send the SIP request
 	_, err := c.Write([]byte(req))
 	if err != nil {
+		p.Discard(c)
 		return nil, err
 	}
 
-	log.Println("-> SIP", strings.Trim(req, "\n\r"))
+	log.Println("-> SIP", strings.Trim(sipMasked(req), "\n\r"))
 
 	// 2. Read SIP response
 	reader := bufio.NewReader(c)
 	resp, err := reader.ReadString('\r')
 	if err != nil {
+		p.Discard(c)
 		return nil, err
 	}
+	p.Release(c)
 
 	log.Println("<- SIP", strings.Trim(resp, "\n\r"))
 
 	// 3. Parse the response
-	res := parser(resp)
+	return parser(resp)
+}
 
-	return res, nil
+// sipSecretField matches the PIN (AD) and password (CO) fields of a SIP message.
+var sipSecretField = regexp.MustCompile(`\|(AD|CO)[^|]*`)
+
+// sipMasked returns a SIP message with PIN and password masked, for logging.
+func sipMasked(msg string) string {
+	return sipSecretField.ReplaceAllString(msg, "|${1}*****")
+}
+
+// checkLen returns an error if a SIP response is shorter than its fixed
+// fields, i.e. "96" (resend), so the parsers can read them at their offsets.
+func checkLen(s string, n int) error {
+	if len(s) < n {
+		return fmt.Errorf("short SIP response: %q", strings.Trim(s, "\n\r"))
+	}
+	return nil
+}
+
+func authParse(s string) (*UIResponse, error) {
+	return patronParse(s, true)
 }
 
-func authParse(s string) *UIResponse {
+// patronParse parses a Patron Information Response. The patron is
+// authenticated if valid, not reported lost, the card has not expired, and
+// (if checkPIN) the PIN was correct.
+func patronParse(s string, checkPIN bool) (*UIResponse, error) {
+	if err := checkLen(s, 61); err != nil {
+		return nil, err
+	}
 	b := s[61:] // first part of SIPresponse not needed here
 	fields := pairFieldIDandValue(b)
 
-	var auth bool
-	if fields["CQ"] == "Y" {
-		auth = true
+	msg := fields["AF"]
+	if msg == "" {
+		msg = fields["AG"]
+	}
+	res := &UIResponse{Action: "LOGIN", Patron: fields["AA"], Message: msg, Fees: feesParse(b)}
+	res.Blocks = patronStatusParse(s[2:16])
+	cardExpired := expired(fields["PA"], time.Now())
+	if cardExpired {
+		res.Blocks = append(res.Blocks, blockCardExpired)
+	}
+	if res.Fees != nil && res.Fees.OverLimit {
+		res.Blocks = append(res.Blocks, blockFeeLimit)
 	}
-	return &UIResponse{Action: "LOGIN", Authenticated: auth, Patron: fields["AA"]}
+
+	switch {
+	case fields["BL"] == "N":
+		res.Reason = loginInvalidPatron
+	case checkPIN && fields["CQ"] != "Y":
+		res.Reason = loginWrongPIN
+	case s[6] == 'Y':
+		res.Reason = loginCardLost
+	case cardExpired:
+		res.Reason = loginCardExpired
+	default:
+		res.Authenticated = true
+	}
+	return res, nil
 }
 
-func checkinParse(s string) *UIResponse {
-	a, b := s[:24], s[24:]
-	var (
-		ok     bool
-		status string
-	)
-	if a[2] == '1' {
-		ok = true
+// patron status flags (64), in order
+var sipPatronStatus = [14]string{
+	blockChargeDenied,
+	blockRenewalDenied,
+	blockRecallDenied,
+	blockHoldDenied,
+	blockCardLost,
+	blockTooManyItems,
+	blockTooManyOverdue,
+	blockTooManyRenewal,
+	blockTooManyClaims,
+	blockTooManyLost,
+	blockExcessiveFines,
+	blockExcessiveFees,
+	blockRecallOverdue,
+	blockTooManyBilled,
+}
+
+// patronStatusParse decodes the 14 character patron status field
+func patronStatusParse(flags string) []string {
+	var blocks []string
+	for i := 0; i < len(flags) && i < len(sipPatronStatus); i++ {
+		if flags[i] == 'Y' {
+			blocks = append(blocks, sipPatronStatus[i])
+		}
 	}
+	return blocks
+}
+
+// expired reports if a patron expiration date (PA, a 3M extension used by
+// Koha: YYYYMMDD, optionally followed by a time) is before now.
+func expired(date string, now time.Time) bool {
+	if len(date) < 8 {
+		return false
+	}
+	t, err := time.ParseInLocation("20060102", date[:8], time.Local)
+	if err != nil {
+		return false
+	}
+	return now.After(t.AddDate(0, 0, 1))
+}
+
+// feesParse extracts outstanding fees from a Patron Information Response
+func feesParse(b string) *fees {
+	fields := pairFieldIDandValue(b)
+	amount, err := parseAmount(fields["BV"])
+	if err != nil || amount == 0 {
+		return nil
+	}
+	f := &fees{
+		Amount:   fields["BV"],
+		Currency: fields["BH"],
+		Limit:    fields["CC"],
+		Items:    fieldValues(b, "AV"),
+	}
+	if limit, err := parseAmount(f.Limit); err == nil && limit > 0 {
+		f.OverLimit = amount >= limit
+	}
+	return f
+}
+
+func checkinParse(s string) (*UIResponse, error) {
+	if err := checkLen(s, 24); err != nil {
+		return nil, err
+	}
+	a, b := s[:24], s[24:]
 	fields := pairFieldIDandValue(b)
-	if a[2] == '0' {
-		status = fields["AF"]
+	it := item{OK: a[2] == '1', Title: fields["AJ"], Barcode: fields["AB"],
+		MediaType: fields["CK"], Location: fields["AQ"]}
+	if it.OK {
+		it.Event, it.Date = eventCheckedIn, sipDate(a[6:14])
 	} else {
-		status = fmt.Sprintf("registrert innlevert %s/%s/%s", a[12:14], a[10:12], a[6:10])
+		it.Status = fields["AF"]
+	}
+	r := &checkinRouting{
+		Alert:          a[5] == 'Y',
+		AlertType:      fields["CV"],
+		MagneticMedia:  a[4] == 'Y',
+		SortBin:        fields["CL"],
+		Destination:    fields["CT"],
+		HoldPatron:     fields["CY"],
+		HoldPatronName: fields["DA"],
+	}
+	r.Action = r.route(fields["AO"])
+	it.Routing = r
+	return &UIResponse{Item: it}, nil
+}
+
+// sipDate turns the date of a SIP timestamp (YYYYMMDD    HHMMSS) into an
+// isoDate.
+func sipDate(s string) string {
+	if len(s) < 8 {
+		return s
+	}
+	return s[0:4] + "-" + s[4:6] + "-" + s[6:8]
+}
+
+func checkoutParse(s string) (*UIResponse, error) {
+	if err := checkLen(s, 24); err != nil {
+		return nil, err
+	}
+	a, b := s[:24], s[24:]
+	fields := pairFieldIDandValue(b)
+	it := item{OK: a[2] == '1', Title: fields["AJ"]}
+	switch {
+	case it.OK:
+		it.Event, it.Date = eventCheckedOut, sipDate(fields["AH"])
+	case fields["AF"] == "1", fields["AF"] == "":
+		// no reason given
+		it.Event = eventCheckoutFailed
+	default:
+		it.Status = fields["AF"]
+	}
+	return &UIResponse{Item: it}, nil
+}
+
+// patronInfoParse parses a Patron Information Response to a request without
+// PIN. Authenticated means the patron is valid.
+func patronInfoParse(s string) (*UIResponse, error) {
+	res, err := patronParse(s, false)
+	if err != nil {
+		return nil, err
 	}
-	return &UIResponse{Item: item{OK: ok, Title: fields["AJ"], Status: status}}
+	res.Action = "PATRON"
+	return res, nil
 }
 
-func checkoutParse(s string) *UIResponse {
+func renewParse(s string) (*UIResponse, error) {
+	if err := checkLen(s, 24); err != nil {
+		return nil, err
+	}
 	a, b := s[:24], s[24:]
-	var (
-		ok     bool
-		status string
-	)
 	fields := pairFieldIDandValue(b)
-	if a[2] == '1' {
-		ok = true
-		date := fields["AH"]
-		status = fmt.Sprintf("utlånt til %s/%s/%s", date[6:8], date[4:6], date[0:4])
+	it := item{OK: a[2] == '1', Title: fields["AJ"]}
+	if it.OK {
+		it.Event, it.Date = eventRenewed, sipDate(fields["AH"])
 	} else {
-		if fields["AF"] == "1" {
-			status = "Failed! Don't know why; SIP should give more information"
-		} else {
-			status = fields["AF"]
-		}
+		it.Status = fields["AF"]
 	}
-	return &UIResponse{Item: item{OK: ok, Status: status, Title: fields["AJ"]}}
+	return &UIResponse{Item: it}, nil
+}
+
+func itemInfoParse(s string) (*UIResponse, error) {
+	if err := checkLen(s, 26); err != nil {
+		return nil, err
+	}
+	a, b := s[:26], s[26:]
+	fields := pairFieldIDandValue(b)
+	queue, _ := strconv.Atoi(fields["CF"])
+	it := item{
+		Title:      fields["AJ"],
+		Status:     fields["AF"],
+		Barcode:    fields["AB"],
+		CircStatus: a[2:4],
+		MediaType:  fields["CK"],
+		HoldQueue:  queue,
+		HoldPatron: fields["CY"],
+		Location:   fields["AQ"],
+	}
+	it.OK = it.CircStatus == circAvailable || it.CircStatus == circReshelving
+	return &UIResponse{Item: it}, nil
+}
+
+func endSessionParse(s string) (*UIResponse, error) {
+	if err := checkLen(s, 21); err != nil {
+		return nil, err
+	}
+	fields := pairFieldIDandValue(s[21:])
+	return &UIResponse{Action: "LOGOUT", Patron: fields["AA"], Message: fields["AF"]}, nil
+}
+
+func feePaidParse(s string) (*UIResponse, error) {
+	if err := checkLen(s, 21); err != nil {
+		return nil, err
+	}
+	a, b := s[:21], s[21:]
+	fields := pairFieldIDandValue(b)
+	return &UIResponse{Action: "PAY", Patron: fields["AA"], Message: fields["AF"],
+		Payment: &paymentResult{Accepted: a[2] == 'Y', TransactionID: fields["BK"]}}, nil
+}
+
+// patronStatusResponseParse parses a Patron Status Response (24), which is
+// the answer to Block Patron.
+func patronStatusResponseParse(s string) (*UIResponse, error) {
+	if err := checkLen(s, 37); err != nil {
+		return nil, err
+	}
+	a, b := s[:37], s[37:]
+	fields := pairFieldIDandValue(b)
+	return &UIResponse{Action: "BLOCK", Patron: fields["AA"], Message: fields["AF"],
+		Blocks: patronStatusParse(a[2:16])}, nil
 }
@@ -5,8 +5,10 @@ import (
 	"bytes"
 	"io"
 	// "io/ioutil"
-	// "log"
+	"log"
 	"net"
+	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -68,11 +70,24 @@ func TestSIPPatronAuthentication(t *testing.T) {
 	p := &ConnPool{}
 	p.Init(1, fakeSIPResponse("64              01220140123    093212000000030003000000000000AOHUTL|AApatronid1|AEFillip Wahl|BLY|CQY|CC5|PCPT|PIY|AFGreetings from Koha. |\r"))
 
-	res, err := DoSIPCall(p, sipFormMsgAuthenticate("HUTL", "patronid1", "pass"), authParse)
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	res, err := DoSIPCall(p, sipFormMsgAuthenticate("HUTL", "patronid1", "7531"), authParse)
+	log.SetOutput(os.Stderr)
 
 	s.ExpectNil(err)
 	s.Expect(true, res.Authenticated)
 	s.Expect("patronid1", res.Patron)
+
+	// the PIN is not logged
+	s.Expect(false, strings.Contains(logged.String(), "7531"))
+	s.Expect(true, strings.Contains(logged.String(), "|AApatronid1|AC<terminalpassword>|AD*****|BP000|"))
+}
+
+func TestSIPMasked(t *testing.T) {
+	s := specs.New(t)
+	s.Expect("9300CNhub|CO*****|CPHUTL|\r", sipMasked("9300CNhub|COsecret|CPHUTL|\r"))
+	s.Expect("35AOHUTL|AA2|AC<terminalpassword>|\r", sipMasked("35AOHUTL|AA2|AC<terminalpassword>|\r"))
 }
 
 func TestSIPCheckin(t *testing.T) {
@@ -85,7 +100,8 @@ func TestSIPCheckin(t *testing.T) {
 	s.ExpectNil(err)
 	s.Expect(true, res.Item.OK)
 	s.Expect("316 salmer og sanger", res.Item.Title)
-	s.Expect("registrert innlevert 24/01/2014", res.Item.Status)
+	s.Expect(eventCheckedIn, res.Item.Event)
+	s.Expect("2014-01-24", res.Item.Date)
 
 	p.Init(1, fakeSIPResponse("100NUY20140128    114702AO|AB234567890|CV99|AFItem not checked out|\r"))
 	res, err = DoSIPCall(p, sipFormMsgCheckin("HUTL", "234567890"), checkinParse)
@@ -102,7 +118,8 @@ func TestSIPCheckout(t *testing.T) {
 	s.ExpectNil(err)
 	s.Expect(true, res.Item.OK)
 	s.Expect("Krutt-Kim", res.Item.Title)
-	s.Expect("utlånt til 21/02/2014", res.Item.Status)
+	s.Expect(eventCheckedOut, res.Item.Event)
+	s.Expect("2014-02-21", res.Item.Date)
 
 	p.Init(1, fakeSIPResponse("120NUN20140124    131049AOHUTL|AA2|AB1234|AJ|AH|AFInvalid Item|BLY|\r"))
 	res, err = DoSIPCall(p, sipFormMsgCheckout("2", "1234"), checkoutParse)
@@ -111,3 +128,141 @@ func TestSIPCheckout(t *testing.T) {
 	s.Expect(false, res.Item.OK)
 	s.Expect("Invalid Item", res.Item.Status)
 }
+
+func TestSIPRenew(t *testing.T) {
+	s := specs.New(t)
+	p := &ConnPool{}
+	p.Init(1, fakeSIPResponse("301YNN20140124    110740AOHUTL|AA2|AB03011174511003|AJKrutt-Kim|AH20140321    235900|\r"))
+	b := &SIPBackend{pool: p}
+	res, err := b.Renew("HUTL", "2", "03011174511003")
+
+	s.ExpectNil(err)
+	s.Expect(true, res.Item.OK)
+	s.Expect("Krutt-Kim", res.Item.Title)
+	s.Expect(eventRenewed, res.Item.Event)
+	s.Expect("2014-03-21", res.Item.Date)
+}
+
+func TestSIPItemInfo(t *testing.T) {
+	s := specs.New(t)
+	p := &ConnPool{}
+	p.Init(1, fakeSIPResponse("1808020020140124    110740AB03011174511003|AJKrutt-Kim|AQhutl|CF2|CK001|CYpatronid1|AFOn hold|\r"))
+	b := &SIPBackend{pool: p}
+	res, err := b.ItemInfo("HUTL", "03011174511003")
+
+	s.ExpectNil(err)
+	s.Expect(false, res.Item.OK)
+	s.Expect("Krutt-Kim", res.Item.Title)
+	s.Expect(circOnHoldShelf, res.Item.CircStatus)
+	s.Expect("001", res.Item.MediaType)
+	s.Expect(2, res.Item.HoldQueue)
+	s.Expect("patronid1", res.Item.HoldPatron)
+	s.Expect("hutl", res.Item.Location)
+}
+
+func TestSIPCheckinRouting(t *testing.T) {
+	s := specs.New(t)
+	p := &ConnPool{}
+	p.Init(1, fakeSIPResponse("101YNY20140124    093621AOHUTL|AB03011143299001|AQhvmu|AJ316 salmer og sanger|CLB3|CV02|CTFMAJ|CY12345|DAOla Nordmann|\r"))
+
+	res, err := DoSIPCall(p, sipFormMsgCheckin("HUTL", "03011143299001"), checkinParse)
+
+	s.ExpectNil(err)
+	s.Expect(true, res.Item.OK)
+	s.Expect("03011143299001", res.Item.Barcode)
+	s.Expect(true, res.Item.Routing.Alert)
+	s.Expect(routeTransit, res.Item.Routing.Action)
+	s.Expect("B3", res.Item.Routing.SortBin)
+	s.Expect("FMAJ", res.Item.Routing.Destination)
+	s.Expect("12345", res.Item.Routing.HoldPatron)
+	s.Expect("Ola Nordmann", res.Item.Routing.HoldPatronName)
+}
+
+func TestCheckinRoute(t *testing.T) {
+	s := specs.New(t)
+	tests := []struct {
+		r    checkinRouting
+		want string
+	}{
+		{checkinRouting{}, routeShelve},
+		{checkinRouting{Alert: true, AlertType: alertHoldLocal}, routeHoldShelf},
+		{checkinRouting{Alert: true, AlertType: alertSendToBranch}, routeTransit},
+		{checkinRouting{Alert: true, AlertType: alertOther}, routeStaff},
+		{checkinRouting{Alert: true, HoldPatron: "1"}, routeHoldShelf},
+		{checkinRouting{Alert: true, HoldPatron: "1", Destination: "FMAJ"}, routeTransit},
+		{checkinRouting{Alert: true}, routeStaff},
+	}
+	for _, tt := range tests {
+		s.Expect(tt.want, tt.r.route("HUTL"))
+	}
+}
+
+func TestSIPLoginFailureReasons(t *testing.T) {
+	s := specs.New(t)
+	tests := []struct {
+		resp   string
+		auth   bool
+		reason string
+		blocks []string
+	}{
+		{"64              01220140123    093212000000030003000000000000AOHUTL|AApatronid1|BLY|CQN|AFWrong PIN|\r",
+			false, loginWrongPIN, nil},
+		{"64YYYY          01220140123    093212000000000000000000000000AOHUTL|AAnobody|BLN|CQN|\r",
+			false, loginInvalidPatron, []string{blockChargeDenied, blockRenewalDenied, blockRecallDenied, blockHoldDenied}},
+		{"64Y    Y        01220140123    093212000000030003000000000000AOHUTL|AApatronid1|BLY|CQY|\r",
+			true, "", []string{blockChargeDenied, blockTooManyItems}},
+		{"64    YY        01220140123    093212000000030003000000000000AOHUTL|AApatronid1|BLY|CQY|\r",
+			false, loginCardLost, []string{blockCardLost, blockTooManyItems}},
+		{"64           Y  01220140123    093212000000030003000000000000AOHUTL|AApatronid1|BLY|CQY|PA20120101|\r",
+			false, loginCardExpired, []string{blockExcessiveFees, blockCardExpired}},
+	}
+	for _, tt := range tests {
+		res, err := authParse(tt.resp)
+		s.ExpectNil(err)
+		s.Expect(tt.auth, res.Authenticated)
+		s.Expect(tt.reason, res.Reason)
+		s.Expect(tt.blocks, res.Blocks)
+	}
+
+	// expired cards can't be used at the automat, with a card either
+	res, _ := patronParse("64              01220140123    093212000000030003000000000000AOHUTL|AApatronid1|BLY|PA20120101|\r", false)
+	s.Expect(false, res.Authenticated)
+	s.Expect(loginCardExpired, res.Reason)
+
+	// the screen message (AF) falls back to the print line (AG)
+	res, _ = authParse("64              01220140123    093212000000030003000000000000AOHUTL|AApatronid1|BLY|CQN|AGWrong PIN|\r")
+	s.Expect("Wrong PIN", res.Message)
+	res, _ = authParse("64              01220140123    093212000000030003000000000000AOHUTL|AApatronid1|BLY|CQN|AFFeil PIN|AGWrong PIN|\r")
+	s.Expect("Feil PIN", res.Message)
+}
+
+func TestSIPBlockPatron(t *testing.T) {
+	s := specs.New(t)
+	req := sipFormMsgBlockPatron("HUTL", "patronid1", "too many failed logins")
+	s.Expect("01N", req[:3])
+	s.Expect("AOHUTL|ALtoo many failed logins|AApatronid1|AC<terminalpassword>|\r", req[21:])
+
+	res, err := patronStatusResponseParse("24YYYY          01220140123    093212AOHUTL|AApatronid1|AFBlocked|\r")
+	s.ExpectNil(err)
+	s.Expect("BLOCK", res.Action)
+	s.Expect("patronid1", res.Patron)
+	s.Expect([]string{blockChargeDenied, blockRenewalDenied, blockRecallDenied, blockHoldDenied}, res.Blocks)
+}
+
+func TestSIPMalformedResponse(t *testing.T) {
+	s := specs.New(t)
+	parsers := []parserFunc{authParse, patronInfoParse, checkinParse, checkoutParse, renewParse,
+		itemInfoParse, endSessionParse, feePaidParse, patronStatusResponseParse}
+	for _, parser := range parsers {
+		p := &ConnPool{}
+		p.Init(1, fakeSIPResponse("96\r"))
+		res, err := DoSIPCall(p, "99\r", parser)
+		s.Expect(true, res == nil)
+		s.Expect(`short SIP response: "96"`, err.Error())
+	}
+
+	// cut off within the fixed fields
+	res, err := checkinParse("101YNN20140124\r")
+	s.Expect(true, res == nil)
+	s.Expect(`short SIP response: "101YNN20140124"`, err.Error())
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Automated book-return sorter ///////////////////////////////////////////////
+
+// sorterConfig describes the sorting machine of a return automat.
+type sorterConfig struct {
+	// Address of the sorter controller. If empty, sort commands are sent
+	// to the RFID service, which drives the sorter.
+	Addr string
+
+	// Rules map checkin results to bins. They are tried in order, and the
+	// first match wins.
+	Rules []sortRule
+
+	// Bin for items no rule matches, and without a numeric SIP sort bin.
+	DefaultBin int
+}
+
+// sortRule matches a checkin result. Empty fields match anything; all
+// non-empty fields must match.
+type sortRule struct {
+	Route     string // routing action (SHELVE, HOLD_SHELF, TRANSIT, STAFF), or REJECT
+	SortBin   string // SIP sort bin (CL)
+	MediaType string // SIP media type (CK)
+	Magnetic  bool   // match only magnetic media
+	Bin       int
+}
+
+// Route matched by failed checkins
+const routeReject = "REJECT"
+
+// Sorter events, reported by the sorter controller or the RFID service
+const (
+	sorterOK       = "OK"        // item sorted
+	sorterJam      = "JAM"       // conveyor jammed; no items can be accepted
+	sorterCleared  = "CLEARED"   // jam cleared
+	sorterBinFull  = "BIN_FULL"  // a bin is full
+	sorterBinEmpty = "BIN_EMPTY" // a bin has been emptied
+)
+
+type sorterEvent struct {
+	Event   string
+	Bin     int
+	Barcode string
+	Message string
+}
+
+func (r sortRule) matches(it item) bool {
+	route, sortBin, magnetic := routeReject, "", false
+	if it.OK {
+		route = routeShelve
+		if it.Routing != nil {
+			route = it.Routing.Action
+		}
+	}
+	if it.Routing != nil {
+		sortBin, magnetic = it.Routing.SortBin, it.Routing.MagneticMedia
+	}
+
+	switch {
+	case r.Route != "" && r.Route != route:
+		return false
+	case r.SortBin != "" && r.SortBin != sortBin:
+		return false
+	case r.MediaType != "" && r.MediaType != it.MediaType:
+		return false
+	case r.Magnetic && !magnetic:
+		return false
+	}
+	return true
+}
+
+// sorter routes returned items into the bins of a sorting machine.
+type sorter struct {
+	cfg  sorterConfig
+	conn *sorterConn // nil if the sorter is driven by the RFID service
+}
+
+func newSorter(c sorterConfig) *sorter {
+	s := &sorter{cfg: c}
+	if c.Addr != "" {
+		s.conn = newSorterConn(c.Addr)
+	}
+	return s
+}
+
+// bin returns the bin a returned item should go to.
+func (s *sorter) bin(it item) int {
+	for _, r := range s.cfg.Rules {
+		if r.matches(it) {
+			return r.Bin
+		}
+	}
+	if it.OK && it.Routing != nil {
+		if n, err := strconv.Atoi(it.Routing.SortBin); err == nil {
+			return n
+		}
+	}
+	return s.cfg.DefaultBin
+}
+
+// events returns the channel of events from the sorter controller, or nil if
+// events come via the RFID service.
+func (s *sorter) events() <-chan sorterEvent {
+	if s == nil || s.conn == nil {
+		return nil
+	}
+	return s.conn.events
+}
+
+// sort sends an item to a bin. Commands go to the sorter controller if there
+// is one; otherwise they are returned, to be sent to the RFID service.
+func (s *sorter) sort(barcode string, bin int) []byte {
+	if s.conn != nil {
+		b, _ := json.Marshal(struct {
+			Cmd     string
+			Barcode string
+			Bin     int
+		}{"SORT", barcode, bin})
+		s.conn.out.Push(append(b, '\n'), prioNormal)
+		return nil
+	}
+	return rfidSortCommand(barcode, strconv.Itoa(bin))
+}
+
+// stop closes the connection to the sorter controller, if any.
+func (s *sorter) stop() {
+	if s.conn != nil {
+		s.conn.out.Close()
+	}
+}
+
+// Connection to a sorter controller //////////////////////////////////////////
+
+const (
+	sorterQueueSize      = 32
+	sorterReconnectDelay = 5 * time.Second
+)
+
+// sorterConn is a line based JSON connection to a sorter controller. It
+// reconnects until stopped; commands are queued while disconnected.
+type sorterConn struct {
+	addr   string
+	out    *outQueue
+	events chan sorterEvent
+}
+
+func newSorterConn(addr string) *sorterConn {
+	return &sorterConn{
+		addr:   addr,
+		out:    newOutQueue("sorter "+addr, sorterQueueSize, dropOldest),
+		events: make(chan sorterEvent),
+	}
+}
+
+// run connects to the sorter controller, and keeps reconnecting until the
+// outgoing queue is closed.
+func (c *sorterConn) run() {
+	for {
+		conn, err := net.DialTimeout("tcp", c.addr, 10*time.Second)
+		if err != nil {
+			log.Println("ERROR", "sorter", c.addr, err)
+		} else {
+			log.Println("INFO", "sorter", c.addr, "connected")
+			done := make(chan bool)
+			go c.reader(conn, done)
+			c.writer(conn, done)
+			conn.Close()
+			log.Println("INFO", "sorter", c.addr, "disconnected")
+		}
+		select {
+		case <-c.out.done:
+			return
+		case <-time.After(sorterReconnectDelay):
+		}
+	}
+}
+
+// writer sends queued commands until the connection fails, the reader
+// stops or the queue is closed.
+func (c *sorterConn) writer(conn net.Conn, done chan bool) {
+	w := bufio.NewWriter(conn)
+	for {
+		msg, ok := c.out.Get(done)
+		if !ok {
+			return
+		}
+		_, err := w.Write(msg)
+		if err == nil {
+			err = w.Flush()
+		}
+		if err != nil {
+			log.Println("ERROR", "sorter", c.addr, err)
+			c.out.PushFront(msg)
+			return
+		}
+		log.Println("-> SORTER:", strings.TrimRight(string(msg), "\n"))
+	}
+}
+
+func (c *sorterConn) reader(conn net.Conn, done chan bool) {
+	defer close(done)
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		log.Println("<- SORTER:", strings.TrimRight(string(line), "\n"))
+		var ev sorterEvent
+		if err := json.Unmarshal(line, &ev); err != nil {
+			log.Println("ERROR", "sorter", c.addr, err)
+			continue
+		}
+		select {
+		case c.events <- ev:
+		case <-c.out.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/knakk/specs"
+	"github.com/rcrowley/go-metrics"
+)
+
+func TestSorterBin(t *testing.T) {
+	s := specs.New(t)
+	srt := newSorter(sorterConfig{
+		DefaultBin: 1,
+		Rules: []sortRule{
+			{Route: routeReject, Bin: 9},
+			{Route: routeHoldShelf, Bin: 2},
+			{Route: routeTransit, Bin: 3},
+			{Magnetic: true, Bin: 4},
+			{MediaType: "006", Bin: 6},
+		},
+	})
+
+	tests := []struct {
+		it   item
+		want int
+	}{
+		{item{OK: false}, 9},
+		{item{OK: true}, 1},
+		{item{OK: true, Routing: &checkinRouting{Action: routeHoldShelf}}, 2},
+		{item{OK: true, Routing: &checkinRouting{Action: routeTransit, MagneticMedia: true}}, 3},
+		{item{OK: true, Routing: &checkinRouting{Action: routeShelve, MagneticMedia: true}}, 4},
+		{item{OK: true, MediaType: "006", Routing: &checkinRouting{Action: routeShelve}}, 6},
+		// no rule matches: use the SIP sort bin
+		{item{OK: true, Routing: &checkinRouting{Action: routeShelve, SortBin: "7"}}, 7},
+	}
+	for _, tt := range tests {
+		s.Expect(tt.want, srt.bin(tt.it))
+	}
+
+	// driven by the RFID service
+	cmd := srt.sort("1234", 2)
+	s.Expect(`{"Reader":"A","Cmd":"SORT","Data":"2","Barcode":"1234"}`+"\n", string(cmd))
+}
+
+func TestSorterConn(t *testing.T) {
+	s := specs.New(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	s.ExpectNil(err)
+	defer ln.Close()
+
+	srt := newSorter(sorterConfig{Addr: ln.Addr().String()})
+	defer srt.stop()
+	s.Expect(true, srt.sort("1234", 3) == nil)
+	go srt.conn.run()
+
+	conn, err := ln.Accept()
+	s.ExpectNil(err)
+	defer conn.Close()
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	s.ExpectNil(err)
+	s.Expect(`{"Cmd":"SORT","Barcode":"1234","Bin":3}`, strings.TrimSpace(line))
+
+	conn.Write([]byte(`{"Event": "BIN_FULL", "Bin": 3}` + "\n"))
+	select {
+	case ev := <-srt.events():
+		s.Expect(sorterBinFull, ev.Event)
+		s.Expect(3, ev.Bin)
+	case <-time.After(time.Second):
+		t.Fatal("no event from sorter")
+	}
+}
+
+func TestSorterStatus(t *testing.T) {
+	s := specs.New(t)
+	m := &appMetrics{automats: make(map[string]*automatStatus)}
+	m.SorterJams = metrics.NewCounter()
+
+	m.SorterEvent("10.0.0.1", sorterEvent{Event: sorterJam})
+	m.SorterEvent("10.0.0.1", sorterEvent{Event: sorterBinFull, Bin: 2})
+	m.SorterEvent("10.0.0.1", sorterEvent{Event: sorterBinFull, Bin: 3})
+	m.SorterEvent("10.0.0.1", sorterEvent{Event: sorterBinEmpty, Bin: 2})
+
+	st := m.automats["10.0.0.1"].copy()
+	s.Expect(true, st.Sorter.Jammed)
+	s.Expect([]int{3}, st.Sorter.FullBins)
+	s.Expect(int64(1), m.SorterJams.Count())
+
+	m.SorterEvent("10.0.0.1", sorterEvent{Event: sorterCleared})
+	s.Expect(false, m.automats["10.0.0.1"].Sorter.Jammed)
+}
@@ -1,32 +1,75 @@
 package main
 
 import (
+	"crypto/tls"
 	"log"
 	"net"
 	"time"
 )
 
 type TCPServer struct {
+	cfg        *liveConfig
+	certs      *certStore // TLS certificates; nil means plaintext
+	backend    Backend
+	guard      *loginGuard
+	stats      *appMetrics
+	usage      *usageStore // usage statistics; may be nil
+	news       *announcementStore
 	listenAddr string
+	ln         net.Listener
 	// TODO this map should use only IP as key, but use ip+port for now
 	// so integration test is easy on localhost (=same ip for all connections)
 	connections map[string]*Automat
 	addChan     chan *Automat
 	rmChan      chan *Automat
+	lookupChan  chan automatReq
+	reconf      chan *config
+	newsChan    chan bool // announcements changed
+	quit        chan bool
+	now         func() time.Time // for the opening hours schedules
 }
 
-func (srv TCPServer) run() {
-	ln, err := net.Listen("tcp", srv.listenAddr)
-	if err != nil {
-		log.Fatal(err)
+func newTCPServer(cfg *config, b Backend, g *loginGuard, m *appMetrics) *TCPServer {
+	return &TCPServer{
+		cfg:         &liveConfig{c: cfg},
+		backend:     b,
+		guard:       g,
+		stats:       m,
+		connections: make(map[string]*Automat, 0),
+		listenAddr:  ":" + cfg.TCPPort,
+		addChan:     make(chan *Automat),
+		rmChan:      make(chan *Automat),
+		lookupChan:  make(chan automatReq),
+		reconf:      make(chan *config),
+		newsChan:    make(chan bool),
+		quit:        make(chan bool),
+		now:         time.Now,
 	}
-	defer ln.Close()
+}
 
+// listen opens the TCP port.
+func (srv *TCPServer) listen() error {
+	var err error
+	if srv.certs != nil {
+		srv.ln, err = tls.Listen("tcp", srv.listenAddr, srv.certs.serverConfig())
+	} else {
+		srv.ln, err = net.Listen("tcp", srv.listenAddr)
+	}
+	return err
+}
+
+// serve accepts connections from the RFID services, until close.
+func (srv *TCPServer) serve() {
 	go srv.handleMessages()
 
 	for {
-		conn, err := ln.Accept()
+		conn, err := srv.ln.Accept()
 		if err != nil {
+			select {
+			case <-srv.quit:
+				return
+			default:
+			}
 			log.Println(err)
 			continue
 		}
@@ -34,60 +77,187 @@ func (srv TCPServer) run() {
 	}
 }
 
-func newTCPServer(cfg *config) *TCPServer {
-	return &TCPServer{
-		connections: make(map[string]*Automat, 0),
-		listenAddr:  ":" + cfg.TCPPort,
-		addChan:     make(chan *Automat),
-		rmChan:      make(chan *Automat),
+// close stops listening, and disconnects the automats.
+func (srv *TCPServer) close() {
+	close(srv.quit)
+	if srv.ln != nil {
+		srv.ln.Close()
 	}
 }
 
-func (srv TCPServer) get(addr string) <-chan *Automat {
-	c := make(chan *Automat)
-	for {
-		go func() {
-			if a, ok := srv.connections[addr]; ok {
-				c <- a
-				return
-			}
-		}()
-		return c
+// config returns the current config.
+func (srv *TCPServer) config() *config {
+	return srv.cfg.get()
+}
+
+// reconfigure replaces the config, and applies it to the connected automats.
+func (srv *TCPServer) reconfigure(c *config) {
+	srv.cfg.set(c)
+	select {
+	case srv.reconf <- c:
+	case <-srv.quit:
+	}
+}
+
+// announce tells handleMessages that the announcements have changed.
+func (srv *TCPServer) announce() {
+	select {
+	case srv.newsChan <- true:
+	case <-srv.quit:
+	}
+}
+
+// automatReq asks handleMessages for the automat connected from addr
+type automatReq struct {
+	addr  string
+	reply chan *Automat // nil if not connected
+}
+
+// lookup returns the automat connected from addr.
+func (srv *TCPServer) lookup(addr string) (*Automat, bool) {
+	r := automatReq{addr: addr, reply: make(chan *Automat, 1)}
+	select {
+	case srv.lookupChan <- r:
+	case <-srv.quit:
+		return nil, false
 	}
+	a := <-r.reply
+	return a, a != nil
 }
 
-func (srv TCPServer) handleMessages() {
-	ticker := time.NewTicker(time.Second * 60)
+// get returns a channel which receives the automat connected from addr, if
+// it is connected.
+func (srv *TCPServer) get(addr string) <-chan *Automat {
+	c := make(chan *Automat, 1)
+	go func() {
+		if a, ok := srv.lookup(addr); ok {
+			c <- a
+		}
+	}()
+	return c
+}
+
+func (srv *TCPServer) handleMessages() {
+	ticker := time.NewTicker(scheduleCheckInterval)
+	defer ticker.Stop()
+
+	// switch the automats to the opening hours mode of their schedule
+	hours := make(map[*Automat]string) // mode last sent
+	checkHours := func(c *config) {
+		now := srv.now()
+		for _, a := range srv.connections {
+			ac, ok := c.findAutomat(a.RFIDconn.RemoteAddr())
+			if !ok {
+				continue
+			}
+			if m := c.hoursMode(ac.Department, now); m != hours[a] {
+				hours[a] = m
+				a.postHours(m)
+			}
+		}
+	}
+
+	// send the automats' UIs the announcements for them when changed
+	news := make(map[*Automat]string) // IDs last sent
+	checkNews := func(c *config) {
+		for _, a := range srv.connections {
+			ac, _ := c.findAutomat(a.RFIDconn.RemoteAddr())
+			n := srv.news.active(ac.Name, a.host(), ac.Department)
+			if ids := announcementIDs(n); ids != news[a] {
+				news[a] = ids
+				a.postNews(n)
+			}
+		}
+	}
+
 	for {
 		select {
 		case <-ticker.C:
-			//log.Println("TCP number of connections:", len(srv.connections))
+			checkHours(srv.config())
+			checkNews(srv.config())
+		case <-srv.newsChan:
+			checkNews(srv.config())
 		case automat := <-srv.addChan:
 			log.Printf("TCP [%v] automat connected\n", automat.RFIDconn.RemoteAddr())
 			srv.connections[automat.RFIDconn.RemoteAddr().String()] = automat
-			stats.ClientsConnected.Inc(1)
+			hours[automat] = automat.hours
+			news[automat] = announcementIDs(automat.news)
+			srv.stats.ClientsConnected.Inc(1)
+			srv.stats.AutomatConnected(automat.host(), true)
 		case automat := <-srv.rmChan:
 			log.Printf("TCP [%v] automat disconnected\n", automat.RFIDconn.RemoteAddr())
-			// close ws connection
-			if automat.ws != nil { // panics if no connection
-				automat.ws.Close()
-			}
 			delete(srv.connections, automat.RFIDconn.RemoteAddr().String())
-			stats.ClientsConnected.Dec(1)
+			delete(hours, automat)
+			delete(news, automat)
+			srv.stats.ClientsConnected.Dec(1)
+			srv.stats.AutomatConnected(automat.host(), false)
+		case r := <-srv.lookupChan:
+			r.reply <- srv.connections[r.addr]
+		case <-srv.quit:
+			for _, a := range srv.connections {
+				a.RFIDconn.Close()
+			}
+			return
+		case c := <-srv.reconf:
+			for _, a := range srv.connections {
+				ac, ok := c.findAutomat(a.RFIDconn.RemoteAddr())
+				if !ok {
+					log.Printf("WARN TCP [%v] automat no longer in config\n", a.RFIDconn.RemoteAddr())
+					continue
+				}
+				a.postConf(ac)
+			}
+			checkHours(c)
+			checkNews(c)
 		}
 	}
 }
 
-func (srv TCPServer) handleConnection(c net.Conn) {
-	automat := newAutomat(c)
+func (srv *TCPServer) handleConnection(c net.Conn) {
 	defer c.Close()
+	ac, ok := srv.cfg.get().findAutomat(c.RemoteAddr())
+	if tc, isTLS := c.(*tls.Conn); isTLS {
+		if !ok {
+			log.Printf("TCP [%v] automat not in config, refusing TLS connection\n", c.RemoteAddr())
+			return
+		}
+		if err := verifyAutomatCert(tc, ac); err != nil {
+			log.Printf("ERROR TCP [%v] %s: %v\n", c.RemoteAddr(), ac.Name, err)
+			return
+		}
+	}
+
+	automat := newAutomat(c)
+	automat.backend = &recordingBackend{Backend: srv.backend, rec: automat.rec}
+	automat.guard = srv.guard
+	automat.stats = srv.stats
+	automat.usage = srv.usage
+	automat.checkItems = srv.cfg.get().ItemInfoBeforeCheckout
+	automat.refOnly = srv.cfg.get().ReferenceOnlyLocations
+	automat.recordDir = srv.cfg.get().RecordDir
+	if ok {
+		automat.configure(ac)
+		automat.setHours(srv.cfg.get().hoursMode(ac.Department, srv.now()))
+	} else {
+		log.Printf("TCP [%v] automat not in config\n", c.RemoteAddr())
+	}
+	if n := srv.news.active(ac.Name, automat.host(), ac.Department); len(n) > 0 {
+		automat.setNews(n)
+	}
 
 	// register automat
-	srv.addChan <- automat
+	select {
+	case srv.addChan <- automat:
+	case <-srv.quit:
+		return
+	}
 
 	// unregister when automat.Read() returns
 	defer func() {
-		srv.rmChan <- automat
+		select {
+		case srv.rmChan <- automat:
+		case <-srv.quit:
+		}
 	}()
 
 	go automat.run()
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// How often certificate files are checked for changes
+	certReloadInterval = time.Minute
+
+	tlsHandshakeTimeout = 10 * time.Second
+)
+
+// tlsConfig configures TLS for a connection. File names are PEM files.
+type tlsConfig struct {
+	Cert       string // certificate of the hub
+	Key        string // private key of Cert
+	CA         string // CA certificates verifying the other end
+	ServerName string // SIP: expected name in the server certificate; defaults to the host of SIPServer
+}
+
+// certStore holds the certificates of a tlsConfig, and reloads them when the
+// files change, so that certificates can be replaced without a restart.
+// New connections use the current certificates.
+type certStore struct {
+	cfg tlsConfig
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+	cas  *x509.CertPool // nil means the system roots
+	mod  time.Time      // modification time of the files when loaded
+}
+
+func newCertStore(c tlsConfig) (*certStore, error) {
+	if (c.Cert == "") != (c.Key == "") {
+		return nil, errors.New("TLS: Cert and Key must be given together")
+	}
+	s := &certStore{cfg: c}
+	return s, s.load()
+}
+
+func (s *certStore) files() []string {
+	var files []string
+	for _, f := range []string{s.cfg.Cert, s.cfg.Key, s.cfg.CA} {
+		if f != "" {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// modTime returns the latest modification time of the files.
+func (s *certStore) modTime() time.Time {
+	var t time.Time
+	for _, f := range s.files() {
+		if fi, err := os.Stat(f); err == nil && fi.ModTime().After(t) {
+			t = fi.ModTime()
+		}
+	}
+	return t
+}
+
+// load reads the files. On error, the certificates already loaded are kept.
+func (s *certStore) load() error {
+	mod := s.modTime()
+
+	var cert *tls.Certificate
+	if s.cfg.Cert != "" {
+		c, err := tls.LoadX509KeyPair(s.cfg.Cert, s.cfg.Key)
+		if err != nil {
+			return err
+		}
+		cert = &c
+	}
+
+	var cas *x509.CertPool
+	if s.cfg.CA != "" {
+		b, err := ioutil.ReadFile(s.cfg.CA)
+		if err != nil {
+			return err
+		}
+		cas = x509.NewCertPool()
+		if !cas.AppendCertsFromPEM(b) {
+			return fmt.Errorf("TLS: no certificates found in %s", s.cfg.CA)
+		}
+	}
+
+	s.mu.Lock()
+	s.cert, s.cas, s.mod = cert, cas, mod
+	s.mu.Unlock()
+	return nil
+}
+
+// reload loads the files again if they have changed since last load.
+func (s *certStore) reload() {
+	s.mu.RLock()
+	changed := s.modTime().After(s.mod)
+	s.mu.RUnlock()
+	if !changed {
+		return
+	}
+	if err := s.load(); err != nil {
+		log.Println("ERROR", "reloading certificates, keeping the old ones:", err)
+		return
+	}
+	log.Println("INFO", "reloaded certificates:", s.files())
+}
+
+// watch reloads changed certificates, until quit is closed.
+func (s *certStore) watch(interval time.Duration, quit <-chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.reload()
+		case <-quit:
+			return
+		}
+	}
+}
+
+func (s *certStore) current() (*tls.Certificate, *x509.CertPool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cert, s.cas
+}
+
+// serverConfig returns a TLS config requiring client certificates signed by
+// the CA. It picks up reloaded certificates for every new connection.
+func (s *certStore) serverConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, cas := s.current()
+			if cert == nil || cas == nil {
+				return nil, errors.New("TLS: server needs Cert, Key and CA")
+			}
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*cert},
+				ClientCAs:    cas,
+				ClientAuth:   tls.RequireAndVerifyClientCert,
+			}, nil
+		},
+	}
+}
+
+// clientConfig returns a TLS config for connecting to addr, with the current
+// certificates.
+func (s *certStore) clientConfig(addr string) *tls.Config {
+	cert, cas := s.current()
+	name := s.cfg.ServerName
+	if name == "" {
+		if h, _, err := net.SplitHostPort(addr); err == nil {
+			name = h
+		} else {
+			name = addr
+		}
+	}
+	c := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		RootCAs:    cas,
+		ServerName: name,
+	}
+	if cert != nil {
+		c.Certificates = []tls.Certificate{*cert}
+	}
+	return c
+}
+
+// verifyAutomatCert checks that the client certificate of an RFID connection
+// belongs to the automat: its common name must be the automat's CertName,
+// or Name if no CertName is configured.
+func verifyAutomatCert(c *tls.Conn, a automat) error {
+	c.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	err := c.Handshake()
+	c.SetDeadline(time.Time{})
+	if err != nil {
+		return err
+	}
+	certs := c.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return errors.New("no client certificate")
+	}
+	want := a.CertName
+	if want == "" {
+		want = a.Name
+	}
+	if got := certs[0].Subject.CommonName; got != want {
+		return fmt.Errorf("client certificate is for %q, expected %q", got, want)
+	}
+	return nil
+}
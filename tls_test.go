@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/knakk/specs"
+)
+
+// testCA issues certificates for tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key,
+		pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue writes a certificate and key for name to dir, and returns the file names.
+func (ca *testCA) issue(t *testing.T, dir, name string, serial int64) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{"hub"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kb, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kb}), 0600)
+	return certFile, keyFile
+}
+
+func TestMutualTLS(t *testing.T) {
+	s := specs.New(t)
+	dir, err := ioutil.TempDir("", "automathub-tls")
+	s.ExpectNil(err)
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t)
+	caFile := filepath.Join(dir, "ca.pem")
+	s.ExpectNil(ioutil.WriteFile(caFile, ca.pem, 0600))
+	hubCert, hubKey := ca.issue(t, dir, "hub", 2)
+	roaCert, roaKey := ca.issue(t, dir, "Røa1", 3)
+
+	srvCerts, err := newCertStore(tlsConfig{Cert: hubCert, Key: hubKey, CA: caFile})
+	s.ExpectNil(err)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", srvCerts.serverConfig())
+	s.ExpectNil(err)
+	defer ln.Close()
+
+	accepted := make(chan error)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- verifyAutomatCert(c.(*tls.Conn), automat{Name: "Røa1"})
+			c.Close()
+		}
+	}()
+
+	// the automat's own certificate is accepted
+	cliCerts, err := newCertStore(tlsConfig{Cert: roaCert, Key: roaKey, CA: caFile, ServerName: "hub"})
+	s.ExpectNil(err)
+	c, err := tls.Dial("tcp", ln.Addr().String(), cliCerts.clientConfig(ln.Addr().String()))
+	s.ExpectNil(err)
+	s.ExpectNil(<-accepted)
+	c.Close()
+
+	// another automat's certificate is not
+	majCert, majKey := ca.issue(t, dir, "Maj1", 4)
+	cliCerts, err = newCertStore(tlsConfig{Cert: majCert, Key: majKey, CA: caFile, ServerName: "hub"})
+	s.ExpectNil(err)
+	c, err = tls.Dial("tcp", ln.Addr().String(), cliCerts.clientConfig(ln.Addr().String()))
+	s.ExpectNil(err)
+	s.Expect(false, <-accepted == nil)
+	c.Close()
+
+	// no client certificate: the handshake fails
+	noCert, err := newCertStore(tlsConfig{CA: caFile, ServerName: "hub"})
+	s.ExpectNil(err)
+	raw, err := net.Dial("tcp", ln.Addr().String())
+	s.ExpectNil(err)
+	tc := tls.Client(raw, noCert.clientConfig(ln.Addr().String()))
+	tc.Handshake()
+	s.Expect(false, <-accepted == nil)
+	tc.Close()
+}
+
+func TestCertReload(t *testing.T) {
+	s := specs.New(t)
+	dir, err := ioutil.TempDir("", "automathub-tls")
+	s.ExpectNil(err)
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t)
+	certFile, keyFile := ca.issue(t, dir, "hub", 2)
+	store, err := newCertStore(tlsConfig{Cert: certFile, Key: keyFile})
+	s.ExpectNil(err)
+	cert, _ := store.current()
+	first := cert.Certificate[0]
+
+	// unchanged files are not reloaded
+	store.reload()
+	cert, _ = store.current()
+	s.Expect(first, cert.Certificate[0])
+
+	// a broken certificate keeps the old one
+	later := time.Now().Add(time.Minute)
+	s.ExpectNil(ioutil.WriteFile(certFile, []byte("garbage"), 0600))
+	s.ExpectNil(os.Chtimes(certFile, later, later))
+	store.reload()
+	cert, _ = store.current()
+	s.Expect(first, cert.Certificate[0])
+
+	// a new certificate replaces it
+	ca.issue(t, dir, "hub", 3)
+	later = later.Add(time.Minute)
+	s.ExpectNil(os.Chtimes(certFile, later, later))
+	store.reload()
+	cert, _ = store.current()
+	s.Expect(false, string(first) == string(cert.Certificate[0]))
+
+	_, err = newCertStore(tlsConfig{Cert: certFile})
+	s.Expect(false, err == nil)
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Usage statistics: what the automats are used for, counted per automat,
+// branch and hour. The counts of each day are kept in a file of their own in
+// the usage directory, so they survive restarts, and only today's file is
+// rewritten.
+
+// usageCounts is what is counted.
+type usageCounts struct {
+	Checkins       int
+	Checkouts      int
+	Logins         int
+	LoginFailures  int
+	Failures       int // refused checkins and checkouts, library system errors
+	Sessions       int // patron sessions ended
+	SessionSeconds int // total length of the sessions
+}
+
+func (c *usageCounts) add(o usageCounts) {
+	c.Checkins += o.Checkins
+	c.Checkouts += o.Checkouts
+	c.Logins += o.Logins
+	c.LoginFailures += o.LoginFailures
+	c.Failures += o.Failures
+	c.Sessions += o.Sessions
+	c.SessionSeconds += o.SessionSeconds
+}
+
+// usageRow is the counts of an automat in an hour, or in a report, of a
+// group of them.
+type usageRow struct {
+	Hour    string `json:",omitempty"` // RFC3339; in reports grouped by day, the date
+	Automat string `json:",omitempty"`
+	Branch  string `json:",omitempty"`
+	usageCounts
+}
+
+type usageKey struct {
+	Hour, Automat, Branch string
+}
+
+// usageStore collects the counts. A nil *usageStore counts nothing.
+type usageStore struct {
+	dir string // where the days are stored; "" keeps them in memory only
+	now func() time.Time
+
+	mu    sync.Mutex
+	days  map[string]map[usageKey]*usageCounts // by date
+	dirty map[string]bool                      // days changed since flush
+}
+
+// usageFlushInterval is how often counts are written to disk.
+const usageFlushInterval = time.Minute
+
+// maxUsageDays is the longest period of a report, as each day is a file.
+const maxUsageDays = 366
+
+func newUsageStore(dir string) *usageStore {
+	return &usageStore{
+		dir:   dir,
+		now:   time.Now,
+		days:  make(map[string]map[usageKey]*usageCounts),
+		dirty: make(map[string]bool),
+	}
+}
+
+// hourOf returns the start of the hour of t.
+func hourOf(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+}
+
+// add adds counts to an automat in the current hour.
+func (u *usageStore) add(automat, branch string, c usageCounts) {
+	if u == nil {
+		return
+	}
+	hour := hourOf(u.now())
+	day := hour.Format(isoDate)
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	counts, ok := u.days[day]
+	if !ok {
+		// continue the day, i.e. after a restart
+		counts = make(map[usageKey]*usageCounts)
+		rows, err := u.load(day)
+		if err != nil {
+			log.Println("ERROR", "usage statistics:", err)
+		}
+		for _, r := range rows {
+			rc := r.usageCounts
+			counts[usageKey{r.Hour, r.Automat, r.Branch}] = &rc
+		}
+		u.days[day] = counts
+	}
+	k := usageKey{hour.Format(time.RFC3339), automat, branch}
+	if counts[k] == nil {
+		counts[k] = &usageCounts{}
+	}
+	counts[k].add(c)
+	u.dirty[day] = true
+}
+
+func (u *usageStore) file(day string) string {
+	return filepath.Join(u.dir, "usage-"+day+".json")
+}
+
+// load reads a stored day. Days without a file have no counts.
+func (u *usageStore) load(day string) ([]usageRow, error) {
+	if u.dir == "" {
+		return nil, nil
+	}
+	b, err := ioutil.ReadFile(u.file(day))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rows []usageRow
+	if err := json.Unmarshal(b, &rows); err != nil {
+		return nil, fmt.Errorf("%s: %v", u.file(day), err)
+	}
+	return rows, nil
+}
+
+// rowsOf returns the counts of a day, sorted.
+func rowsOf(counts map[usageKey]*usageCounts) []usageRow {
+	rows := make([]usageRow, 0, len(counts))
+	for k, c := range counts {
+		rows = append(rows, usageRow{Hour: k.Hour, Automat: k.Automat, Branch: k.Branch, usageCounts: *c})
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].Hour != rows[j].Hour {
+			return rows[i].Hour < rows[j].Hour
+		}
+		return rows[i].Automat < rows[j].Automat
+	})
+	return rows
+}
+
+// flush writes the changed days to disk. Days before today are then
+// forgotten; reports read them from disk.
+func (u *usageStore) flush() error {
+	if u == nil || u.dir == "" {
+		return nil
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	today := u.now().Format(isoDate)
+	for day := range u.dirty {
+		b, _ := json.MarshalIndent(rowsOf(u.days[day]), "", "  ")
+		if err := os.MkdirAll(u.dir, 0755); err != nil {
+			return err
+		}
+		// a new file is renamed into place, so a crash leaves the old one
+		tmp := u.file(day) + ".tmp"
+		if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, u.file(day)); err != nil {
+			return err
+		}
+		delete(u.dirty, day)
+	}
+	for day := range u.days {
+		if day != today {
+			delete(u.days, day)
+		}
+	}
+	return nil
+}
+
+// flushEvery flushes the counts at every interval, until quit is closed.
+func (u *usageStore) flushEvery(interval time.Duration, quit <-chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := u.flush(); err != nil {
+				log.Println("ERROR", "usage statistics:", err)
+			}
+		case <-quit:
+			return
+		}
+	}
+}
+
+// day returns the counts of a day, from memory or disk.
+func (u *usageStore) day(day string) ([]usageRow, error) {
+	u.mu.Lock()
+	counts, ok := u.days[day]
+	if ok {
+		rows := rowsOf(counts)
+		u.mu.Unlock()
+		return rows, nil
+	}
+	u.mu.Unlock()
+	return u.load(day)
+}
+
+// Groupings of usage reports
+var usageGroups = map[string]func(r usageRow, h time.Time) usageRow{
+	"automat": func(r usageRow, h time.Time) usageRow { return usageRow{Automat: r.Automat, Branch: r.Branch} },
+	"branch":  func(r usageRow, h time.Time) usageRow { return usageRow{Branch: r.Branch} },
+	"hour":    func(r usageRow, h time.Time) usageRow { return usageRow{Hour: r.Hour} },
+	"day":     func(r usageRow, h time.Time) usageRow { return usageRow{Hour: h.Format(isoDate)} },
+}
+
+// usageQuery selects what a report is made of.
+type usageQuery struct {
+	From, To time.Time // To is not included
+	Group    string    // see usageGroups
+	Automat  string    // only this automat, if given
+	Branch   string    // only this branch, if given
+}
+
+// usageReport is the counts of a period, by group.
+type usageReport struct {
+	From, To time.Time
+	Group    string
+	Rows     []usageRow
+	Total    usageCounts
+}
+
+// report sums up the counts of the query.
+func (u *usageStore) report(q usageQuery) (*usageReport, error) {
+	groupOf, ok := usageGroups[q.Group]
+	if !ok {
+		return nil, fmt.Errorf("unknown group: %q", q.Group)
+	}
+	sums := make(map[usageRow]*usageCounts)
+	r := &usageReport{From: q.From, To: q.To, Group: q.Group}
+	for d := q.From; d.Before(q.To); d = d.AddDate(0, 0, 1) {
+		rows, err := u.day(d.Format(isoDate))
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			h, err := time.Parse(time.RFC3339, row.Hour)
+			if err != nil || h.Before(q.From) || !h.Before(q.To) ||
+				(q.Automat != "" && row.Automat != q.Automat) ||
+				(q.Branch != "" && row.Branch != q.Branch) {
+				continue
+			}
+			g := groupOf(row, h)
+			if sums[g] == nil {
+				sums[g] = &usageCounts{}
+			}
+			sums[g].add(row.usageCounts)
+			r.Total.add(row.usageCounts)
+		}
+	}
+	for g, c := range sums {
+		g.usageCounts = *c
+		r.Rows = append(r.Rows, g)
+	}
+	sort.Slice(r.Rows, func(i, j int) bool {
+		a, b := r.Rows[i], r.Rows[j]
+		if a.Hour != b.Hour {
+			return a.Hour < b.Hour
+		}
+		if a.Branch != b.Branch {
+			return a.Branch < b.Branch
+		}
+		return a.Automat < b.Automat
+	})
+	return r, nil
+}
+
+// usagePeriod returns the period of a report: a "day", "week" (Monday to
+// Sunday) or "month" containing date.
+func usagePeriod(period string, date time.Time) (from, to time.Time, err error) {
+	from = time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, date.Location())
+	switch period {
+	case "day":
+		return from, from.AddDate(0, 0, 1), nil
+	case "week":
+		from = from.AddDate(0, 0, -(int(from.Weekday())+6)%7)
+		return from, from.AddDate(0, 0, 7), nil
+	case "month":
+		from = from.AddDate(0, 0, 1-from.Day())
+		return from, from.AddDate(0, 1, 0), nil
+	}
+	return from, from, fmt.Errorf("unknown period: %q", period)
+}
+
+// WriteCSV writes the rows of the report, with a header.
+func (r *usageReport) WriteCSV(out io.Writer) error {
+	w := csv.NewWriter(out)
+	w.Write([]string{"hour", "branch", "automat", "checkins", "checkouts", "logins",
+		"login_failures", "failures", "sessions", "session_seconds"})
+	for _, row := range r.Rows {
+		c := row.usageCounts
+		w.Write([]string{row.Hour, row.Branch, row.Automat, strconv.Itoa(c.Checkins),
+			strconv.Itoa(c.Checkouts), strconv.Itoa(c.Logins), strconv.Itoa(c.LoginFailures),
+			strconv.Itoa(c.Failures), strconv.Itoa(c.Sessions), strconv.Itoa(c.SessionSeconds)})
+	}
+	w.Flush()
+	return w.Error()
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/knakk/specs"
+)
+
+func TestUsageStore(t *testing.T) {
+	s := specs.New(t)
+	dir, err := ioutil.TempDir("", "automathub-usage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Date(2014, 1, 24, 10, 30, 0, 0, time.Local)
+	u := newUsageStore(dir)
+	u.now = func() time.Time { return now }
+	u.add("Røa1", "ROA", usageCounts{Logins: 1})
+	u.add("Røa1", "ROA", usageCounts{Checkouts: 1})
+	u.add("Hoved1", "HUTL", usageCounts{Checkins: 1})
+	now = now.Add(time.Hour)
+	u.add("Hoved1", "HUTL", usageCounts{Checkins: 1, Failures: 1})
+	s.ExpectNil(u.flush())
+
+	// a restart continues the day
+	u = newUsageStore(dir)
+	u.now = func() time.Time { return now }
+	u.add("Røa1", "ROA", usageCounts{Sessions: 1, SessionSeconds: 90})
+	now = now.AddDate(0, 0, 3) // next Monday
+	u.add("Røa1", "ROA", usageCounts{Checkouts: 2})
+	s.ExpectNil(u.flush())
+
+	from, to, _ := usagePeriod("day", time.Date(2014, 1, 24, 15, 0, 0, 0, time.Local))
+	r, err := u.report(usageQuery{From: from, To: to, Group: "automat"})
+	s.ExpectNil(err)
+	s.Expect(2, len(r.Rows))
+	s.Expect("Hoved1", r.Rows[0].Automat)
+	s.Expect(2, r.Rows[0].Checkins)
+	s.Expect("Røa1", r.Rows[1].Automat)
+	s.Expect(1, r.Rows[1].Sessions)
+	s.Expect(90, r.Rows[1].SessionSeconds)
+	s.Expect(1, r.Total.Checkouts)
+
+	r, _ = u.report(usageQuery{From: from, To: to, Group: "hour", Branch: "HUTL"})
+	s.Expect(2, len(r.Rows))
+	s.Expect(1, r.Rows[1].Failures)
+
+	from, to, _ = usagePeriod("week", time.Date(2014, 1, 22, 0, 0, 0, 0, time.Local))
+	s.Expect(time.Date(2014, 1, 20, 0, 0, 0, 0, time.Local), from)
+	r, _ = u.report(usageQuery{From: from, To: to, Group: "branch"})
+	s.Expect(1, r.Total.Checkouts)
+
+	from, to, _ = usagePeriod("month", time.Date(2014, 1, 22, 0, 0, 0, 0, time.Local))
+	s.Expect(time.Date(2014, 2, 1, 0, 0, 0, 0, time.Local), to)
+	r, _ = u.report(usageQuery{From: from, To: to, Group: "day"})
+	s.Expect(2, len(r.Rows))
+	s.Expect("2014-01-27", r.Rows[1].Hour)
+	s.Expect(3, r.Total.Checkouts)
+}
+
+func TestUsageHandler(t *testing.T) {
+	s := specs.New(t)
+	app := &App{usage: newUsageStore("")}
+	app.usage.now = func() time.Time { return time.Date(2014, 1, 24, 10, 30, 0, 0, time.Local) }
+	a := newTestAutomat()
+	a.usage = app.usage
+	a.backend = &fakeBackend{}
+	a.configure(automat{IP: "10.0.0.1", Name: "Røa1", Department: "ROA"})
+	a.handleRFID([]byte(`{"Command": "PATRON-CARD", "Barcode": "card1"}`))
+	runJob(a)
+	a.handleUI([]byte(`{"Action": "CHECKOUT"}`))
+	a.handleRFID([]byte(`{"Barcode": "03011174511003"}`))
+	runJob(a)
+	a.handleUI([]byte(`{"Action": "LOGOUT"}`))
+
+	w := httptest.NewRecorder()
+	app.usageHandler(w, httptest.NewRequest("GET", "/.usage?date=2014-01-24", nil))
+	s.Expect(http.StatusOK, w.Code)
+	var r usageReport
+	s.ExpectNil(json.Unmarshal(w.Body.Bytes(), &r))
+	s.Expect(1, len(r.Rows))
+	s.Expect(usageCounts{Logins: 1, Checkouts: 1, Sessions: 1}, r.Rows[0].usageCounts)
+
+	w = httptest.NewRecorder()
+	app.usageHandler(w, httptest.NewRequest("GET", "/.usage?from=2014-01-20&to=2014-01-24&group=branch&format=csv", nil))
+	s.Expect(http.StatusOK, w.Code)
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	s.Expect(2, len(lines))
+	s.Expect(",ROA,,0,1,1,0,0,1,0", lines[1])
+
+	w = httptest.NewRecorder()
+	app.usageHandler(w, httptest.NewRequest("GET", "/.usage?period=year", nil))
+	s.Expect(http.StatusBadRequest, w.Code)
+
+	// at most a year
+	w = httptest.NewRecorder()
+	app.usageHandler(w, httptest.NewRequest("GET", "/.usage?from=2013-01-01&to=2013-12-31", nil))
+	s.Expect(http.StatusOK, w.Code)
+	w = httptest.NewRecorder()
+	app.usageHandler(w, httptest.NewRequest("GET", "/.usage?from=2013-01-01&to=2014-01-01", nil))
+	s.Expect(http.StatusOK, w.Code)
+	w = httptest.NewRecorder()
+	app.usageHandler(w, httptest.NewRequest("GET", "/.usage?from=2013-01-01&to=2014-01-02", nil))
+	s.Expect(http.StatusBadRequest, w.Code)
+	w = httptest.NewRecorder()
+	app.usageHandler(w, httptest.NewRequest("GET", "/.usage?from=1000-01-01&to=9999-12-31", nil))
+	s.Expect(http.StatusBadRequest, w.Code)
+}
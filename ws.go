@@ -31,25 +31,33 @@ func (c *monitorConn) reader() {
 }
 
 type wsHub struct {
+	stats    *appMetrics
 	monitors map[*monitorConn]bool // Connected monitor pages
 	mReg     chan *monitorConn     // Register monitor
 	mUnReg   chan *monitorConn     // Unregister monitor
 }
 
-func NewHub() *wsHub {
+func NewHub(m *appMetrics) *wsHub {
 	return &wsHub{
+		stats:    m,
 		monitors: make(map[*monitorConn]bool),
 		mReg:     make(chan *monitorConn),
 		mUnReg:   make(chan *monitorConn),
 	}
 }
 
-func (h *wsHub) run() {
+func (h *wsHub) run(quit <-chan bool) {
 	ticker := time.NewTicker(time.Second * 1)
+	defer ticker.Stop()
 	for {
 		select {
+		case <-quit:
+			for c := range h.monitors {
+				go c.ws.Close()
+			}
+			return
 		case <-ticker.C:
-			m := stats.Export()
+			m := h.stats.Export()
 			for c := range h.monitors {
 				select {
 				case c.send <- m: